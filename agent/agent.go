@@ -3,21 +3,21 @@ package agent
 import (
 	"time"
 	"sync"
-	"path/filepath"
 	"log"
 	"path"
 	"github.com/prometheus/client_golang/prometheus"
 	"fmt"
+	"reflect"
 )
 
 const (
-	globRefreshInterval = 5 * time.Second
-	bufferSize = 100000
-	bufferTimeout = 10 * time.Second
-	timeout = 10 * time.Second
+	defaultGlobRefreshInterval = 5 * time.Second
+	defaultBufferSize = 100000
+	defaultBufferTimeout = 10 * time.Second
+	defaultTimeout = 10 * time.Second
+	maxFrameSize = 64 * 1024 * 1024
 )
 
-
 var (
 	logsCount = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name:    "oklogging_agent_logs_count",
@@ -31,6 +31,10 @@ var (
 		Name:    "oklogging_agent_bytes_written",
 		Help:    "Bytes written to server",
 	})
+	bytesUncompressed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:    "oklogging_agent_bytes_uncompressed",
+		Help:    "Bytes written to server before compression",
+	})
 	writeErrors = prometheus.NewCounter(prometheus.CounterOpts{
 		Name:    "oklogging_agent_write_errors",
 		Help:    "Write errors count",
@@ -56,12 +60,41 @@ var (
 		Name:    "oklogging_agent_write_histogram",
 		Help:    "Write buffer to server histogram",
 	})
+	spoolBatches = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:    "oklogging_agent_spool_batches",
+		Help:    "Batches waiting in spools",
+	})
+	spoolBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:    "oklogging_agent_spool_bytes",
+		Help:    "Bytes waiting in spools",
+	})
+	recordsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:    "oklogging_agent_records_dropped",
+		Help:    "Records dropped by transformers",
+	})
+	outputDroppedBatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:    "oklogging_agent_output_dropped_batches",
+		Help:    "Batches dropped by best-effort outputs",
+	})
+	rateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:    "oklogging_agent_records_rate_limited",
+		Help:    "Records dropped by rate limits",
+	})
+	checksumMismatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:    "oklogging_agent_checksum_mismatches",
+		Help:    "Batches rejected by the server because of checksum mismatch",
+	})
+	throttledBatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:    "oklogging_agent_throttled_batches",
+		Help:    "Batches rejected by overloaded servers with retry-after hints",
+	})
 )
 
 func init(){
 	prometheus.MustRegister(logsCount)
 	prometheus.MustRegister(bytesRead)
 	prometheus.MustRegister(bytesWritten)
+	prometheus.MustRegister(bytesUncompressed)
 	prometheus.MustRegister(writeErrors)
 	prometheus.MustRegister(writeOperations)
 
@@ -69,30 +102,263 @@ func init(){
 	prometheus.MustRegister(offsetsCommits)
 	prometheus.MustRegister(jsonHistogram)
 	prometheus.MustRegister(writeHistogram)
+	prometheus.MustRegister(spoolBatches)
+	prometheus.MustRegister(spoolBytes)
+	prometheus.MustRegister(recordsDropped)
+	prometheus.MustRegister(rateLimited)
+	prometheus.MustRegister(outputDroppedBatches)
+	prometheus.MustRegister(checksumMismatches)
+	prometheus.MustRegister(throttledBatches)
+}
+
+type LevelsConfig struct {
+	// MinLevel rules are tried in order, the first one matching log labels is used
+	MinLevel []MinLevelConfig
+}
+
+type Config struct {
+	// InputFormat is one of InputFormatDocker or InputFormatCri
+	InputFormat string
+	LogsDir string
+	OffsetsDir string
+	// Servers are "host:port" or "srv:<name>" entries, see ServerPool
+	Servers []string
+	// OutputFormat is one of OutputFormatRaw, OutputFormatPrefix or OutputFormatJson
+	OutputFormat string
+	// Compression is a list of codecs in preference order, the server picks one of them
+	Compression []string
+	// Tls is nil for plain tcp connections
+	Tls *TlsConfig
+	// Multiplex sends all logs over one connection per server instead of a connection per log
+	Multiplex bool
+	// Window is the max number of batches of a log sent without acknowledgements, it's ignored with Multiplex
+	Window int
+	// VersionedHandshake negotiates capabilities, servers without it would take the magic for a huge frame
+	VersionedHandshake bool
+	// Checksum adds CRC32C to batches if the server supports it
+	Checksum bool
+	// Dedup sends input offsets of batches, so the server skips records it has already written
+	Dedup bool
+	// HeartbeatInterval is the max idle time of server connections, heartbeats are disabled if it's negative
+	HeartbeatInterval time.Duration
+	// ServerPolicy is OutputRequired by default, it matters only if there are other outputs
+	ServerPolicy string
+	// Archive writes logs to local files too, nil disables it
+	Archive *ArchiveConfig
+	Multiline *MultilineConfig
+	// Filters are applied to logs matching their selectors after labels are added
+	Filters []FilterConfig
+	// Redact is applied to all logs after filters, nil disables it
+	Redact *RedactConfig
+	// Parsers turn text lines into fields, the first rule matching log labels is used,
+	// they require OutputFormatJson
+	Parsers []ParserConfig
+	// Structured parses json application logs, it requires OutputFormatJson
+	Structured *StructuredConfig
+	// Levels enables level detection, nil disables it
+	Levels *LevelsConfig
+	// RateLimit is applied to each log, it can be overridden by log labels
+	RateLimit RateLimitConfig
+	Metadata MetadataConfig
+	// SpoolDir keeps batches while the server is unavailable, spooling is disabled if it's empty
+	SpoolDir string
+	// SpoolMaxSize limits spool size of each log
+	SpoolMaxSize int64
+	// BufferSize, BufferTimeout, Timeout and GlobRefreshInterval use defaults if not set
+	BufferSize int
+	BufferTimeout time.Duration
+	Timeout time.Duration
+	GlobRefreshInterval time.Duration
+}
+
+func (config *Config) setDefaults() {
+	if config.ServerPolicy == "" {
+		config.ServerPolicy = OutputRequired
+	}
+	if config.Archive != nil && config.Archive.Policy == "" {
+		archive := *config.Archive
+		archive.Policy = OutputBestEffort
+		config.Archive = &archive
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultBufferSize
+	}
+	if config.BufferTimeout <= 0 {
+		config.BufferTimeout = defaultBufferTimeout
+	}
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.GlobRefreshInterval <= 0 {
+		config.GlobRefreshInterval = defaultGlobRefreshInterval
+	}
+}
+
+func (config Config) Validate() error {
+	if _, err := NewServerPool(config.Servers); err != nil {
+		return err
+	}
+	if config.OffsetsDir == "" {
+		return fmt.Errorf("empty offsets dir")
+	}
+	switch config.InputFormat {
+	case InputFormatDocker, InputFormatCri:
+	default:
+		return fmt.Errorf("unknown input format: %s", config.InputFormat)
+	}
+	if _, err := NewFormatter(config.OutputFormat); err != nil {
+		return err
+	}
+	if !config.VersionedHandshake && (len(config.Compression) > 0 || config.Multiplex || config.Window > 1 || config.Checksum || config.Dedup) {
+		return fmt.Errorf("compression, multiplex, window, checksum and dedup require the versioned handshake")
+	}
+	if config.Archive != nil {
+		if config.Archive.Dir == "" {
+			return fmt.Errorf("empty archive dir")
+		}
+		if err := ValidateOutputPolicy(config.ServerPolicy); err != nil {
+			return err
+		}
+		if err := ValidateOutputPolicy(config.Archive.Policy); err != nil {
+			return err
+		}
+		if config.ServerPolicy != OutputRequired && config.Archive.Policy != OutputRequired {
+			return fmt.Errorf("at least one output should be %s", OutputRequired)
+		}
+	}
+	if (config.Structured != nil || len(config.Parsers) > 0) && config.OutputFormat != OutputFormatJson {
+		return fmt.Errorf("structured logs require %s output format", OutputFormatJson)
+	}
+	for _, p := range config.Parsers {
+		if err := ValidatePattern(p.Pattern); err != nil {
+			return err
+		}
+	}
+	if config.Levels != nil {
+		for _, r := range config.Levels.MinLevel {
+			if err := ValidateLevel(r.Level); err != nil {
+				return err
+			}
+		}
+	}
+	for _, codec := range config.Compression {
+		if _, err := NewCompressor(codec); err != nil {
+			return err
+		}
+	}
+	return config.RateLimit.Validate()
+}
+
+// sameCopiers returns true if copiers started with one config don't need a restart to apply the other one.
+func sameCopiers(a, b Config) bool {
+	a.GlobRefreshInterval, b.GlobRefreshInterval = 0, 0
+	return reflect.DeepEqual(a, b)
+}
+
+// tailedLog is the file of a log being read now, rotated files are read before the active one.
+type tailedLog struct {
+	path string
+	fileId string
+	input *FileInput
+	copier *Copier
+}
+
+// agentSettings is everything built from Config, it's replaced as a whole on reload.
+type agentSettings struct {
+	config Config
+	globPatterns []string
+	parseRotation func(string) (string, int, bool)
+	getLabels func(string) (LogLabels, error)
+	newTransformer func() Transformer
+	enricher *Enricher
+	redact *RedactTransformer
+	output TcpOutputConfig
+	// mux is nil if logs have their own connections
+	mux *Multiplexer
+}
+
+func newAgentSettings(config Config) (*agentSettings, error) {
+	config.setDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	servers, err := NewServerPool(config.Servers)
+	if err != nil {
+		return nil, err
+	}
+	settings := &agentSettings{
+		config: config,
+		enricher: NewEnricher(config.Metadata),
+		output: TcpOutputConfig{
+			Servers: servers,
+			Timeout: config.Timeout,
+			Compression: config.Compression,
+			Window: config.Window,
+			VersionedHandshake: config.VersionedHandshake,
+			Checksum: config.Checksum,
+			Dedup: config.Dedup,
+			HeartbeatInterval: config.HeartbeatInterval,
+		},
+	}
+	switch config.InputFormat {
+	case InputFormatDocker:
+		settings.globPatterns = []string{
+			path.Join(config.LogsDir, "*/*" + dockerLogSuffix),
+			path.Join(config.LogsDir, "*/*" + dockerLogSuffix + ".*"),
+		}
+		settings.parseRotation = parseDockerRotation
+		settings.getLabels = GetLabelsByLog
+		settings.newTransformer = func() Transformer { return &DockerJsonTransformer{} }
+	case InputFormatCri:
+		settings.globPatterns = []string{path.Join(config.LogsDir, "*/*/*.log")}
+		settings.parseRotation = notRotated
+		settings.getLabels = GetLabelsByCriLog
+		settings.newTransformer = func() Transformer { return &CriTransformer{} }
+	}
+	if config.Redact != nil {
+		if settings.redact, err = NewRedactTransformer(*config.Redact); err != nil {
+			return nil, err
+		}
+	}
+	if config.Tls != nil {
+		if settings.output.Tls, err = NewTlsReloader(*config.Tls); err != nil {
+			return nil, err
+		}
+	}
+	if config.Multiplex {
+		settings.mux = NewMultiplexer(settings.output)
+	}
+	return settings, nil
 }
 
 type LogAgent struct {
-	globPattern string
+	agentSettings
 	lock sync.Mutex
-	copiers map[string]*Copier
+	logs map[string]*tailedLog
 	offsetStorage *OffsetStorage
-	server string
+	// reloads discards labels fetched with the settings before a reload
+	reloads int
 }
 
-func NewLogAgent(dockerContainersDir string, offsetStoreDir string, server string) (*LogAgent, error) {
-	if server == "" {
-		return nil, fmt.Errorf("empty server")
+func NewLogAgent(config Config) (*LogAgent, error) {
+	settings, err := newAgentSettings(config)
+	if err != nil {
+		return nil, err
 	}
 	logAgent :=  &LogAgent{
-		globPattern: path.Join(dockerContainersDir, "*/*-json.log"),
-		copiers: map[string]*Copier{},
-		server: server,
+		agentSettings: *settings,
+		logs: map[string]*tailedLog{},
 	}
-	var err error
-	logAgent.offsetStorage, err = NewOffsetStorage(offsetStoreDir)
+	logAgent.offsetStorage, err = NewOffsetStorage(config.OffsetsDir)
 	if err != nil {
 		return nil, err
 	}
+	if logAgent.output.Tls != nil {
+		go logAgent.output.Tls.Watch()
+	}
 	err = logAgent.refreshGlob()
 	if err != nil {
 		return nil, err
@@ -100,66 +366,270 @@ func NewLogAgent(dockerContainersDir string, offsetStoreDir string, server strin
 	return logAgent, nil
 }
 
+func (agent *LogAgent) globRefreshInterval() time.Duration {
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	return agent.config.GlobRefreshInterval
+}
+
 func (agent *LogAgent) Run() {
-	ticker := time.NewTicker(globRefreshInterval).C
-	for range ticker {
+	for {
+		time.Sleep(agent.globRefreshInterval())
 		err := agent.refreshGlob()
 		if err != nil {
-			log.Println("failed to refresh glob", agent.globPattern, err)
+			log.Println("failed to refresh glob", agent.globPatterns, err)
 			continue
 		}
 	}
 }
 
+// Reload applies a new config. If copiers are affected by the change they are stopped and started again
+// from committed offsets, the current config is kept if the new one is invalid.
+func (agent *LogAgent) Reload(config Config) error {
+	settings, err := newAgentSettings(config)
+	if err != nil {
+		return err
+	}
+	agent.lock.Lock()
+	if settings.config.OffsetsDir != agent.config.OffsetsDir {
+		agent.lock.Unlock()
+		return fmt.Errorf("offsets dir can't be changed on reload")
+	}
+	if sameCopiers(agent.config, settings.config) {
+		agent.config = settings.config
+		agent.lock.Unlock()
+		log.Println("config reloaded, copiers are kept")
+		return nil
+	}
+	if reflect.DeepEqual(agent.config.Metadata, settings.config.Metadata) {
+		// keep cached pods
+		settings.enricher = agent.enricher
+	}
+	if agent.output.Tls != nil {
+		agent.output.Tls.Close()
+	}
+	if settings.output.Tls != nil {
+		go settings.output.Tls.Watch()
+	}
+	mux := agent.mux
+	agent.agentSettings = *settings
+	agent.reloads++
+	// closed copiers are kept in logs until they finish, so refreshGlob doesn't start another copier of the log,
+	// they are waited without the lock as a copier may be blocked in a write
+	var copiers []*Copier
+	for _, tailed := range agent.logs {
+		tailed.copier.Close()
+		copiers = append(copiers, tailed.copier)
+	}
+	agent.lock.Unlock()
+	wg := sync.WaitGroup{}
+	for _, copier := range copiers {
+		wg.Add(1)
+		go func(copier *Copier) {
+			defer wg.Done()
+			copier.Wait()
+		}(copier)
+	}
+	wg.Wait()
+	if mux != nil {
+		mux.Close()
+	}
+	log.Println("config reloaded, restarting copiers")
+	return agent.refreshGlob()
+}
+
 func (agent *LogAgent) Close() {
 	agent.lock.Lock()
 	defer agent.lock.Unlock()
-	for file, copier := range agent.copiers {
-		copier.Close()
-		delete(agent.copiers, file)
+	for logPath, tailed := range agent.logs {
+		tailed.copier.Close()
+		delete(agent.logs, logPath)
 	}
 }
 
+// finished returns true if the file was rotated or removed and has been read to its end.
+func (t *tailedLog) finished(files []logFile) bool {
+	if files[len(files) - 1].fileId == t.fileId {
+		return false
+	}
+	size, err := t.input.Size()
+	if err != nil {
+		log.Println("failed to stat", t.path, err)
+		return false
+	}
+	return t.input.Committed() >= size
+}
+
+// logLabels queries docker and kubernetes, so it's called without the agent lock.
+// It returns labels sent with the log and labels configuring the agent, see Enricher.Enrich.
+func (s *agentSettings) logLabels(logPath string) (LogLabels, LogLabels, error) {
+	labels, err := s.getLabels(logPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	labels, settings := s.enricher.Enrich(labels)
+	return labels, settings, nil
+}
+
+func (agent *LogAgent) startCopier(file logFile, labels LogLabels, settings LogLabels) (*tailedLog, error) {
+	labels[formatLabel] = agent.config.OutputFormat
+	log.Println("got labels for log", file.path, labels)
+	in, err := NewFileInput(file.path, agent.offsetStorage)
+	if err != nil {
+		return nil, err
+	}
+	serverLabels := labels
+	if agent.config.Dedup {
+		serverLabels = make(LogLabels, len(labels) + 1)
+		for k, v := range labels {
+			serverLabels[k] = v
+		}
+		serverLabels[streamLabel] = streamIdentity(labels, in.FileId(), in.Generation())
+	}
+	var out Output = NewTcpOutput(agent.output, serverLabels)
+	if agent.mux != nil {
+		out = NewMuxOutput(agent.mux, serverLabels)
+	}
+	if archive := agent.config.Archive; archive != nil {
+		archivePath, err := archivePath(archive.Dir, labels)
+		if err != nil {
+			in.Close()
+			return nil, err
+		}
+		out = NewFanOutOutput([]FanOutTarget{
+			{Output: out, Required: agent.config.ServerPolicy == OutputRequired},
+			{Output: NewFileOutput(archivePath, archive.MaxSize), Required: archive.Policy == OutputRequired},
+		})
+	}
+	var multiline *Multiline
+	if agent.config.Multiline.Enabled() {
+		multiline = NewMultiline(*agent.config.Multiline)
+	}
+	formatter, _ := NewFormatter(agent.config.OutputFormat)
+	var spool *Spool
+	if agent.config.SpoolDir != "" {
+		if spool, err = NewSpool(path.Join(agent.config.SpoolDir, pathKey(file.logPath)), agent.config.SpoolMaxSize); err != nil {
+			in.Close()
+			return nil, err
+		}
+	}
+	transformer := TransformerChain{agent.newTransformer()}
+	for _, filter := range agent.config.Filters {
+		if filter.Selector.Matches(labels) {
+			transformer = append(transformer, NewFilterTransformer(filter))
+		}
+	}
+	if agent.redact != nil {
+		transformer = append(transformer, agent.redact)
+	}
+	// events are parsed once multiline lines are joined
+	var eventTransformer TransformerChain
+	if agent.config.OutputFormat == OutputFormatJson {
+		if pattern := choosePattern(agent.config.Parsers, withSettings(labels, settings)); pattern != nil {
+			eventTransformer = append(eventTransformer, NewParserTransformer(pattern))
+		}
+	}
+	if agent.config.Structured != nil {
+		eventTransformer = append(eventTransformer, NewStructuredTransformer(*agent.config.Structured, labels))
+	}
+	minLevel := ""
+	if agent.config.Levels != nil {
+		eventTransformer = append(eventTransformer, &LevelTransformer{})
+		minLevel = chooseMinLevel(agent.config.Levels.MinLevel, labels)
+	}
+	options := CopierOptions{
+		Multiline: multiline,
+		Stream: serverLabels[streamLabel],
+		Formatter: formatter,
+		Spool: spool,
+		RateLimiter: NewRateLimiter(agent.config.RateLimit.Override(withSettings(labels, settings))),
+		MinLevel: minLevel,
+		BufferSize: agent.config.BufferSize,
+		BufferTimeout: agent.config.BufferTimeout,
+	}
+	if len(eventTransformer) > 0 {
+		options.EventTransformer = eventTransformer
+	}
+	copier := NewCopier(in, out, transformer, options)
+	go copier.Run()
+	return &tailedLog{path: file.path, fileId: in.FileId(), input: in, copier: copier}, nil
+}
+
 func (agent *LogAgent) refreshGlob() error {
 	agent.lock.Lock()
-	defer agent.lock.Unlock()
-
-	files, err := filepath.Glob(agent.globPattern)
+	settings, reloads := agent.agentSettings, agent.reloads
+	logs, err := listLogs(agent.globPatterns, agent.parseRotation)
 	if err != nil {
+		agent.lock.Unlock()
 		return err
 	}
-	freshFiles := map[string]struct{}{}
-	for _, f := range files {
-		freshFiles[f] = struct{}{}
-		if _, ok := agent.copiers[f]; ok {
-			continue
+	var fileIds, logPaths []string
+	starting := map[string]logFile{}
+	for logPath, files := range logs {
+		logPaths = append(logPaths, logPath)
+		for _, f := range files {
+			fileIds = append(fileIds, f.fileId)
+			if f.path == logPath {
+				// offsets were saved by the log path before
+				agent.offsetStorage.MigratePath(f.path, f.fileId)
+			}
 		}
-		labels, err := GetLabelsByLog(f)
+		if tailed, ok := agent.logs[logPath]; ok {
+			if !tailed.copier.Closed() {
+				if tailed.finished(files) {
+					// the next file is started once the copier is closed
+					log.Println("finished reading rotated log", tailed.path)
+					tailed.copier.Close()
+				}
+				continue
+			}
+			delete(agent.logs, logPath)
+		}
+		starting[logPath] = files[chooseFile(files, agent.offsetStorage)]
+	}
+	for logPath, tailed := range agent.logs {
+		if _, ok := logs[logPath]; !ok {
+			tailed.copier.Close()
+			delete(agent.logs, logPath)
+		}
+	}
+	agent.offsetStorage.GC(fileIds)
+	if agent.config.SpoolDir != "" {
+		GCSpools(agent.config.SpoolDir, logPaths)
+	}
+	agent.lock.Unlock()
+
+	labels, logSettings := map[string]LogLabels{}, map[string]LogLabels{}
+	for logPath, file := range starting {
+		l, s, err := settings.logLabels(file.logPath)
 		if err != nil {
 			if err != ErrSkip {
-				log.Println("failed to get labels for log", f, err)
+				log.Println("failed to get labels for log", logPath, err)
 			}
 			continue
 		}
-		log.Println("got labels for log", f, labels)
-		in, err := NewFileInput(f, agent.offsetStorage)
-		if err != nil {
-			log.Println("failed to init input", err)
+		labels[logPath], logSettings[logPath] = l, s
+	}
+
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	if agent.reloads != reloads {
+		// the reload refreshes the list with new settings
+		return nil
+	}
+	for logPath, l := range labels {
+		if _, ok := agent.logs[logPath]; ok {
+			// started by a concurrent refresh
 			continue
 		}
-		out := NewTcpOutput(agent.server, labels, timeout)
-		copier := NewCopier(in, out, &DockerJsonTransformer{}, bufferSize, bufferTimeout)
-		go copier.Run()
-		agent.copiers[f] = copier
-	}
-	for file, copier := range agent.copiers {
-		if _, ok := freshFiles[file]; !ok {
-			copier.Close()
-			delete(agent.copiers, file)
+		tailed, err := agent.startCopier(starting[logPath], l, logSettings[logPath])
+		if err != nil {
+			log.Println("failed to start copier for log", logPath, err)
+			continue
 		}
+		agent.logs[logPath] = tailed
 	}
-	logsCount.Set(float64(len(agent.copiers)))
-	agent.offsetStorage.GC(files)
+	logsCount.Set(float64(len(agent.logs)))
 	log.Println("files list refreshed")
 	return nil
-}
\ No newline at end of file
+}
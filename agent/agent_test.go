@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// legacyServer accepts legacy handshakes and sends received batches to the channel until it's closed.
+func legacyServer(t *testing.T) (net.Listener, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	batches := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for first := true; ; first = false {
+					frame, err := readFrame(conn, 0)
+					if err != nil {
+						return
+					}
+					if !first {
+						batches <- string(frame)
+					}
+					if err := binary.Write(conn, binary.LittleEndian, int32(200)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l, batches
+}
+
+func TestLogAgentMigratesPathOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, batches := legacyServer(t)
+	defer l.Close()
+
+	logPath := path.Join(dir, "logs", "default_app-1_uid", "app", "0.log")
+	require.NoError(t, os.MkdirAll(path.Dir(logPath), 0755))
+	first := "2018-01-01T00:00:00Z stdout F a\n"
+	require.NoError(t, ioutil.WriteFile(logPath, []byte(first + "2018-01-01T00:00:01Z stdout F b\n"), 0644))
+	// saved by an older agent
+	offsets, err := NewOffsetStorage(path.Join(dir, "offsets"))
+	require.NoError(t, err)
+	require.NoError(t, offsets.Save(logPath, int64(len(first))))
+
+	agent, err := NewLogAgent(Config{
+		InputFormat: InputFormatCri,
+		LogsDir: path.Join(dir, "logs"),
+		OffsetsDir: path.Join(dir, "offsets"),
+		Servers: []string{l.Addr().String()},
+		OutputFormat: OutputFormatRaw,
+		BufferTimeout: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer agent.Close()
+
+	select {
+	case batch := <- batches:
+		assert.Equal(t, "b\n", batch)
+	case <- time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for a batch")
+	}
+	fileId, err := GetFileId(logPath)
+	require.NoError(t, err)
+	_, err = offsets.Get(logPath)
+	assert.Error(t, err, "the path offset is removed")
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if offset, _ := offsets.Get(fileId); offset == int64(len(first)) * 2 {
+			return
+		}
+	}
+	require.FailNow(t, "offset isn't saved by the inode")
+}
+
+func TestLogAgentReloadDoesNotBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// the server never replies, so the copier is blocked in the handshake up to the timeout
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	logPath := path.Join(dir, "logs", "default_app-1_uid", "app", "0.log")
+	require.NoError(t, os.MkdirAll(path.Dir(logPath), 0755))
+	require.NoError(t, ioutil.WriteFile(logPath, []byte("2018-01-01T00:00:00Z stdout F a\n"), 0644))
+	config := Config{
+		InputFormat: InputFormatCri,
+		LogsDir: path.Join(dir, "logs"),
+		OffsetsDir: path.Join(dir, "offsets"),
+		Servers: []string{l.Addr().String()},
+		OutputFormat: OutputFormatRaw,
+		BufferTimeout: 10 * time.Millisecond,
+		Timeout: 2 * time.Second,
+	}
+	agent, err := NewLogAgent(config)
+	require.NoError(t, err)
+	defer agent.Close()
+	select {
+	case conn := <- accepted:
+		defer conn.Close()
+	case <- time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for a connection")
+	}
+	var copier *Copier
+	agent.lock.Lock()
+	for _, tailed := range agent.logs {
+		copier = tailed.copier
+	}
+	agent.lock.Unlock()
+
+	config.OutputFormat = OutputFormatJson
+	reloaded := make(chan error)
+	go func() {
+		reloaded <- agent.Reload(config)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	agent.globRefreshInterval()
+	assert.True(t, time.Since(start) < 500 * time.Millisecond, "the agent lock is held while copiers stop")
+	require.NoError(t, <- reloaded)
+	assert.True(t, copier.Closed())
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+	require.Len(t, agent.logs, 1)
+	for _, tailed := range agent.logs {
+		assert.False(t, tailed.copier == copier, "copiers are restarted")
+	}
+}
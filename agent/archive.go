@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+type ArchiveConfig struct {
+	Dir string
+	// MaxSize moves the file to <file>.1 when it's exceeded, the previous one is removed
+	MaxSize int64
+	// Policy is OutputBestEffort by default
+	Policy string
+}
+
+// FileOutput appends batches to a local file.
+type FileOutput struct {
+	path string
+	maxSize int64
+	file *os.File
+	size int64
+}
+
+func NewFileOutput(path string, maxSize int64) *FileOutput {
+	return &FileOutput{path: path, maxSize: maxSize}
+}
+
+// archivePath returns <dir>/<docker.name>.log, the name is the same for docker and cri logs.
+func archivePath(dir string, labels LogLabels) (string, error) {
+	name := labels["docker.name"]
+	if name == "" {
+		return "", fmt.Errorf("no docker.name label for archive file name")
+	}
+	name = strings.NewReplacer("/", "_", "..", "_").Replace(name)
+	return path.Join(dir, name + ".log"), nil
+}
+
+func (o *FileOutput) String() string {
+	return "File(" + o.path + ")"
+}
+
+func (o *FileOutput) Close() {
+	if o.file != nil {
+		o.file.Close()
+		o.file = nil
+	}
+}
+
+func (o *FileOutput) open() error {
+	if err := os.MkdirAll(path.Dir(o.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	o.file, o.size = f, fi.Size()
+	return nil
+}
+
+func (o *FileOutput) Write(data []byte) error {
+	if o.file != nil && o.maxSize > 0 && o.size >= o.maxSize {
+		o.Close()
+		if err := os.Rename(o.path, o.path + ".1"); err != nil {
+			return err
+		}
+	}
+	if o.file == nil {
+		if err := o.open(); err != nil {
+			return err
+		}
+	}
+	n, err := o.file.Write(data)
+	o.size += int64(n)
+	if err != nil {
+		// reopen on the next write
+		o.Close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultBackoffMin = time.Second
+	defaultBackoffMax = time.Minute
+)
+
+// Backoff returns exponentially growing delays with jitter, each delay is random between a half and a whole
+// of min * 2^attempts, capped at max.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+	attempts uint
+}
+
+func (b *Backoff) Next() time.Duration {
+	d := b.Max
+	if b.attempts < 32 && b.Min << b.attempts < b.Max {
+		d = b.Min << b.attempts
+	}
+	b.attempts++
+	return d / 2 + time.Duration(rand.Int63n(int64(d / 2) + 1))
+}
+
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
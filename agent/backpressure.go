@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// capBackpressure makes the server reply retry-after hints with statusTooManyRequests
+	capBackpressure = "backpressure"
+	backpressureVersion = "1"
+	// statusTooManyRequests is replied by an overloaded server, the connection is kept unless it's pipelined
+	statusTooManyRequests = 429
+	retryAfterHintSize = 4
+)
+
+// RetryAfterError is returned while the server asks not to send batches.
+type RetryAfterError struct {
+	After time.Duration
+	Err error
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.Err, e.After)
+}
+
+// retryAfter returns the delay asked by the server, 0 for other errors.
+func retryAfter(err error) time.Duration {
+	if e, ok := err.(*RetryAfterError); ok {
+		return e.After
+	}
+	return 0
+}
+
+// decodeRetryAfter reads the hint in milliseconds.
+func decodeRetryAfter(hint []byte) (time.Duration, error) {
+	if len(hint) < retryAfterHintSize {
+		return 0, fmt.Errorf("invalid retry-after hint size: %d", len(hint))
+	}
+	return time.Duration(binary.LittleEndian.Uint32(hint)) * time.Millisecond, nil
+}
+
+func readRetryAfter(conn net.Conn, timeout time.Duration) (time.Duration, error) {
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return 0, err
+		}
+	}
+	hint := make([]byte, retryAfterHintSize)
+	if _, err := io.ReadFull(conn, hint); err != nil {
+		return 0, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return 0, err
+	}
+	return decodeRetryAfter(hint)
+}
+
+// throttle keeps the time until which the server doesn't accept batches.
+type throttle struct {
+	until time.Time
+}
+
+// wait returns RetryAfterError until the time the server has asked for.
+func (t *throttle) wait(server string) error {
+	if after := time.Until(t.until); after > 0 {
+		return &RetryAfterError{After: after, Err: fmt.Errorf("server %s is overloaded", server)}
+	}
+	return nil
+}
+
+func (t *throttle) set(after time.Duration) {
+	throttledBatches.Inc()
+	t.until = time.Now().Add(after)
+}
@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryAfter(t *testing.T) {
+	after, err := decodeRetryAfter([]byte{0xe8, 0x03, 0, 0})
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, after)
+	_, err = decodeRetryAfter([]byte{1})
+	assert.Error(t, err)
+
+	assert.Equal(t, time.Second, retryAfter(&RetryAfterError{After: time.Second, Err: StatusError(statusTooManyRequests)}))
+	assert.Equal(t, time.Duration(0), retryAfter(errors.New("failed")))
+
+	th := throttle{}
+	assert.NoError(t, th.wait("logs:1234"))
+	th.set(time.Minute)
+	assert.True(t, retryAfter(th.wait("logs:1234")) > 59 * time.Second)
+}
+
+type throttledOutput struct {
+	testOutput
+}
+
+func (o *throttledOutput) Write(data []byte) error {
+	return &RetryAfterError{After: time.Minute, Err: StatusError(statusTooManyRequests)}
+}
+
+func TestFanOutRetryAfter(t *testing.T) {
+	out := NewFanOutOutput([]FanOutTarget{{Output: &throttledOutput{testOutput{name: "server"}}, Required: true}, {Output: &testOutput{name: "archive"}, Required: true}})
+	assert.Equal(t, time.Minute, retryAfter(out.Write([]byte("a\n"))))
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// capDedup makes batches carry input offsets, the server skips records it has written
+	capDedup = "dedup"
+	dedupVersion = "1"
+	// streamLabel identifies the input of a log, offsets of different streams aren't related
+	streamLabel = "oklogging.stream"
+)
+
+// Batch is formatted records with input offsets they were read up to, so the server can skip records
+// it has already written.
+type Batch struct {
+	Data []byte
+	// End is the input offset after the batch including dropped records, 0 if it isn't known
+	End int64
+	// Marks are end offsets of records in order
+	Marks []BatchMark
+	// Stream is the identity of the input the offsets belong to, see streamIdentity
+	Stream string
+}
+
+type BatchMark struct {
+	// Offset is the input offset after the record
+	Offset int64
+	// Pos is the end of the record in Data
+	Pos int
+}
+
+// BatchWriter is implemented by outputs using input offsets of batches.
+type BatchWriter interface {
+	WriteBatch(*Batch) error
+}
+
+func writeBatch(out Output, batch *Batch) error {
+	if w, ok := out.(BatchWriter); ok {
+		return w.WriteBatch(batch)
+	}
+	return out.Write(batch.Data)
+}
+
+// copyBatch returns the batch with its own copy of data.
+func copyBatch(batch *Batch) *Batch {
+	return &Batch{
+		Data: append([]byte(nil), batch.Data...),
+		End: batch.End,
+		Marks: append([]BatchMark(nil), batch.Marks...),
+		Stream: batch.Stream,
+	}
+}
+
+// encodeOffsets returns varints of the end and of mark deltas.
+func (b *Batch) encodeOffsets() []byte {
+	buf := make([]byte, binary.MaxVarintLen64 * (2 + 2 * len(b.Marks)))
+	n := binary.PutUvarint(buf, uint64(b.End))
+	n += binary.PutUvarint(buf[n:], uint64(len(b.Marks)))
+	offset, pos := int64(0), 0
+	for _, m := range b.Marks {
+		n += binary.PutUvarint(buf[n:], uint64(m.Offset - offset))
+		n += binary.PutUvarint(buf[n:], uint64(m.Pos - pos))
+		offset, pos = m.Offset, m.Pos
+	}
+	return buf[:n]
+}
+
+// decodeOffsets sets offsets of the batch and returns the rest of data.
+func (b *Batch) decodeOffsets(data []byte) ([]byte, error) {
+	r := bytes.NewReader(data)
+	end, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(data)) {
+		return nil, fmt.Errorf("invalid batch marks count: %d", count)
+	}
+	b.End, b.Marks = int64(end), make([]BatchMark, 0, count)
+	offset, pos := int64(0), 0
+	for i := uint64(0); i < count; i++ {
+		offsetDelta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		posDelta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		offset, pos = offset + int64(offsetDelta), pos + int(posDelta)
+		b.Marks = append(b.Marks, BatchMark{Offset: offset, Pos: pos})
+	}
+	return data[len(data) - r.Len():], nil
+}
+
+// streamIdentity is stable while the file is read, including agent restarts, but differs for rotated files.
+// The generation tells apart a file reusing the inode of a removed one, see OffsetStorage.Generation.
+func streamIdentity(labels map[string]string, fileId string, generation string) string {
+	name, ok := labels["container_id"]
+	if !ok {
+		name = labels["docker.name"]
+	}
+	return name + "/" + fileId + "/" + generation
+}
+
+// encodeBatch returns the body of a data frame: the checksum, input offsets and compressed data,
+// depending on what the server has accepted.
+func encodeBatch(batch *Batch, compressor Compressor, dedup bool, checksum bool) ([]byte, error) {
+	payload := batch.Data
+	if compressor != nil {
+		var err error
+		if payload, err = compressor.Compress(batch.Data); err != nil {
+			return nil, err
+		}
+	}
+	if dedup {
+		payload = append(batch.encodeOffsets(), payload...)
+	}
+	if checksum {
+		payload = withChecksum(payload)
+	}
+	return payload, nil
+}
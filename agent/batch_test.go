@@ -0,0 +1,27 @@
+package agent
+
+import (
+	"testing"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchOffsets(t *testing.T) {
+	batch := &Batch{Data: []byte("a\nbb\n"), End: 300, Marks: []BatchMark{{Offset: 2, Pos: 2}, {Offset: 290, Pos: 5}}}
+	data := append(batch.encodeOffsets(), batch.Data...)
+
+	decoded := &Batch{}
+	rest, err := decoded.decodeOffsets(data)
+	require.NoError(t, err)
+	assert.Equal(t, batch.End, decoded.End)
+	assert.Equal(t, batch.Marks, decoded.Marks)
+	assert.Equal(t, "a\nbb\n", string(rest))
+
+	_, err = decoded.decodeOffsets(data[:3])
+	assert.Error(t, err)
+}
+
+func TestStreamIdentity(t *testing.T) {
+	assert.Equal(t, "abc/1_2/f00d", streamIdentity(map[string]string{"container_id": "abc", "docker.name": "app"}, "1_2", "f00d"))
+	assert.Equal(t, "k8s_app/1_2/f00d", streamIdentity(map[string]string{"docker.name": "k8s_app"}, "1_2", "f00d"))
+}
@@ -0,0 +1,25 @@
+package agent
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+const (
+	capChecksum = "checksum"
+	checksumCrc32c = "crc32c"
+	checksumSize = 4
+	// statusChecksumMismatch is replied for corrupted batches, they are sent again
+	statusChecksumMismatch = 422
+	maxChecksumRetries = 3
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// withChecksum prefixes the payload with its CRC32C.
+func withChecksum(payload []byte) []byte {
+	frame := make([]byte, checksumSize + len(payload))
+	binary.LittleEndian.PutUint32(frame, crc32.Checksum(payload, crc32cTable))
+	copy(frame[checksumSize:], payload)
+	return frame
+}
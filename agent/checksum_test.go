@@ -0,0 +1,13 @@
+package agent
+
+import (
+	"encoding/binary"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithChecksum(t *testing.T) {
+	frame := withChecksum([]byte("123456789"))
+	assert.Equal(t, uint32(0xe3069283), binary.LittleEndian.Uint32(frame))
+	assert.Equal(t, "123456789", string(frame[checksumSize:]))
+}
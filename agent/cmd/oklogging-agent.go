@@ -4,24 +4,199 @@ import (
 	".."
 	"log"
 	"flag"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
+	"regexp"
+	"time"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
+const (
+	configCheckInterval = 5 * time.Second
+)
+
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+type kubeApiConfig struct {
+	url, tokenFile, caFile string
+}
+
+// podSources keeps kubernetes api clients between config reloads, so unchanged metadata settings
+// don't restart copiers.
+var podSources = map[kubeApiConfig]agent.PodSource{}
+
+func podSource(metadata agent.MetadataFileConfig) (agent.PodSource, error) {
+	key := kubeApiConfig{metadata.KubeApi, metadata.KubeTokenFile, metadata.KubeCaFile}
+	if pods, ok := podSources[key]; ok {
+		return pods, nil
+	}
+	pods, err := agent.NewPodSource(key.url, key.tokenFile, key.caFile)
+	if err != nil {
+		return nil, err
+	}
+	podSources[key] = pods
+	return pods, nil
+}
+
+func loadConfig(path string) (agent.Config, error) {
+	file, err := agent.LoadConfigFile(path)
+	if err != nil {
+		return agent.Config{}, err
+	}
+	config, err := file.Config()
+	if err != nil {
+		return agent.Config{}, err
+	}
+	if config.Metadata.NodeName == "" {
+		config.Metadata.NodeName = os.Getenv("NODE_NAME")
+	}
+	if config.Metadata.Pods, err = podSource(file.Metadata); err != nil {
+		return agent.Config{}, fmt.Errorf("failed to init kubernetes api client: %s", err)
+	}
+	return config, nil
+}
+
+// watchConfig reloads the config file on SIGHUP or when the file changes.
+func watchConfig(path string, loggingAgent *agent.LogAgent) {
+	modTime := time.Time{}
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(configCheckInterval)
+	for {
+		select {
+		case <- hup:
+			log.Println("got SIGHUP, reloading", path)
+		case <- ticker.C:
+			fi, err := os.Stat(path)
+			if err != nil {
+				log.Println("failed to check config file", err)
+				continue
+			}
+			if fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+			log.Println("config file changed, reloading", path)
+		}
+		config, err := loadConfig(path)
+		if err != nil {
+			log.Println("failed to load config, keeping the current one:", err)
+			continue
+		}
+		if err := loggingAgent.Reload(config); err != nil {
+			log.Println("failed to reload config:", err)
+		}
+	}
+}
+
 func main() {
-	var containersDir, offsetsDir, server, metricsListen string
+	var configPath, containersDir, podsDir, metricsListen string
+	var multilineStart, multilineContinue string
+	var servers, compression string
+	var useTls bool
+	archive := &agent.ArchiveConfig{}
+	tlsConfig := &agent.TlsConfig{}
+	var kubeApi, kubeTokenFile, kubeCaFile, labelsAllow, labelsDeny string
+	config := agent.Config{Multiline: &agent.MultilineConfig{}}
+	flag.StringVar(&configPath, "config", "", "YAML or JSON (*.json) config file, reloaded on SIGHUP or change; other flags except -metricsListen are ignored if set")
 	flag.StringVar(&containersDir, "containers-dir", "/var/lib/docker/containers", "containers path")
-	flag.StringVar(&offsetsDir, "offsets-dir", "", "offsets save dir")
+	flag.StringVar(&podsDir, "pods-dir", "/var/log/pods", "kubelet pods logs path (cri input format)")
+	flag.StringVar(&config.InputFormat, "input-format", agent.InputFormatDocker, "logs format: docker (json-file logging driver) or cri (containerd, cri-o)")
+	flag.StringVar(&config.OffsetsDir, "offsets-dir", "", "offsets save dir")
 	flag.StringVar(&metricsListen, "metricsListen", "", "ip:port of :port for /metrics")
-	flag.StringVar(&server, "server", "", "server ip:port")
+	flag.StringVar(&servers, "server", "", "comma separated servers: ip:port, host:port (all addresses of the host are used) or srv:<name> (DNS SRV records)")
+	flag.StringVar(&config.OutputFormat, "output-format", agent.OutputFormatRaw, "records format: raw (message only), prefix (\"<time> <stream> <message>\") or json")
+	flag.StringVar(&compression, "compression", "", "comma separated compression codecs in preference order: zstd, gzip, snappy")
+	flag.BoolVar(&useTls, "tls", false, "connect to the server with tls (implied by other -tls-* flags)")
+	flag.StringVar(&tlsConfig.CaFile, "tls-ca", "", "server CA bundle file, system roots are used if not set")
+	flag.StringVar(&tlsConfig.CertFile, "tls-cert", "", "client certificate file")
+	flag.StringVar(&tlsConfig.KeyFile, "tls-key", "", "client certificate key file")
+	flag.StringVar(&tlsConfig.ServerName, "tls-server-name", "", "server name to verify the server certificate against, the -server host by default")
+	flag.BoolVar(&config.Multiplex, "multiplex", false, "send all logs over one connection per server, requires a server supporting it")
+	flag.IntVar(&config.Window, "window", 1, "max batches of a log sent before the server acknowledges them, requires a server supporting it if more than 1")
+	flag.BoolVar(&config.VersionedHandshake, "versioned-handshake", false, "negotiate capabilities with the server, required by -compression, -multiplex, -window, -checksum and -dedup; servers have to support it")
+	flag.BoolVar(&config.Checksum, "checksum", false, "add CRC32C checksums to batches, the server verifies them before writing")
+	flag.DurationVar(&config.HeartbeatInterval, "heartbeat-interval", 30 * time.Second, "send heartbeats over server connections idle for this time, so the server doesn't close them, -1s disables them")
+	flag.BoolVar(&config.Dedup, "dedup", false, "send input offsets of batches, the server skips records it has already written when batches are sent again")
+	flag.StringVar(&config.ServerPolicy, "server-policy", agent.OutputRequired, "server output policy with other outputs: required (retry until written) or best-effort (drop failed batches)")
+	flag.StringVar(&archive.Dir, "archive-dir", "", "dir to archive logs to as <docker.name>.log files, disabled if not set")
+	flag.Int64Var(&archive.MaxSize, "archive-max-size", 100 * 1024 * 1024, "max archive file size, the file is moved to .1 then")
+	flag.StringVar(&archive.Policy, "archive-policy", agent.OutputBestEffort, "archive output policy: required or best-effort")
+	flag.StringVar(&config.SpoolDir, "spool-dir", "", "dir to keep batches in while the server is unavailable, spooling is disabled if not set")
+	flag.Int64Var(&config.SpoolMaxSize, "spool-max-size", 100 * 1024 * 1024, "max spool size in bytes per log")
+	flag.StringVar(&multilineStart, "multiline-start", "", "regexp matching the first line of a multiline event")
+	flag.StringVar(&multilineContinue, "multiline-continue", "", "regexp matching continuation lines of a multiline event")
+	flag.IntVar(&config.Multiline.MaxLines, "multiline-max-lines", 500, "max lines in a multiline event")
+	flag.DurationVar(&config.Multiline.MaxWait, "multiline-max-wait", 3 * time.Second, "max time to wait for the next line of a multiline event")
+	flag.StringVar(&config.Metadata.NodeName, "node-name", os.Getenv("NODE_NAME"), "node name label value")
+	flag.StringVar(&kubeApi, "kube-api", "", "kubernetes api url to get pod labels and annotations from, \"in-cluster\" for the service account config")
+	flag.StringVar(&kubeTokenFile, "kube-token-file", "", "kubernetes api bearer token file")
+	flag.StringVar(&kubeCaFile, "kube-ca-file", "", "kubernetes api CA certificate file")
+	flag.BoolVar(&config.Metadata.PodLabels, "pod-labels", false, "add pod labels as label.<name> (requires -kube-api)")
+	flag.BoolVar(&config.Metadata.PodAnnotations, "pod-annotations", false, "add pod annotations as annotation.<name> (requires -kube-api)")
+	flag.StringVar(&labelsAllow, "labels-allow", "", "comma separated label name patterns to send, all labels if empty")
+	flag.StringVar(&labelsDeny, "labels-deny", "", "comma separated label name patterns not to send")
+	flag.Float64Var(&config.RateLimit.LinesPerSecond, "rate-limit-lines", 0, "max lines per second per log, unlimited if 0")
+	flag.Float64Var(&config.RateLimit.BytesPerSecond, "rate-limit-bytes", 0, "max bytes per second per log, unlimited if 0")
+	flag.StringVar(&config.RateLimit.Overflow, "rate-limit-overflow", agent.RateLimitDrop, "lines over the rate limit: drop (with a summary line) or sample")
+	flag.IntVar(&config.RateLimit.Sample, "rate-limit-sample", 10, "keep 1 of N lines over the rate limit in sample mode")
 	flag.Parse()
-	if server == "" {
-		log.Fatalln("-server argument isn't set")
-	}
-	if offsetsDir == "" {
-		log.Fatalln("-offsets-dir argument isn't set")
+	var err error
+	if configPath != "" {
+		if config, err = loadConfig(configPath); err != nil {
+			log.Fatalln("failed to load config:", err)
+		}
+	} else {
+		if config.Servers = splitList(servers); len(config.Servers) == 0 {
+			log.Fatalln("-server argument isn't set")
+		}
+		if config.OffsetsDir == "" {
+			log.Fatalln("-offsets-dir argument isn't set")
+		}
+		if multilineStart != "" {
+			if config.Multiline.StartPattern, err = regexp.Compile(multilineStart); err != nil {
+				log.Fatalln("invalid -multiline-start:", err)
+			}
+		}
+		if multilineContinue != "" {
+			if config.Multiline.ContinuationPattern, err = regexp.Compile(multilineContinue); err != nil {
+				log.Fatalln("invalid -multiline-continue:", err)
+			}
+		}
+		config.LogsDir = containersDir
+		if config.InputFormat == agent.InputFormatCri {
+			config.LogsDir = podsDir
+		}
+		if config.Metadata.Pods, err = agent.NewPodSource(kubeApi, kubeTokenFile, kubeCaFile); err != nil {
+			log.Fatalln("failed to init kubernetes api client:", err)
+		}
+		config.Compression = splitList(compression)
+		if useTls || *tlsConfig != (agent.TlsConfig{}) {
+			config.Tls = tlsConfig
+		}
+		if archive.Dir != "" {
+			config.Archive = archive
+		}
+		config.Metadata.Allow = splitList(labelsAllow)
+		config.Metadata.Deny = splitList(labelsDeny)
 	}
-	loggingAgent, err := agent.NewLogAgent(containersDir, offsetsDir, server)
+
+	loggingAgent, err := agent.NewLogAgent(config)
 	if err != nil {
 		log.Fatalln("failed to init agent:", err)
 	}
@@ -33,5 +208,8 @@ func main() {
 			log.Fatal(http.ListenAndServe(metricsListen, nil))
 		}()
 	}
+	if configPath != "" {
+		go watchConfig(configPath, loggingAgent)
+	}
 	loggingAgent.Run()
-}
\ No newline at end of file
+}
@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionSnappy = "snappy"
+)
+
+type Compressor interface {
+	Compress([]byte) ([]byte, error)
+}
+
+func NewCompressor(codec string) (Compressor, error) {
+	switch codec {
+	case CompressionNone, "":
+		return nil, nil
+	case CompressionGzip:
+		return &GzipCompressor{}, nil
+	case CompressionZstd:
+		w, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &ZstdCompressor{writer: w}, nil
+	case CompressionSnappy:
+		return &SnappyCompressor{}, nil
+	}
+	return nil, fmt.Errorf("unknown compression: %s", codec)
+}
+
+type GzipCompressor struct {
+	buf bytes.Buffer
+	writer *gzip.Writer
+}
+
+func (c *GzipCompressor) Compress(data []byte) ([]byte, error) {
+	c.buf.Reset()
+	if c.writer == nil {
+		c.writer = gzip.NewWriter(&c.buf)
+	} else {
+		c.writer.Reset(&c.buf)
+	}
+	if _, err := c.writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := c.writer.Close(); err != nil {
+		return nil, err
+	}
+	return c.buf.Bytes(), nil
+}
+
+type ZstdCompressor struct {
+	buf []byte
+	writer *zstd.Encoder
+}
+
+func (c *ZstdCompressor) Compress(data []byte) ([]byte, error) {
+	c.buf = c.writer.EncodeAll(data, c.buf[:0])
+	return c.buf, nil
+}
+
+type SnappyCompressor struct {
+	buf []byte
+}
+
+func (c *SnappyCompressor) Compress(data []byte) ([]byte, error) {
+	c.buf = snappy.Encode(c.buf[:cap(c.buf)], data)
+	return c.buf, nil
+}
@@ -0,0 +1,336 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"time"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultContainersDir = "/var/lib/docker/containers"
+	defaultPodsDir = "/var/log/pods"
+	defaultSpoolMaxSize = 100 * 1024 * 1024
+	defaultArchiveMaxSize = 100 * 1024 * 1024
+)
+
+// Duration is a time.Duration written as a string like "10s" in config files.
+type Duration time.Duration
+
+func (d *Duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.set(s)
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return d.set(s)
+}
+
+type InputFileConfig struct {
+	// Format is docker or cri
+	Format string `yaml:"format" json:"format"`
+	// Dir is /var/lib/docker/containers or /var/log/pods by default
+	Dir string `yaml:"dir" json:"dir"`
+	OffsetsDir string `yaml:"offsets_dir" json:"offsets_dir"`
+}
+
+type MultilineFileConfig struct {
+	Start string `yaml:"start" json:"start"`
+	Continue string `yaml:"continue" json:"continue"`
+	MaxLines int `yaml:"max_lines" json:"max_lines"`
+	MaxWait Duration `yaml:"max_wait" json:"max_wait"`
+}
+
+type FilterFileConfig struct {
+	Selector map[string]string `yaml:"selector" json:"selector"`
+	Include []string `yaml:"include" json:"include"`
+	Exclude []string `yaml:"exclude" json:"exclude"`
+}
+
+type RedactRuleFileConfig struct {
+	Name string `yaml:"name" json:"name"`
+	Pattern string `yaml:"pattern" json:"pattern"`
+}
+
+type RedactFileConfig struct {
+	Rules []string `yaml:"rules" json:"rules"`
+	Custom []RedactRuleFileConfig `yaml:"custom" json:"custom"`
+	Mode string `yaml:"mode" json:"mode"`
+	Salt string `yaml:"salt" json:"salt"`
+}
+
+type StructuredFileConfig struct {
+	Rename map[string]string `yaml:"rename" json:"rename"`
+	Labels bool `yaml:"labels" json:"labels"`
+}
+
+type ParserFileConfig struct {
+	Selector map[string]string `yaml:"selector" json:"selector"`
+	// Pattern is a name of a builtin pattern, Regex is a custom one
+	Pattern string `yaml:"pattern" json:"pattern"`
+	Regex string `yaml:"regex" json:"regex"`
+}
+
+type MinLevelFileConfig struct {
+	Selector map[string]string `yaml:"selector" json:"selector"`
+	Level string `yaml:"level" json:"level"`
+}
+
+type LevelsFileConfig struct {
+	MinLevel []MinLevelFileConfig `yaml:"min_level" json:"min_level"`
+}
+
+type TransformersFileConfig struct {
+	Multiline *MultilineFileConfig `yaml:"multiline" json:"multiline"`
+	Filters []FilterFileConfig `yaml:"filters" json:"filters"`
+	Redact *RedactFileConfig `yaml:"redact" json:"redact"`
+	Parsers []ParserFileConfig `yaml:"parsers" json:"parsers"`
+	Structured *StructuredFileConfig `yaml:"structured" json:"structured"`
+	Levels *LevelsFileConfig `yaml:"levels" json:"levels"`
+}
+
+type MetadataFileConfig struct {
+	// NodeName is $NODE_NAME by default
+	NodeName string `yaml:"node_name" json:"node_name"`
+	// KubeApi is a url or "in-cluster"
+	KubeApi string `yaml:"kube_api" json:"kube_api"`
+	KubeTokenFile string `yaml:"kube_token_file" json:"kube_token_file"`
+	KubeCaFile string `yaml:"kube_ca_file" json:"kube_ca_file"`
+	PodLabels bool `yaml:"pod_labels" json:"pod_labels"`
+	PodAnnotations bool `yaml:"pod_annotations" json:"pod_annotations"`
+	LabelsAllow []string `yaml:"labels_allow" json:"labels_allow"`
+	LabelsDeny []string `yaml:"labels_deny" json:"labels_deny"`
+}
+
+type ArchiveFileConfig struct {
+	Dir string `yaml:"dir" json:"dir"`
+	MaxSize int64 `yaml:"max_size" json:"max_size"`
+	Policy string `yaml:"policy" json:"policy"`
+}
+
+type OutputFileConfig struct {
+	// Server is a shorthand for a single entry of Servers
+	Server string `yaml:"server" json:"server"`
+	Servers []string `yaml:"servers" json:"servers"`
+	// Policy is required or best-effort
+	Policy string `yaml:"policy" json:"policy"`
+	Archive *ArchiveFileConfig `yaml:"archive" json:"archive"`
+	Format string `yaml:"format" json:"format"`
+	Compression []string `yaml:"compression" json:"compression"`
+	Tls *TlsConfig `yaml:"tls" json:"tls"`
+	Multiplex bool `yaml:"multiplex" json:"multiplex"`
+	Window int `yaml:"window" json:"window"`
+	VersionedHandshake bool `yaml:"versioned_handshake" json:"versioned_handshake"`
+	Checksum bool `yaml:"checksum" json:"checksum"`
+	Dedup bool `yaml:"dedup" json:"dedup"`
+	HeartbeatInterval Duration `yaml:"heartbeat_interval" json:"heartbeat_interval"`
+	SpoolDir string `yaml:"spool_dir" json:"spool_dir"`
+	SpoolMaxSize int64 `yaml:"spool_max_size" json:"spool_max_size"`
+}
+
+type TuningFileConfig struct {
+	BufferSize int `yaml:"buffer_size" json:"buffer_size"`
+	BufferTimeout Duration `yaml:"buffer_timeout" json:"buffer_timeout"`
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+	GlobRefreshInterval Duration `yaml:"glob_refresh_interval" json:"glob_refresh_interval"`
+}
+
+type RateLimitFileConfig struct {
+	LinesPerSecond float64 `yaml:"lines_per_second" json:"lines_per_second"`
+	BytesPerSecond float64 `yaml:"bytes_per_second" json:"bytes_per_second"`
+	Overflow string `yaml:"overflow" json:"overflow"`
+	Sample int `yaml:"sample" json:"sample"`
+}
+
+// ConfigFile is the agent config file, YAML or JSON if the file name ends with .json.
+type ConfigFile struct {
+	Input InputFileConfig `yaml:"input" json:"input"`
+	Transformers TransformersFileConfig `yaml:"transformers" json:"transformers"`
+	Metadata MetadataFileConfig `yaml:"metadata" json:"metadata"`
+	Output OutputFileConfig `yaml:"output" json:"output"`
+	RateLimit RateLimitFileConfig `yaml:"rate_limit" json:"rate_limit"`
+	Tuning TuningFileConfig `yaml:"tuning" json:"tuning"`
+}
+
+// LoadConfigFile reads and validates a config file, unknown fields are errors.
+func LoadConfigFile(path string) (*ConfigFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &ConfigFile{}
+	if filepath.Ext(path) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(file)
+	} else {
+		err = yaml.UnmarshalStrict(data, file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	config, err := file.Config()
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Config returns the agent config, Metadata.Pods is left to the caller.
+func (file *ConfigFile) Config() (Config, error) {
+	config := Config{
+		InputFormat: file.Input.Format,
+		LogsDir: file.Input.Dir,
+		OffsetsDir: file.Input.OffsetsDir,
+		Servers: file.Output.Servers,
+		OutputFormat: file.Output.Format,
+		Compression: file.Output.Compression,
+		Tls: file.Output.Tls,
+		Multiplex: file.Output.Multiplex,
+		Window: file.Output.Window,
+		VersionedHandshake: file.Output.VersionedHandshake,
+		Checksum: file.Output.Checksum,
+		Dedup: file.Output.Dedup,
+		HeartbeatInterval: time.Duration(file.Output.HeartbeatInterval),
+		ServerPolicy: file.Output.Policy,
+		Metadata: MetadataConfig{
+			NodeName: file.Metadata.NodeName,
+			PodLabels: file.Metadata.PodLabels,
+			PodAnnotations: file.Metadata.PodAnnotations,
+			Allow: file.Metadata.LabelsAllow,
+			Deny: file.Metadata.LabelsDeny,
+		},
+		SpoolDir: file.Output.SpoolDir,
+		SpoolMaxSize: file.Output.SpoolMaxSize,
+		RateLimit: RateLimitConfig(file.RateLimit),
+		BufferSize: file.Tuning.BufferSize,
+		BufferTimeout: time.Duration(file.Tuning.BufferTimeout),
+		Timeout: time.Duration(file.Tuning.Timeout),
+		GlobRefreshInterval: time.Duration(file.Tuning.GlobRefreshInterval),
+	}
+	if config.InputFormat == "" {
+		config.InputFormat = InputFormatDocker
+	}
+	if config.LogsDir == "" {
+		config.LogsDir = defaultContainersDir
+		if config.InputFormat == InputFormatCri {
+			config.LogsDir = defaultPodsDir
+		}
+	}
+	if file.Output.Server != "" {
+		config.Servers = append([]string{file.Output.Server}, config.Servers...)
+	}
+	if config.OutputFormat == "" {
+		config.OutputFormat = OutputFormatRaw
+	}
+	if config.SpoolMaxSize <= 0 {
+		config.SpoolMaxSize = defaultSpoolMaxSize
+	}
+	if a := file.Output.Archive; a != nil {
+		config.Archive = &ArchiveConfig{Dir: a.Dir, MaxSize: a.MaxSize, Policy: a.Policy}
+		if config.Archive.MaxSize <= 0 {
+			config.Archive.MaxSize = defaultArchiveMaxSize
+		}
+	}
+	if m := file.Transformers.Multiline; m != nil {
+		config.Multiline = &MultilineConfig{MaxLines: m.MaxLines, MaxWait: time.Duration(m.MaxWait)}
+		var err error
+		if m.Start != "" {
+			if config.Multiline.StartPattern, err = regexp.Compile(m.Start); err != nil {
+				return config, fmt.Errorf("invalid multiline start: %s", err)
+			}
+		}
+		if m.Continue != "" {
+			if config.Multiline.ContinuationPattern, err = regexp.Compile(m.Continue); err != nil {
+				return config, fmt.Errorf("invalid multiline continue: %s", err)
+			}
+		}
+	}
+	for i, f := range file.Transformers.Filters {
+		filter := FilterConfig{Selector: NewLabelSelector(f.Selector)}
+		var err error
+		if filter.Include, err = compilePatterns(f.Include); err != nil {
+			return config, fmt.Errorf("invalid filter #%d include: %s", i, err)
+		}
+		if filter.Exclude, err = compilePatterns(f.Exclude); err != nil {
+			return config, fmt.Errorf("invalid filter #%d exclude: %s", i, err)
+		}
+		config.Filters = append(config.Filters, filter)
+	}
+	for i, p := range file.Transformers.Parsers {
+		parser := ParserConfig{Selector: NewLabelSelector(p.Selector)}
+		switch {
+		case p.Pattern != "" && p.Regex != "":
+			return config, fmt.Errorf("parser #%d should have either pattern or regex", i)
+		case p.Pattern != "":
+			var ok bool
+			if parser.Pattern, ok = BuiltinPatterns[p.Pattern]; !ok {
+				return config, fmt.Errorf("unknown parser #%d pattern: %s", i, p.Pattern)
+			}
+		default:
+			var err error
+			if parser.Pattern, err = regexp.Compile(p.Regex); err != nil {
+				return config, fmt.Errorf("invalid parser #%d regex: %s", i, err)
+			}
+		}
+		config.Parsers = append(config.Parsers, parser)
+	}
+	if l := file.Transformers.Levels; l != nil {
+		config.Levels = &LevelsConfig{}
+		for _, r := range l.MinLevel {
+			config.Levels.MinLevel = append(config.Levels.MinLevel, MinLevelConfig{Selector: NewLabelSelector(r.Selector), Level: r.Level})
+		}
+	}
+	if s := file.Transformers.Structured; s != nil {
+		config.Structured = &StructuredConfig{Rename: s.Rename, Labels: s.Labels}
+	}
+	if r := file.Transformers.Redact; r != nil {
+		config.Redact = &RedactConfig{Rules: r.Rules, Mode: r.Mode, Salt: r.Salt}
+		for _, rule := range r.Custom {
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return config, fmt.Errorf("invalid redact rule %s: %s", rule.Name, err)
+			}
+			config.Redact.Custom = append(config.Redact.Custom, RedactRule{Name: rule.Name, Pattern: pattern})
+		}
+		if _, err := NewRedactTransformer(*config.Redact); err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		r, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
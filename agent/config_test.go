@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"testing"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, dir, name, content string) string {
+	p := path.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+	return p
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := writeConfigFile(t, dir, "agent.yaml", `
+input:
+  format: cri
+  offsets_dir: /offsets
+transformers:
+  multiline:
+    start: '^\d{4}-'
+    max_wait: 1s
+  filters:
+  - selector: {namespace: ingress-nginx}
+    exclude: ['GET /healthz']
+  redact:
+    rules: [card, email]
+    custom:
+    - {name: password, pattern: 'password=(\S+)'}
+    mode: hash
+output:
+  server: logs:1234
+  versioned_handshake: true
+  compression: [zstd, gzip]
+  tls:
+    ca_file: /ca.pem
+tuning:
+  buffer_timeout: 2s
+`)
+	file, err := LoadConfigFile(p)
+	require.NoError(t, err)
+	config, err := file.Config()
+	require.NoError(t, err)
+	assert.Equal(t, InputFormatCri, config.InputFormat)
+	assert.Equal(t, defaultPodsDir, config.LogsDir)
+	assert.Equal(t, []string{"logs:1234"}, config.Servers)
+	assert.Equal(t, OutputFormatRaw, config.OutputFormat)
+	assert.Equal(t, []string{"zstd", "gzip"}, config.Compression)
+	assert.Equal(t, &TlsConfig{CaFile: "/ca.pem"}, config.Tls)
+	assert.Equal(t, `^\d{4}-`, config.Multiline.StartPattern.String())
+	assert.Equal(t, time.Second, config.Multiline.MaxWait)
+	assert.Len(t, config.Filters, 1)
+	assert.Equal(t, NewLabelSelector(map[string]string{"namespace": "ingress-nginx"}), config.Filters[0].Selector)
+	assert.Equal(t, "GET /healthz", config.Filters[0].Exclude[0].String())
+	assert.Equal(t, []string{"card", "email"}, config.Redact.Rules)
+	assert.Equal(t, "password", config.Redact.Custom[0].Name)
+	assert.Equal(t, RedactHash, config.Redact.Mode)
+	assert.Equal(t, 2 * time.Second, config.BufferTimeout)
+	assert.Equal(t, time.Duration(0), config.Timeout)
+
+	p = writeConfigFile(t, dir, "agent.json", `{
+	"input": {"offsets_dir": "/offsets"},
+	"output": {"server": "logs:1234", "format": "json"},
+	"tuning": {"glob_refresh_interval": "1m"}
+}`)
+	file, err = LoadConfigFile(p)
+	require.NoError(t, err)
+	config, err = file.Config()
+	require.NoError(t, err)
+	assert.Equal(t, InputFormatDocker, config.InputFormat)
+	assert.Equal(t, defaultContainersDir, config.LogsDir)
+	assert.Equal(t, OutputFormatJson, config.OutputFormat)
+	assert.Equal(t, time.Minute, config.GlobRefreshInterval)
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, content := range []string{
+		"input: {offsets_dir: /offsets}\noutput: {server: logs:1234, unknown: 1}\n",
+		"input: {offsets_dir: /offsets}\n",
+		"input: {offsets_dir: /offsets}\noutput: {server: logs:1234, format: xml}\n",
+		"input: {offsets_dir: /offsets}\noutput: {server: logs:1234}\ntransformers: {multiline: {start: '('}}\n",
+		"input: {offsets_dir: /offsets}\noutput: {server: logs:1234}\ntransformers: {filters: [{exclude: ['[']}]}\n",
+		"input: {offsets_dir: /offsets}\noutput: {server: logs:1234}\ntransformers: {redact: {rules: [ssn]}}\n",
+		"input: {offsets_dir: /offsets}\noutput: {server: logs:1234}\ntuning: {timeout: 10}\n",
+		"input: {offsets_dir: /offsets}\noutput: {server: logs:1234, multiplex: true}\n",
+	} {
+		_, err := LoadConfigFile(writeConfigFile(t, dir, "agent.yaml", content))
+		assert.Error(t, err, content)
+	}
+}
+
+func TestSameCopiers(t *testing.T) {
+	config := Config{Servers: []string{"logs:1234"}, Compression: []string{"zstd"}}
+	other := config
+	other.GlobRefreshInterval = time.Minute
+	assert.True(t, sameCopiers(config, other))
+	other.Compression = []string{"gzip"}
+	assert.False(t, sameCopiers(config, other))
+}
@@ -7,94 +7,526 @@ import (
 	"log"
 )
 
+type CopierOptions struct {
+	// Multiline is nil if lines aren't joined
+	Multiline *Multiline
+	// EventTransformer parses multiline events after they are joined, nil if records aren't parsed
+	EventTransformer Transformer
+	// Stream is the identity of the input sent with offsets of batches, see streamIdentity
+	Stream string
+	Formatter Formatter
+	// Spool is nil if failed batches are retried from memory
+	Spool *Spool
+	// RateLimiter is nil if records aren't limited
+	RateLimiter *RateLimiter
+	// MinLevel drops records with lower levels, it's applied to multiline events
+	MinLevel string
+	BufferSize int
+	BufferTimeout time.Duration
+}
+
 type Copier struct {
 	input Input
 	output Output
+	// pipeline is set if the output acknowledges batches asynchronously
+	pipeline PipelinedOutput
+	// inflight are unacknowledged batches of the pipeline in order
+	inflight []*inflightBatch
 	transformer Transformer
+	eventTransformer Transformer
+	multiline *Multiline
+	formatter Formatter
+	spool *Spool
+	rateLimiter *RateLimiter
+	minLevel string
+	stream string
 	ctx context.Context
 	cancelFn context.CancelFunc
-	closed bool
+	done chan struct{}
 	bufferSize int
 	bufferTimeout time.Duration
+	backoff Backoff
+	// retryAt delays writes after a failure while batches are spooled
+	retryAt time.Time
+	// throttledUntil is the retry-after hint of an overloaded server, the next retryAt isn't earlier
+	throttledUntil time.Time
+}
+
+type inflightBatch struct {
+	batch *Batch
+	offset int64
+	// seq is 0 until the batch is sent over the current connection
+	seq uint64
+}
 
+type inputLine struct {
+	line string
+	// start and offset are input offsets before and after the line
+	start int64
+	offset int64
 }
 
-func NewCopier(in Input, out Output, tr Transformer, bufferSize int, bufferTimeout time.Duration) *Copier {
+func NewCopier(in Input, out Output, tr Transformer, options CopierOptions) *Copier {
 	ctx, cancelFn := context.WithCancel(context.Background())
+	pipeline, ok := out.(PipelinedOutput)
+	if !ok || pipeline.Window() <= 1 {
+		pipeline = nil
+	}
 	return &Copier{
+		pipeline: pipeline,
 		input: in,
 		output: out,
 		transformer: tr,
+		eventTransformer: options.EventTransformer,
+		multiline: options.Multiline,
+		formatter: options.Formatter,
+		spool: options.Spool,
+		rateLimiter: options.RateLimiter,
+		minLevel: options.MinLevel,
+		stream: options.Stream,
 		ctx: ctx,
 		cancelFn: cancelFn,
-		closed: false,
-		bufferSize: bufferSize,
-		bufferTimeout: bufferTimeout,
+		done: make(chan struct{}),
+		bufferSize: options.BufferSize,
+		bufferTimeout: options.BufferTimeout,
+		backoff: Backoff{Min: defaultBackoffMin, Max: defaultBackoffMax},
 	}
 }
 
+// Closed returns true when Run has finished and everything is closed.
 func (c *Copier) Closed() bool {
-	return c.closed
+	select {
+	case <- c.done:
+		return true
+	default:
+		return false
+	}
 }
 
 func (c *Copier) Close() {
-	if c.closed {
-		return
-	}
+	c.cancelFn()
+}
+
+// Wait blocks until Run has finished.
+func (c *Copier) Wait() {
+	<- c.done
+}
+
+func (c *Copier) close() {
+	c.cancelFn()
 	c.input.Close()
 	c.output.Close()
-	c.closed = true
+	if c.spool != nil {
+		c.spool.Close()
+	}
+	close(c.done)
 	return
 }
 
+func (c *Copier) readLines(lines chan<- inputLine) {
+	defer close(lines)
+	start, err := c.input.Offset()
+	if err != nil {
+		log.Println("failed to get input offset", err)
+		return
+	}
+	for {
+		line, err := c.input.ReadLine()
+		if err != nil {
+			//todo: logging
+			return
+		}
+		offset, err := c.input.Offset()
+		if err != nil {
+			log.Println("failed to get input offset", err)
+			return
+		}
+		select {
+		case <- c.ctx.Done():
+			return
+		case lines <- inputLine{line: line, start: start, offset: offset}:
+		}
+		start = offset
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <- t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// sleep waits for d or until the copier is closed.
+func (c *Copier) sleep(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <- c.ctx.Done():
+	case <- t.C:
+	}
+}
+
+// throttle keeps the retry-after hint of the write error.
+func (c *Copier) throttle(err error) {
+	if after := retryAfter(err); after > 0 {
+		c.throttledUntil = time.Now().Add(after)
+	}
+}
+
+// heartbeat keeps the output connection alive while the log is idle.
+func (c *Copier) heartbeat() {
+	h, ok := c.output.(Heartbeater)
+	if !ok || time.Now().Before(c.retryAt) {
+		return
+	}
+	if err := h.Heartbeat(); err != nil {
+		log.Println("failed to send heartbeat to output", c.output, err)
+		// the connection is closed, unacknowledged batches are sent again over the next one
+		for _, b := range c.inflight {
+			b.seq = 0
+		}
+	}
+}
+
+// drainSpool writes spooled batches in order, it returns false if the output has failed.
+func (c *Copier) drainSpool() bool {
+	for c.spool != nil && !c.spool.Empty() {
+		if c.ctx.Err() != nil {
+			return false
+		}
+		batch, err := c.spool.PeekBatch()
+		if err != nil {
+			log.Println("failed to read spooled batch", err)
+			return false
+		}
+		if batch.Stream != c.stream {
+			// offsets of the file spooled before rotation would make the server skip records of this one
+			batch.End, batch.Marks = 0, nil
+		}
+		writeOperations.Inc()
+		if err := writeBatch(c.output, batch); err != nil {
+			log.Println("failed to write spooled batch to output", c.output, err)
+			writeErrors.Inc()
+			c.throttle(err)
+			return false
+		}
+		if err := c.spool.Pop(); err != nil {
+			log.Println("failed to remove spooled batch", err)
+			return false
+		}
+	}
+	return true
+}
+
+// sendInflight sends batches which aren't sent over the current connection, all of them are sent again
+// after a failure.
+func (c *Copier) sendInflight() bool {
+	for _, b := range c.inflight {
+		if b.seq != 0 {
+			continue
+		}
+		writeOperations.Inc()
+		seq, err := c.pipeline.Send(b.batch)
+		if err != nil {
+			log.Println("failed to write to output", c.output, err)
+			writeErrors.Inc()
+			c.throttle(err)
+			for _, b := range c.inflight {
+				b.seq = 0
+			}
+			return false
+		}
+		b.seq = seq
+	}
+	return true
+}
+
+// ackedOffset removes acknowledged batches and returns the offset of the last one.
+func (c *Copier) ackedOffset() (int64, bool) {
+	acked := c.pipeline.Acked()
+	n := 0
+	for n < len(c.inflight) && c.inflight[n].seq != 0 && c.inflight[n].seq <= acked {
+		n++
+	}
+	if n == 0 {
+		return 0, false
+	}
+	offset := c.inflight[n - 1].offset
+	c.inflight = c.inflight[n:]
+	return offset, true
+}
+
 func (c *Copier) Run() {
-	defer c.Close()
+	defer c.close()
 	buf := &bytes.Buffer{}
+	// offset of the last line written to buf or dropped, lines held by multiline aren't committed until they are flushed
+	bufOffset, savedOffset := int64(0), int64(0)
+	// marks are offsets of records in buf
+	var marks []BatchMark
+	batch := func() *Batch {
+		return &Batch{Data: buf.Bytes(), End: bufOffset, Marks: marks, Stream: c.stream}
+	}
+	resetBuffer := func() {
+		buf.Reset()
+		marks = marks[:0]
+	}
 	flushTimer := time.NewTimer(c.bufferTimeout)
+	defer flushTimer.Stop()
+	multilineTimer := time.NewTimer(0)
+	defer multilineTimer.Stop()
+	if !multilineTimer.Stop() {
+		<- multilineTimer.C
+	}
+
+	// retrying returns true while writes are delayed after a failure, the delay grows with each failure
+	retrying := func(written bool) bool {
+		if written {
+			c.backoff.Reset()
+		} else if time.Now().After(c.retryAt) {
+			c.retryAt = time.Now().Add(c.backoff.Next())
+			if c.throttledUntil.After(c.retryAt) {
+				c.retryAt = c.throttledUntil
+			}
+		}
+		return !written
+	}
+
+	saveOffset := func(offset int64) {
+		if offset == savedOffset {
+			return
+		}
+		if err := c.input.SaveOffset(offset); err != nil {
+			log.Println("failed to save input offset", err)
+		}
+		savedOffset = offset
+	}
+
+	commitAcked := func() {
+		if offset, ok := c.ackedOffset(); ok {
+			saveOffset(offset)
+		}
+	}
+
+	// flushPipeline sends the buffer without waiting for acknowledgements, offsets are saved when batches are acknowledged
+	flushPipeline := func() {
+		resetTimer(flushTimer, c.bufferTimeout)
+		commitAcked()
+		written := false
+		if time.Now().After(c.retryAt) {
+			// new batches are taken only when previous ones are sent, so memory is bounded by the window
+			written = c.drainSpool() && c.sendInflight()
+			if written && buf.Len() > 0 {
+				c.inflight = append(c.inflight, &inflightBatch{batch: copyBatch(batch()), offset: bufOffset})
+				resetBuffer()
+				written = c.sendInflight()
+			} else if written && bufOffset != savedOffset {
+				// only dropped records since the last flush
+				if len(c.inflight) == 0 {
+					saveOffset(bufOffset)
+				} else {
+					c.inflight[len(c.inflight) - 1].offset = bufOffset
+				}
+			}
+			commitAcked()
+		}
+		if !retrying(written) {
+			return
+		}
+		if c.spool == nil {
+			c.sleep(time.Until(c.retryAt))
+			return
+		}
+		for len(c.inflight) > 0 {
+			if err := c.spool.PushBatch(c.inflight[0].batch); err != nil {
+				log.Println("failed to spool batch", err)
+				c.sleep(time.Until(c.retryAt))
+				return
+			}
+			saveOffset(c.inflight[0].offset)
+			c.inflight = c.inflight[1:]
+		}
+		if buf.Len() > 0 {
+			if err := c.spool.PushBatch(batch()); err != nil {
+				log.Println("failed to spool batch", err)
+				c.sleep(time.Until(c.retryAt))
+				return
+			}
+			resetBuffer()
+		}
+		saveOffset(bufOffset)
+	}
 
 	flushBuffer := func() {
-		if buf.Len() < 1 {
+		if c.pipeline != nil {
+			flushPipeline()
 			return
 		}
-		flushTimer.Stop()
-		flushTimer = time.NewTimer(c.bufferTimeout)
-		writeOperations.Inc()
-		err := c.output.Write(buf.Bytes())
-		if err != nil {
-			log.Println("failed to write to output", c.output, err)
-			writeErrors.Inc()
-			time.Sleep(time.Second) //todo
+		resetTimer(flushTimer, c.bufferTimeout)
+		written := false
+		if time.Now().After(c.retryAt) {
+			if written = c.drainSpool(); !written {
+				retrying(false)
+			}
+		}
+		if buf.Len() < 1 {
+			if bufOffset != savedOffset {
+				// only dropped records since the last flush
+				if err := c.input.SaveOffset(bufOffset); err != nil {
+					log.Println("failed to save input offset", err)
+				}
+				savedOffset = bufOffset
+			}
 			return
 		}
-		if err = c.input.SaveOffset(); err != nil {
+		if written {
+			writeOperations.Inc()
+			if err := writeBatch(c.output, batch()); err != nil {
+				log.Println("failed to write to output", c.output, err)
+				writeErrors.Inc()
+				c.throttle(err)
+				written = false
+			}
+		}
+		if retrying(written) {
+			if c.spool == nil {
+				c.sleep(time.Until(c.retryAt))
+				return
+			}
+			if err := c.spool.PushBatch(batch()); err != nil {
+				log.Println("failed to spool batch", err)
+				c.sleep(time.Until(c.retryAt))
+				return
+			}
+		}
+		if err := c.input.SaveOffset(bufOffset); err != nil {
 			log.Println("failed to save input offset", err)
 		}
-		buf.Reset()
+		savedOffset = bufOffset
+		resetBuffer()
+	}
+
+	writeRecord := func(record *Record, offset int64) {
+		if levelBelow(record.Level, c.minLevel) {
+			recordsDropped.Inc()
+			bufOffset = offset
+			return
+		}
+		if err := c.formatter.Format(buf, record); err != nil {
+			log.Println("failed to format record", err)
+			return
+		}
+		bufOffset = offset
+		marks = append(marks, BatchMark{Offset: offset, Pos: buf.Len()})
+	}
+
+	writeSummary := func() {
+		if c.rateLimiter == nil {
+			return
+		}
+		if summary, ok := c.rateLimiter.Summary(); ok {
+			writeRecord(summary, bufOffset)
+		}
 	}
 
+	// writeEvent limits and parses joined multiline events, so lines of a stack trace are kept or dropped together
+	writeEvent := func(event *Record, offset int64) {
+		if c.rateLimiter != nil {
+			if !c.rateLimiter.Allow(event) {
+				bufOffset = offset
+				return
+			}
+			writeSummary()
+		}
+		if c.eventTransformer != nil {
+			if err := c.eventTransformer.Do(event); err != nil {
+				if err == ErrDrop {
+					recordsDropped.Inc()
+				}
+				bufOffset = offset
+				return
+			}
+		}
+		writeRecord(event, offset)
+	}
+
+	dropRecord := func(offset int64) {
+		if c.multiline == nil || !c.multiline.Pending() {
+			bufOffset = offset
+		}
+	}
+
+	var acks <-chan struct{}
+	if c.pipeline != nil {
+		acks = c.pipeline.Acks()
+	}
+
+	lines := make(chan inputLine)
+	go c.readLines(lines)
+
 	for {
+		if buf.Len() >= c.bufferSize {
+			if c.ctx.Err() != nil {
+				return
+			}
+			flushBuffer()
+			continue
+		}
 		select {
 		case <- c.ctx.Done():
 			return
 		case <- flushTimer.C:
+			writeSummary()
 			flushBuffer()
-		default:
-			if buf.Len() >= c.bufferSize {
-				flushBuffer()
-				continue
+			c.heartbeat()
+		case <- acks:
+			commitAcked()
+		case <- multilineTimer.C:
+			for {
+				event, offset, ok := c.multiline.Flush()
+				if !ok {
+					break
+				}
+				writeEvent(event, offset)
 			}
-			line, err := c.input.ReadLine()
-			if err != nil {
-				//todo: logging
+		case l, ok := <- lines:
+			if !ok {
+				if c.ctx.Err() == nil {
+					// the input has ended, e.g. the file was truncated, read records are sent before the copier stops
+					for c.multiline != nil {
+						event, offset, ok := c.multiline.Flush()
+						if !ok {
+							break
+						}
+						writeEvent(event, offset)
+					}
+					writeSummary()
+					flushBuffer()
+				}
 				return
 			}
-			line, err = c.transformer.Do(line)
-			if err != nil {
+			record := &Record{Log: l.line}
+			if err := c.transformer.Do(record); err != nil {
+				if err == ErrDrop {
+					recordsDropped.Inc()
+					dropRecord(l.offset)
+				}
 				//todo: logging
 				continue
 			}
-			buf.WriteString(line)
+			if c.multiline == nil {
+				writeEvent(record, l.offset)
+				continue
+			}
+			if event, offset, ok := c.multiline.Push(record, l.start, l.offset); ok {
+				writeEvent(event, offset)
+			}
+			if c.multiline.Pending() {
+				resetTimer(multilineTimer, c.multiline.MaxWait())
+			}
 		}
 	}
 }
-
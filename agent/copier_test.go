@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// linesInput returns the lines and blocks until it's closed.
+type linesInput struct {
+	lines []string
+	offset int64
+	ctx context.Context
+	cancelFn context.CancelFunc
+}
+
+func newLinesInput(lines ...string) *linesInput {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	return &linesInput{lines: lines, ctx: ctx, cancelFn: cancelFn}
+}
+
+func (in *linesInput) Close() {
+	in.cancelFn()
+}
+
+func (in *linesInput) ReadLine() (string, error) {
+	if len(in.lines) == 0 {
+		<- in.ctx.Done()
+		return "", in.ctx.Err()
+	}
+	line := in.lines[0]
+	in.lines = in.lines[1:]
+	in.offset += int64(len(line))
+	return line, nil
+}
+
+func (in *linesInput) Offset() (int64, error) {
+	return in.offset, nil
+}
+
+func (in *linesInput) SaveOffset(offset int64) error {
+	return nil
+}
+
+type bufferOutput struct {
+	lock sync.Mutex
+	data strings.Builder
+}
+
+func (o *bufferOutput) Close() {}
+
+func (o *bufferOutput) String() string {
+	return "buffer"
+}
+
+func (o *bufferOutput) Write(data []byte) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.data.Write(data)
+	return nil
+}
+
+// copyLines runs the copier until the output has the expected number of lines.
+func copyLines(t *testing.T, in Input, tr Transformer, options CopierOptions, lines int) []string {
+	out := &bufferOutput{}
+	options.BufferSize = 1024
+	options.BufferTimeout = 10 * time.Millisecond
+	copier := NewCopier(in, out, tr, options)
+	go copier.Run()
+	defer copier.Wait()
+	defer copier.Close()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		out.lock.Lock()
+		data := out.data.String()
+		out.lock.Unlock()
+		if strings.Count(data, "\n") >= lines {
+			return strings.SplitAfter(data, "\n")[:lines]
+		}
+	}
+	require.FailNow(t, "timed out waiting for output")
+	return nil
+}
+
+func TestCopierMultilineStructured(t *testing.T) {
+	in := newLinesInput(
+		`{"level": "error", "msg": "failed"}` + "\n",
+		"  at main.go:10\n",
+		"{\n",
+		`  "msg": "pretty"` + "\n",
+		"}\n",
+		`{"msg": "last"}` + "\n",
+	)
+	tr := TransformerChain{&PassThroughTransformer{}}
+	lines := copyLines(t, in, tr, CopierOptions{
+		Multiline: NewMultiline(MultilineConfig{StartPattern: regexp.MustCompile(`^\{`), MaxWait: 50 * time.Millisecond}),
+		EventTransformer: TransformerChain{NewStructuredTransformer(StructuredConfig{}, nil), &LevelTransformer{}},
+		Formatter: &JsonFormatter{},
+	}, 3)
+	assert.Equal(t, []string{
+		`{"log":"{\"level\": \"error\", \"msg\": \"failed\"}\n  at main.go:10"}` + "\n",
+		`{"msg":"pretty"}` + "\n",
+		`{"msg":"last"}` + "\n",
+	}, lines)
+}
+
+func TestCopierMultilineParser(t *testing.T) {
+	in := newLinesInput(
+		"2018-01-01 00:00:00 UTC [42] ERROR:  syntax error\n",
+		"\tSTATEMENT:  selec 1\n",
+		"2018-01-01 00:00:01 UTC [42] LOG:  checkpoint\n",
+	)
+	tr := TransformerChain{&PassThroughTransformer{}}
+	lines := copyLines(t, in, tr, CopierOptions{
+		Multiline: NewMultiline(MultilineConfig{StartPattern: regexp.MustCompile(`^\d{4}-`), MaxWait: 50 * time.Millisecond}),
+		EventTransformer: TransformerChain{NewParserTransformer(BuiltinPatterns["postgres"]), &LevelTransformer{}},
+		Formatter: &JsonFormatter{},
+	}, 2)
+	assert.Equal(t, []string{
+		`{"level":"error","message":"syntax error\n\tSTATEMENT:  selec 1","pid":"42","timestamp":"2018-01-01 00:00:00 UTC"}` + "\n",
+		`{"level":"info","message":"checkpoint","pid":"42","timestamp":"2018-01-01 00:00:01 UTC"}` + "\n",
+	}, lines)
+}
+
+// batchesOutput keeps written batches with their offsets.
+type batchesOutput struct {
+	bufferOutput
+	batches []*Batch
+}
+
+func (o *batchesOutput) WriteBatch(batch *Batch) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.batches = append(o.batches, copyBatch(batch))
+	return nil
+}
+
+func (o *batchesOutput) count() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.batches)
+}
+
+func TestCopierSpoolOfAnotherStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	spool, err := NewSpool(dir, 1024)
+	require.NoError(t, err)
+	// spooled before the log was rotated
+	require.NoError(t, spool.PushBatch(&Batch{Data: []byte("a\n"), End: 2, Marks: []BatchMark{{Offset: 2, Pos: 2}}, Stream: "c/1_2/f00d"}))
+	require.NoError(t, spool.PushBatch(&Batch{Data: []byte("b\n"), End: 4, Marks: []BatchMark{{Offset: 4, Pos: 2}}, Stream: "c/1_3/beef"}))
+
+	out := &batchesOutput{}
+	copier := NewCopier(newLinesInput(), out, &PassThroughTransformer{}, CopierOptions{
+		Stream: "c/1_3/beef",
+		Spool: spool,
+		Formatter: &RawFormatter{},
+		BufferSize: 1024,
+		BufferTimeout: 10 * time.Millisecond,
+	})
+	go copier.Run()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && out.count() < 2; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	copier.Close()
+	copier.Wait()
+	assert.Equal(t, []*Batch{
+		{Data: []byte("a\n"), Stream: "c/1_2/f00d"},
+		{Data: []byte("b\n"), End: 4, Marks: []BatchMark{{Offset: 4, Pos: 2}}, Stream: "c/1_3/beef"},
+	}, out.batches)
+}
+
+func TestCopierRateLimitMultiline(t *testing.T) {
+	in := newLinesInput(
+		"panic: a\n",
+		"\tat main.go:1\n",
+		"\tat main.go:2\n",
+		"panic: b\n",
+		"\tat main.go:3\n",
+	)
+	lines := copyLines(t, in, &PassThroughTransformer{}, CopierOptions{
+		Multiline: NewMultiline(MultilineConfig{StartPattern: regexp.MustCompile(`^\S`), MaxWait: 50 * time.Millisecond}),
+		RateLimiter: NewRateLimiter(RateLimitConfig{LinesPerSecond: 1}),
+		Formatter: &RawFormatter{},
+	}, 4)
+	// events are limited once joined, so stack traces aren't cut
+	assert.Equal(t, []string{
+		"panic: a\n",
+		"\tat main.go:1\n",
+		"\tat main.go:2\n",
+		"1 lines dropped by oklogging rate limit\n",
+	}, lines)
+}
@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"path"
+	"strings"
+	"fmt"
+)
+
+const (
+	InputFormatDocker = "docker"
+	InputFormatCri = "cri"
+)
+
+// GetLabelsByCriLog extracts labels from the kubelet log path: <pods dir>/<namespace>_<pod>_<pod uid>/<container>/<restart count>.log
+func GetLabelsByCriLog(logPath string) (LogLabels, error) {
+	dir, f := path.Split(logPath)
+	if !strings.HasSuffix(f, ".log") {
+		return nil, fmt.Errorf("invalid log path format: %s (should be *.log)", logPath)
+	}
+	restartCount := strings.TrimSuffix(f, ".log")
+	dir, container := path.Split(strings.TrimSuffix(dir, "/"))
+	_, pod := path.Split(strings.TrimSuffix(dir, "/"))
+	parts := strings.Split(pod, "_")
+	if container == "" || len(parts) != 3 {
+		return nil, fmt.Errorf("can't get pod from log path: %s", logPath)
+	}
+	namespace, podName, podUid := parts[0], parts[1], parts[2]
+	labels := LogLabels{
+		"namespace": namespace,
+		"pod": podName,
+		"pod_uid": podUid,
+		"container": container,
+		// the same name as dockershim gives to k8s containers, so the server lays out files the same way
+		"docker.name": strings.Join([]string{"k8s", container, podName, namespace, podUid, restartCount}, "_"),
+	}
+	return labels, nil
+}
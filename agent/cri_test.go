@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetLabelsByCriLog(t *testing.T) {
+	labels, err := GetLabelsByCriLog("/var/log/pods/default_nginx-6db489d4b7-fl9ph_5ea6e40b-02e4-4d5a-9b5a-a3cbf9a2c1a0/nginx/2.log")
+	require.NoError(t, err)
+	assert.Equal(t, LogLabels{
+		"namespace": "default",
+		"pod": "nginx-6db489d4b7-fl9ph",
+		"pod_uid": "5ea6e40b-02e4-4d5a-9b5a-a3cbf9a2c1a0",
+		"container": "nginx",
+		"docker.name": "k8s_nginx_nginx-6db489d4b7-fl9ph_default_5ea6e40b-02e4-4d5a-9b5a-a3cbf9a2c1a0_2",
+	}, labels)
+
+	_, err = GetLabelsByCriLog("/var/log/pods/5ea6e40b/nginx/2.log")
+	assert.Error(t, err)
+}
+
+func TestCriTransformer(t *testing.T) {
+	tr := &CriTransformer{}
+
+	record := &Record{Log: "2018-01-01T00:00:00.000000001Z stdout F hello world"}
+	require.NoError(t, tr.Do(record))
+	assert.Equal(t, &Record{Time: "2018-01-01T00:00:00.000000001Z", Stream: "stdout", Log: "hello world\n"}, record)
+
+	assert.Equal(t, ErrPartial, tr.Do(&Record{Log: "2018-01-01T00:00:00.000000002Z stderr P first "}))
+	assert.Equal(t, ErrPartial, tr.Do(&Record{Log: "2018-01-01T00:00:00.000000003Z stderr P second "}))
+	record = &Record{Log: "2018-01-01T00:00:00.000000004Z stderr F third"}
+	require.NoError(t, tr.Do(record))
+	assert.Equal(t, &Record{Time: "2018-01-01T00:00:00.000000004Z", Stream: "stderr", Log: "first second third\n"}, record)
+
+	record = &Record{Log: "2018-01-01T00:00:00.000000005Z stdout F "}
+	require.NoError(t, tr.Do(record))
+	assert.Equal(t, "\n", record.Log)
+
+	assert.Error(t, tr.Do(&Record{Log: "garbage"}))
+}
+
+func TestCriTransformerInterleaved(t *testing.T) {
+	tr := &CriTransformer{}
+
+	assert.Equal(t, ErrPartial, tr.Do(&Record{Log: "2018-01-01T00:00:00.000000001Z stdout P out1 "}))
+	assert.Equal(t, ErrPartial, tr.Do(&Record{Log: "2018-01-01T00:00:00.000000002Z stderr P err1 "}))
+	record := &Record{Log: "2018-01-01T00:00:00.000000003Z stderr F err2"}
+	require.NoError(t, tr.Do(record))
+	assert.Equal(t, &Record{Time: "2018-01-01T00:00:00.000000003Z", Stream: "stderr", Log: "err1 err2\n"}, record)
+	record = &Record{Log: "2018-01-01T00:00:00.000000004Z stdout F out2"}
+	require.NoError(t, tr.Do(record))
+	assert.Equal(t, &Record{Time: "2018-01-01T00:00:00.000000004Z", Stream: "stdout", Log: "out1 out2\n"}, record)
+}
@@ -12,10 +12,18 @@ import (
 
 const (
 	dockerTimeout = 10 * time.Second
+	// container labels with this prefix configure the agent, e.g. oklogging/rate-limit-lines
+	agentDockerLabelPrefix = "oklogging/"
 )
 
 var (
 	ErrSkip = errors.New("Skipped")
+	kubernetesDockerLabels = map[string]string{
+		"io.kubernetes.pod.namespace": "namespace",
+		"io.kubernetes.pod.name": "pod",
+		"io.kubernetes.pod.uid": "pod_uid",
+		"io.kubernetes.container.name": "container",
+	}
 )
 
 type LogLabels map[string]string
@@ -61,6 +69,18 @@ func GetLabelsByLog(logPath string) (LogLabels, error) {
 	}
 	labels := LogLabels{
 		"docker.name": strings.TrimLeft(container.Name, "/"),
+		"container_id": containerId,
+		"image": container.Config.Image,
+	}
+	for dockerLabel, label := range kubernetesDockerLabels {
+		if v, ok := container.Config.Labels[dockerLabel]; ok {
+			labels[label] = v
+		}
+	}
+	for dockerLabel, v := range container.Config.Labels {
+		if strings.HasPrefix(dockerLabel, agentDockerLabelPrefix) {
+			labels[podLabelPrefix + dockerLabel] = v
+		}
 	}
 	return labels, nil
 }
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// OutputRequired outputs block the copier until a batch is written, offsets are committed after that
+	OutputRequired = "required"
+	// OutputBestEffort outputs get each batch once, failed batches are dropped
+	OutputBestEffort = "best-effort"
+)
+
+func ValidateOutputPolicy(policy string) error {
+	switch policy {
+	case OutputRequired, OutputBestEffort:
+		return nil
+	}
+	return fmt.Errorf("unknown output policy: %s", policy)
+}
+
+type FanOutTarget struct {
+	Output Output
+	Required bool
+}
+
+// FanOutOutput writes every batch to all targets. A batch is written again by the copier while any
+// required target fails, FanOutOutput remembers targets which have got it, so they don't get duplicates.
+type FanOutOutput struct {
+	targets []FanOutTarget
+	pending []byte
+	done []bool
+}
+
+func NewFanOutOutput(targets []FanOutTarget) *FanOutOutput {
+	return &FanOutOutput{targets: targets}
+}
+
+func (o *FanOutOutput) String() string {
+	var names []string
+	for _, t := range o.targets {
+		names = append(names, t.Output.String())
+	}
+	return "FanOut(" + strings.Join(names, ", ") + ")"
+}
+
+func (o *FanOutOutput) Close() {
+	for _, t := range o.targets {
+		t.Output.Close()
+	}
+}
+
+func (o *FanOutOutput) Write(data []byte) error {
+	return o.WriteBatch(&Batch{Data: data})
+}
+
+// WriteBatch passes input offsets of the batch to targets using them.
+func (o *FanOutOutput) WriteBatch(batch *Batch) error {
+	if o.done == nil || !bytes.Equal(batch.Data, o.pending) {
+		o.pending = append(o.pending[:0], batch.Data...)
+		o.done = make([]bool, len(o.targets))
+	}
+	var failed []string
+	var after time.Duration
+	for i, t := range o.targets {
+		if o.done[i] {
+			continue
+		}
+		err := writeBatch(t.Output, batch)
+		if err != nil && t.Required {
+			failed = append(failed, fmt.Sprintf("%s: %s", t.Output, err))
+			if d := retryAfter(err); d > after {
+				after = d
+			}
+			continue
+		}
+		if err != nil {
+			log.Println("dropping batch of best-effort output", t.Output, err)
+			outputDroppedBatches.Inc()
+		}
+		o.done[i] = true
+	}
+	if len(failed) > 0 {
+		err := fmt.Errorf("required outputs failed: %s", strings.Join(failed, "; "))
+		if after > 0 {
+			return &RetryAfterError{After: after, Err: err}
+		}
+		return err
+	}
+	o.done = nil
+	return nil
+}
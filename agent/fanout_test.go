@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"testing"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testOutput struct {
+	name string
+	fail bool
+	writes []string
+}
+
+func (o *testOutput) Close() {}
+
+func (o *testOutput) String() string {
+	return o.name
+}
+
+func (o *testOutput) Write(data []byte) error {
+	if o.fail {
+		return errors.New("failed")
+	}
+	o.writes = append(o.writes, string(data))
+	return nil
+}
+
+func TestFanOutOutput(t *testing.T) {
+	server := &testOutput{name: "server"}
+	archive := &testOutput{name: "archive"}
+	extra := &testOutput{name: "extra", fail: true}
+	out := NewFanOutOutput([]FanOutTarget{{Output: server, Required: true}, {Output: archive, Required: true}, {Output: extra}})
+
+	require.NoError(t, out.Write([]byte("a\n")))
+
+	archive.fail = true
+	extra.fail = false
+	assert.Error(t, out.Write([]byte("b\n")))
+	assert.Error(t, out.Write([]byte("b\n")))
+	archive.fail = false
+	require.NoError(t, out.Write([]byte("b\n")))
+	require.NoError(t, out.Write([]byte("b\n")))
+
+	assert.Equal(t, []string{"a\n", "b\n", "b\n"}, server.writes)
+	assert.Equal(t, []string{"a\n", "b\n", "b\n"}, archive.writes)
+	assert.Equal(t, []string{"b\n", "b\n"}, extra.writes)
+}
+
+func TestFileOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p, err := archivePath(path.Join(dir, "archive"), LogLabels{"docker.name": "k8s_app_pod_ns_uid_0"})
+	require.NoError(t, err)
+	out := NewFileOutput(p, 4)
+	require.NoError(t, out.Write([]byte("a\n")))
+	require.NoError(t, out.Write([]byte("b\n")))
+	require.NoError(t, out.Write([]byte("c\n")))
+	out.Close()
+
+	data, err := ioutil.ReadFile(p)
+	require.NoError(t, err)
+	assert.Equal(t, "c\n", string(data))
+	data, err = ioutil.ReadFile(p + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, "a\nb\n", string(data))
+
+	_, err = archivePath(dir, LogLabels{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"regexp"
+)
+
+// LabelSelector matches logs by labels, values may contain "*" matching any characters.
+// An empty selector matches every log.
+type LabelSelector map[string]*regexp.Regexp
+
+// NewLabelSelector compiles the patterns of label values once, selectors are matched for every started log.
+func NewLabelSelector(selector map[string]string) LabelSelector {
+	s := make(LabelSelector, len(selector))
+	for name, pattern := range selector {
+		s[name] = compileLabelPatterns([]string{pattern})[0]
+	}
+	return s
+}
+
+func (s LabelSelector) Matches(labels LogLabels) bool {
+	for name, pattern := range s {
+		value, ok := labels[name]
+		if !ok || !pattern.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+type FilterConfig struct {
+	Selector LabelSelector
+	// Include keeps only records matching any of patterns, all records if it's empty
+	Include []*regexp.Regexp
+	// Exclude drops records matching any of patterns
+	Exclude []*regexp.Regexp
+}
+
+// FilterTransformer drops records by the message, it should follow the transformer parsing the input format.
+type FilterTransformer struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func NewFilterTransformer(config FilterConfig) *FilterTransformer {
+	return &FilterTransformer{include: config.Include, exclude: config.Exclude}
+}
+
+func (f *FilterTransformer) Do(record *Record) error {
+	if len(f.include) > 0 && !matchAny(f.include, record.Log) {
+		return ErrDrop
+	}
+	if matchAny(f.exclude, record.Log) {
+		return ErrDrop
+	}
+	return nil
+}
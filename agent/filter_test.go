@@ -0,0 +1,36 @@
+package agent
+
+import (
+	"testing"
+	"regexp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLabelSelector(t *testing.T) {
+	labels := LogLabels{"namespace": "ingress-nginx", "container": "controller"}
+	assert.True(t, NewLabelSelector(map[string]string{}).Matches(labels))
+	assert.True(t, NewLabelSelector(map[string]string{"namespace": "ingress-nginx"}).Matches(labels))
+	assert.True(t, NewLabelSelector(map[string]string{"namespace": "ingress-*", "container": "controller"}).Matches(labels))
+	assert.False(t, NewLabelSelector(map[string]string{"namespace": "ingress"}).Matches(labels))
+	assert.False(t, NewLabelSelector(map[string]string{"pod": "*"}).Matches(labels))
+}
+
+func TestTransformerChainFilter(t *testing.T) {
+	chain := TransformerChain{
+		&DockerJsonTransformer{},
+		NewFilterTransformer(FilterConfig{Exclude: []*regexp.Regexp{regexp.MustCompile(`GET /healthz`)}}),
+	}
+	record := &Record{Log: `{"log":"GET /api 200\n","stream":"stdout","time":"t"}`}
+	assert.NoError(t, chain.Do(record))
+	assert.Equal(t, "GET /api 200\n", record.Log)
+	record = &Record{Log: `{"log":"GET /healthz 200\n","stream":"stdout","time":"t"}`}
+	assert.Equal(t, ErrDrop, chain.Do(record))
+
+	filter := NewFilterTransformer(FilterConfig{
+		Include: []*regexp.Regexp{regexp.MustCompile(`ERROR`), regexp.MustCompile(`WARN`)},
+		Exclude: []*regexp.Regexp{regexp.MustCompile(`ignored`)},
+	})
+	assert.NoError(t, filter.Do(&Record{Log: "WARN disk\n"}))
+	assert.Equal(t, ErrDrop, filter.Do(&Record{Log: "INFO ok\n"}))
+	assert.Equal(t, ErrDrop, filter.Do(&Record{Log: "ERROR ignored\n"}))
+}
@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"fmt"
+)
+
+const (
+	OutputFormatRaw = "raw"
+	OutputFormatPrefix = "prefix"
+	OutputFormatJson = "json"
+
+	// formatLabel tells the server how records are formatted
+	formatLabel = "oklogging.format"
+)
+
+// Formatter writes records to the buffer sent to the server.
+type Formatter interface {
+	Format(*bytes.Buffer, *Record) error
+}
+
+func NewFormatter(format string) (Formatter, error) {
+	switch format {
+	case OutputFormatRaw:
+		return &RawFormatter{}, nil
+	case OutputFormatPrefix:
+		return &PrefixFormatter{}, nil
+	case OutputFormatJson:
+		return &JsonFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown output format: %s", format)
+}
+
+// RawFormatter writes only the log message.
+type RawFormatter struct {}
+
+func (f *RawFormatter) Format(buf *bytes.Buffer, record *Record) error {
+	buf.WriteString(record.Log)
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// PrefixFormatter writes "<time> <stream> <log>".
+type PrefixFormatter struct {}
+
+func (f *PrefixFormatter) Format(buf *bytes.Buffer, record *Record) error {
+	buf.WriteString(orDash(record.Time))
+	buf.WriteByte(' ')
+	buf.WriteString(orDash(record.Stream))
+	buf.WriteByte(' ')
+	buf.WriteString(record.Log)
+	return nil
+}
+
+// JsonFormatter writes a json object per line, structured records are merged into it.
+type JsonFormatter struct {}
+
+type jsonRecord struct {
+	Time string `json:"time,omitempty"`
+	Stream string `json:"stream,omitempty"`
+	Level string `json:"level,omitempty"`
+	Log string `json:"log"`
+}
+
+// structuredRecord merges parsed fields and labels with the record, the message is written as "log"
+// only if it isn't parsed.
+func structuredRecord(record *Record) map[string]interface{} {
+	res := make(map[string]interface{}, len(record.Fields) + 3)
+	for k, v := range record.Fields {
+		res[k] = v
+	}
+	if record.Fields == nil {
+		res["log"] = strings.TrimSuffix(record.Log, "\n")
+	}
+	if record.Labels != nil {
+		res["labels"] = record.Labels
+	}
+	if record.Time != "" {
+		res["time"] = record.Time
+	}
+	if record.Stream != "" {
+		res["stream"] = record.Stream
+	}
+	if record.Level != "" {
+		res["level"] = record.Level
+	}
+	return res
+}
+
+func (f *JsonFormatter) Format(buf *bytes.Buffer, record *Record) error {
+	var v interface{} = jsonRecord{
+		Time: record.Time,
+		Stream: record.Stream,
+		Level: record.Level,
+		Log: strings.TrimSuffix(record.Log, "\n"),
+	}
+	if record.Fields != nil || record.Labels != nil {
+		v = structuredRecord(record)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	buf.WriteByte('\n')
+	return nil
+}
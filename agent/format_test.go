@@ -0,0 +1,26 @@
+package agent
+
+import (
+	"testing"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatters(t *testing.T) {
+	record := &Record{Time: "2018-01-01T00:00:00.000Z", Stream: "stderr", Log: "failed \"x\"\n"}
+	for format, expected := range map[string]string{
+		OutputFormatRaw: "failed \"x\"\n",
+		OutputFormatPrefix: "2018-01-01T00:00:00.000Z stderr failed \"x\"\n",
+		OutputFormatJson: `{"time":"2018-01-01T00:00:00.000Z","stream":"stderr","log":"failed \"x\""}` + "\n",
+	} {
+		formatter, err := NewFormatter(format)
+		require.NoError(t, err)
+		buf := &bytes.Buffer{}
+		require.NoError(t, formatter.Format(buf, record))
+		assert.Equal(t, expected, buf.String(), format)
+	}
+
+	_, err := NewFormatter("xml")
+	assert.Error(t, err)
+}
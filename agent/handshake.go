@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// handshakeMagic starts versioned handshakes. Servers without them read it as the size of a ~1.1 GiB
+	// labels frame and try to allocate it, so it's sent only with VersionedHandshake.
+	handshakeMagic = "OKLG"
+	protocolVersion = 1
+	minProtocolVersion = 1
+
+	capCompression = "compression"
+	capWindow = "window"
+	capMux = "mux"
+)
+
+// Version is reported to servers, it's set with -ldflags "-X ...agent.Version=..."
+var Version = "dev"
+
+type hello struct {
+	MinVersion int `json:"min_version"`
+	Version int `json:"version"`
+	Agent string `json:"agent"`
+	Capabilities map[string]string `json:"capabilities,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type welcome struct {
+	Version int `json:"version"`
+	Server string `json:"server"`
+	Status int32 `json:"status"`
+	Error string `json:"error,omitempty"`
+	Capabilities map[string]string `json:"capabilities,omitempty"`
+}
+
+// handshake describes the connection to the server, it returns capabilities accepted by the server
+// with the values it has chosen.
+func handshake(conn net.Conn, config TcpOutputConfig, labels map[string]string, capabilities map[string]string) (map[string]string, error) {
+	if !config.VersionedHandshake {
+		return legacyHandshake(conn, config, labels)
+	}
+	payload, err := json.Marshal(hello{
+		MinVersion: minProtocolVersion,
+		Version: protocolVersion,
+		Agent: Version,
+		Capabilities: capabilities,
+		Labels: labels,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(config.Timeout)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := conn.Write([]byte(handshakeMagic)); err != nil {
+		return nil, err
+	}
+	if err := writeFrame(conn, payload, config.Timeout); err != nil {
+		return nil, err
+	}
+	frame, err := readFrame(conn, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	w := welcome{}
+	if err := json.Unmarshal(frame, &w); err != nil {
+		return nil, fmt.Errorf("invalid handshake response: %s", err)
+	}
+	if w.Status != 200 {
+		return nil, fmt.Errorf("got %d response from server %s: %s", w.Status, w.Server, w.Error)
+	}
+	if w.Version < minProtocolVersion || w.Version > protocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version %d of server %s", w.Version, w.Server)
+	}
+	return w.Capabilities, nil
+}
+
+// legacyHandshake sends bare labels answered with a status, as servers without capabilities expect,
+// so no capabilities are accepted.
+func legacyHandshake(conn net.Conn, config TcpOutputConfig, labels map[string]string) (map[string]string, error) {
+	payload, err := json.Marshal(labels)
+	if err != nil {
+		return nil, err
+	}
+	if err := send(conn, payload, config.Timeout); err != nil {
+		return nil, err
+	}
+	return map[string]string{}, nil
+}
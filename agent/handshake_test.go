@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testHandshakeServer(t *testing.T, conn net.Conn, w welcome) <-chan hello {
+	hellos := make(chan hello, 1)
+	go func() {
+		magic := make([]byte, len(handshakeMagic))
+		if _, err := io.ReadFull(conn, magic); err != nil || string(magic) != handshakeMagic {
+			conn.Close()
+			return
+		}
+		frame, err := readFrame(conn, time.Second)
+		require.NoError(t, err)
+		h := hello{}
+		require.NoError(t, json.Unmarshal(frame, &h))
+		hellos <- h
+		payload, _ := json.Marshal(w)
+		writeFrame(conn, payload, time.Second)
+	}()
+	return hellos
+}
+
+func TestHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	hellos := testHandshakeServer(t, server, welcome{Version: 1, Status: 200, Capabilities: map[string]string{capCompression: "gzip"}})
+	accepted, err := handshake(client, TcpOutputConfig{Timeout: time.Second, VersionedHandshake: true}, map[string]string{"pod": "p"},
+		map[string]string{capCompression: "zstd,gzip", capWindow: "8"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{capCompression: "gzip"}, accepted)
+	h := <- hellos
+	assert.Equal(t, protocolVersion, h.Version)
+	assert.Equal(t, map[string]string{"pod": "p"}, h.Labels)
+	assert.Equal(t, "8", h.Capabilities[capWindow])
+
+	client, server = net.Pipe()
+	defer client.Close()
+	testHandshakeServer(t, server, welcome{Version: 1, Status: 400, Error: "unsupported protocol version"})
+	_, err = handshake(client, TcpOutputConfig{Timeout: time.Second, VersionedHandshake: true}, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestLegacyHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	labels := make(chan map[string]string, 1)
+	go func() {
+		frame, err := readFrame(server, time.Second)
+		require.NoError(t, err)
+		l := map[string]string{}
+		require.NoError(t, json.Unmarshal(frame, &l))
+		labels <- l
+		binary.Write(server, binary.LittleEndian, int32(200))
+	}()
+	// servers without the versioned handshake get bare labels and no capabilities are used
+	accepted, err := handshake(client, TcpOutputConfig{Timeout: time.Second}, map[string]string{"pod": "p"},
+		map[string]string{capCompression: "zstd,gzip", capWindow: "8", capHeartbeat: "30000"})
+	require.NoError(t, err)
+	assert.Empty(t, accepted)
+	assert.Equal(t, map[string]string{"pod": "p"}, <- labels)
+}
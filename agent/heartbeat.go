@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	// capHeartbeat is the heartbeat interval in milliseconds, the server closes idle connections
+	capHeartbeat = "heartbeat"
+	muxHeartbeat = 4
+	defaultHeartbeatInterval = 30 * time.Second
+)
+
+// Heartbeater is implemented by outputs keeping connections alive while logs are idle.
+type Heartbeater interface {
+	// Heartbeat checks the connection if nothing was sent for the heartbeat interval
+	Heartbeat() error
+}
+
+func formatHeartbeat(interval time.Duration) string {
+	return strconv.FormatInt(int64(interval / time.Millisecond), 10)
+}
+
+// parseHeartbeat returns the interval accepted by the server, 0 if heartbeats aren't supported.
+func parseHeartbeat(accepted map[string]string) time.Duration {
+	ms, err := strconv.ParseInt(accepted[capHeartbeat], 10, 64)
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (o *TcpOutput) Heartbeat() error {
+	if o.conn == nil || o.heartbeat <= 0 || time.Since(o.lastSent) < o.heartbeat {
+		return nil
+	}
+	o.lastSent = time.Now()
+	if !o.pipelined {
+		// the server replies the status, so a dead server is detected
+		if err := send(o.conn, nil, o.config.Timeout); err != nil {
+			o.disconnect()
+			o.config.Servers.Failed(o.server)
+			return err
+		}
+		return nil
+	}
+	select {
+	case <- o.connDone:
+		return o.closed()
+	default:
+	}
+	// the server acknowledges the last batch again, acknowledgements aren't waited for
+	if err := writeFrame(o.conn, nil, o.config.Timeout); err != nil {
+		o.disconnect()
+		o.config.Servers.Failed(o.server)
+		return err
+	}
+	return nil
+}
+
+// heartbeats checks the idle multiplexed connection until it's closed, it's closed if the server doesn't respond.
+func (c *muxConn) heartbeats(interval time.Duration) {
+	id := c.register()
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- c.done:
+			return
+		case <- ticker.C:
+		}
+		c.writeLock.Lock()
+		idle := time.Since(c.lastWrite)
+		c.writeLock.Unlock()
+		if idle < interval {
+			continue
+		}
+		response, err := c.request(muxHeartbeat, id, nil)
+		if err == nil && response.status != 200 {
+			err = StatusError(response.status)
+		}
+		if err != nil {
+			log.Println("heartbeat of multiplexed connection to", c.server, "failed", err)
+			c.close(err)
+			return
+		}
+	}
+}
+
+// Heartbeat checks all targets, the first error is returned.
+func (o *FanOutOutput) Heartbeat() error {
+	var err error
+	for _, t := range o.targets {
+		if h, ok := t.Output.(Heartbeater); ok {
+			if e := h.Heartbeat(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
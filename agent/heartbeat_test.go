@@ -0,0 +1,19 @@
+package agent
+
+import (
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeatInterval(t *testing.T) {
+	assert.Equal(t, "30000", formatHeartbeat(30 * time.Second))
+	assert.Equal(t, 10 * time.Second, parseHeartbeat(map[string]string{capHeartbeat: "10000"}))
+	assert.Equal(t, time.Duration(0), parseHeartbeat(map[string]string{}))
+	assert.Equal(t, time.Duration(0), parseHeartbeat(map[string]string{capHeartbeat: "-1"}))
+
+	config := TcpOutputConfig{HeartbeatInterval: time.Second}
+	assert.Equal(t, "1000", config.capabilities(false)[capHeartbeat])
+	config.HeartbeatInterval = -1
+	assert.NotContains(t, config.capabilities(false), capHeartbeat)
+}
@@ -1,55 +1,94 @@
 package agent
 
 import (
-	"gopkg.in/okmeter/gotail.v1"
 	"context"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 type Input interface {
 	Close()
 	ReadLine() (string, error)
-	SaveOffset() error
+	Offset() (int64, error)
+	SaveOffset(offset int64) error
 }
 
 type FileInput struct {
 	filePath string
-	tail *tail.Tail
+	fileId string
+	tail *fileTail
 	ctx context.Context
 	cancelFn context.CancelFunc
 	offsetStorage *OffsetStorage
+	committed int64
+	// generation tells apart files with the same inode, see OffsetStorage.Generation
+	generation string
+	lock sync.Mutex
+	// truncated is set once the file is truncated while it's read
+	truncated bool
 }
 
+// NewFileInput opens the file and continues from the offset saved for its inode.
 func NewFileInput(filePath string, offsetStorage *OffsetStorage) (*FileInput, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	fileId, err := FileId(stat)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 	fi := &FileInput{
 		offsetStorage: offsetStorage,
 		filePath: filePath,
+		fileId: fileId,
 	}
 
-	offset, err := offsetStorage.Get(filePath)
+	offset, err := offsetStorage.Get(fileId)
+	reset := false
 	if err != nil {
 		log.Println("can't get offset for file", filePath, err)
 		offset = 0
+	} else if stat.Size() < offset {
+		// truncated or another file with the inode
+		offset, reset = 0, true
+	}
+	if reset {
+		fi.generation, err = offsetStorage.NewGeneration(fileId)
 	} else {
-		fi, err := os.Stat(filePath)
-		if err != nil {
-			return nil, err
-		}
-		if fi.Size() < offset {
-			offset = 0
-		}
+		fi.generation, err = offsetStorage.Generation(fileId)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
-	log.Println("tailing file", filePath, "from offset", offset)
-	t, err := tail.NewTail(filePath, offset, tail.NewConfig())
+	log.Println("tailing file", filePath, "inode", fileId, "from offset", offset)
+	fi.tail, err = newFileTail(f, offset)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	fi.tail = &t
+	fi.committed = offset
 	fi.ctx, fi.cancelFn = context.WithCancel(context.Background())
 	return fi, nil
 }
 
+func (fi *FileInput) FileId() string {
+	return fi.fileId
+}
+
+func (fi *FileInput) Generation() string {
+	return fi.generation
+}
+
 func (fi *FileInput) Close() {
 	log.Println("closing fileinput for", fi.filePath)
 	fi.tail.Close()
@@ -62,6 +101,10 @@ func (fi *FileInput) ReadLine() (string, error) {
 		return "", fi.ctx.Err()
 	default:
 		line, err := fi.tail.ReadLine()
+		if err == errTailTruncated {
+			fi.truncate()
+			return "", err
+		}
 		if err != nil {
 			log.Println(err)
 			return "", err
@@ -72,11 +115,50 @@ func (fi *FileInput) ReadLine() (string, error) {
 	}
 }
 
-func (fi *FileInput) SaveOffset() error {
-	offset, err := fi.tail.Offset()
-	if err != nil {
-		return err
+func (fi *FileInput) Offset() (int64, error) {
+	return fi.tail.Offset(), nil
+}
+
+// truncate makes the copier start again from the start of the file with a new stream identity, offsets
+// of records read before are ignored.
+func (fi *FileInput) truncate() {
+	log.Println("file", fi.filePath, "was truncated, reading it from the start")
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.truncated = true
+	if _, err := fi.offsetStorage.NewGeneration(fi.fileId); err != nil {
+		log.Println("failed to renew generation of", fi.filePath, err)
+	}
+	if err := fi.offsetStorage.Save(fi.fileId, 0); err != nil {
+		log.Println("failed to reset offset of", fi.filePath, err)
+	}
+	atomic.StoreInt64(&fi.committed, 0)
+}
+
+func (fi *FileInput) SaveOffset(offset int64) error {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	if fi.truncated {
+		return nil
 	}
 	offsetsCommits.Inc()
-	return fi.offsetStorage.Save(fi.filePath, offset)
-}
\ No newline at end of file
+	if err := fi.offsetStorage.Save(fi.fileId, offset); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&fi.committed, offset)
+	return nil
+}
+
+// Size returns the current size of the opened file, even if it was rotated or removed.
+func (fi *FileInput) Size() (int64, error) {
+	stat, err := fi.tail.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// Committed returns the last saved offset.
+func (fi *FileInput) Committed() int64 {
+	return atomic.LoadInt64(&fi.committed)
+}
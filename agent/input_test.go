@@ -6,6 +6,7 @@ import (
 	"os"
 	"github.com/stretchr/testify/require"
 	"path"
+	"strings"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,26 +31,155 @@ func TestFileInput(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "line1", line)
 
-	require.NoError(t, input.SaveOffset())
-	offset, err := offsetStgorage.Get(logPath)
+	offset, err := input.Offset()
 	require.NoError(t, err)
 	assert.Equal(t, int64(6), offset)
+	require.NoError(t, input.SaveOffset(offset))
+	offset, err = offsetStgorage.Get(input.FileId())
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), offset)
+	generation := input.Generation()
+	assert.NotEmpty(t, generation)
 	input.Close()
 
 	l.WriteString("line2\n")
 	input, err = NewFileInput(logPath, offsetStgorage)
 	require.NoError(t, err)
+	assert.Equal(t, generation, input.Generation())
 
 	line, err = input.ReadLine()
 	require.NoError(t, err)
 	assert.Equal(t, "line2", line)
 	input.Close()
 
-	require.NoError(t, offsetStgorage.Save(logPath, 100500))
+	require.NoError(t, offsetStgorage.Save(input.FileId(), 100500))
 	input, err = NewFileInput(logPath, offsetStgorage)
 	require.NoError(t, err)
 
 	line, err = input.ReadLine()
 	require.NoError(t, err)
 	assert.Equal(t, "line1", line)
-}
\ No newline at end of file
+	// the offset is past the end, so it's another file with the same inode
+	assert.NotEqual(t, generation, input.Generation())
+}
+
+func TestFileInputRotation(t *testing.T) {
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "logs")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	offsetStorage, err := NewOffsetStorage(path.Join(tmpDir, "offsets"))
+	require.NoError(t, err)
+
+	logPath := path.Join(tmpDir, "1-json.log")
+	l, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	l.WriteString("line1\nline2\npart")
+
+	input, err := NewFileInput(logPath, offsetStorage)
+	require.NoError(t, err)
+	defer input.Close()
+	fileId := input.FileId()
+
+	line, err := input.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "line1", line)
+	require.NoError(t, input.SaveOffset(6))
+
+	require.NoError(t, os.Rename(logPath, logPath + ".1"))
+	l.WriteString("ial\n")
+	l.Close()
+	require.NoError(t, ioutil.WriteFile(logPath, []byte("new\n"), 0644))
+
+	line, err = input.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "line2", line)
+	line, err = input.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "partial", line)
+	offset, err := input.Offset()
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), offset)
+
+	rotatedId, err := GetFileId(logPath + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, fileId, rotatedId)
+
+	newInput, err := NewFileInput(logPath, offsetStorage)
+	require.NoError(t, err)
+	defer newInput.Close()
+	assert.NotEqual(t, fileId, newInput.FileId())
+	line, err = newInput.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "new", line)
+}
+
+func TestFileInputTruncated(t *testing.T) {
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "logs")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	offsetStorage, err := NewOffsetStorage(path.Join(tmpDir, "offsets"))
+	require.NoError(t, err)
+	logPath := path.Join(tmpDir, "1.log")
+	require.NoError(t, ioutil.WriteFile(logPath, []byte("line1\nline2\n"), 0644))
+
+	input, err := NewFileInput(logPath, offsetStorage)
+	require.NoError(t, err)
+	defer input.Close()
+	generation := input.Generation()
+	for _, expected := range []string{"line1", "line2"} {
+		line, err := input.ReadLine()
+		require.NoError(t, err)
+		assert.Equal(t, expected, line)
+	}
+	require.NoError(t, input.SaveOffset(12))
+
+	require.NoError(t, os.Truncate(logPath, 0))
+	_, err = input.ReadLine()
+	assert.Equal(t, errTailTruncated, err)
+	// the file is read from the start with a new identity, offsets of records read before aren't saved
+	require.NoError(t, input.SaveOffset(12))
+	offset, err := offsetStorage.Get(input.FileId())
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), offset)
+	g, err := offsetStorage.Generation(input.FileId())
+	require.NoError(t, err)
+	assert.NotEqual(t, generation, g)
+
+	require.NoError(t, ioutil.WriteFile(logPath, []byte("new\n"), 0644))
+	line, err := input.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "new", line)
+	offset, err = input.Offset()
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), offset)
+}
+
+func TestFileInputLongLine(t *testing.T) {
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "logs")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	offsetStorage, err := NewOffsetStorage(path.Join(tmpDir, "offsets"))
+	require.NoError(t, err)
+	logPath := path.Join(tmpDir, "1.log")
+	long := strings.Repeat("x", tailMaxLineSize + 10)
+	require.NoError(t, ioutil.WriteFile(logPath, []byte(long + "\nnext\n"), 0644))
+
+	input, err := NewFileInput(logPath, offsetStorage)
+	require.NoError(t, err)
+	defer input.Close()
+	line, err := input.ReadLine()
+	require.NoError(t, err)
+	assert.True(t, len(line) >= tailMaxLineSize && len(line) < tailMaxLineSize + 10, "line of %d bytes", len(line))
+	rest, err := input.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, long, line + rest)
+	line, err = input.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "next", line)
+	offset, err := input.Offset()
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(long) + 6), offset)
+}
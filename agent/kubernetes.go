@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"net/http"
+	"time"
+	"io/ioutil"
+	"crypto/x509"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"net"
+	"encoding/json"
+	"strings"
+	"net/url"
+)
+
+const (
+	kubernetesTimeout = 10 * time.Second
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCaFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+type Pod struct {
+	Metadata struct {
+		Name string `json:"name"`
+		Namespace string `json:"namespace"`
+		Uid string `json:"uid"`
+		Labels map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+		Containers []struct {
+			Name string `json:"name"`
+			Image string `json:"image"`
+		} `json:"containers"`
+	} `json:"spec"`
+}
+
+type PodSource interface {
+	GetPod(namespace, name string) (*Pod, error)
+}
+
+// KubernetesApi fetches pods from the Kubernetes API server or anything serving the same
+// /api/v1 paths, e.g. `kubectl proxy`.
+type KubernetesApi struct {
+	url string
+	tokenFile string
+	client *http.Client
+}
+
+func NewKubernetesApi(apiUrl string, tokenFile string, caFile string) (*KubernetesApi, error) {
+	transport := &http.Transport{}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &KubernetesApi{
+		url: strings.TrimRight(apiUrl, "/"),
+		tokenFile: tokenFile,
+		client: &http.Client{Transport: transport, Timeout: kubernetesTimeout},
+	}, nil
+}
+
+func NewInClusterKubernetesApi() (*KubernetesApi, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT aren't set, not running in a cluster?")
+	}
+	return NewKubernetesApi("https://" + net.JoinHostPort(host, port), inClusterTokenFile, inClusterCaFile)
+}
+
+// NewPodSource returns nil if apiUrl is empty and the service account config if it's "in-cluster".
+func NewPodSource(apiUrl string, tokenFile string, caFile string) (PodSource, error) {
+	var (
+		api *KubernetesApi
+		err error
+	)
+	switch apiUrl {
+	case "":
+		return nil, nil
+	case "in-cluster":
+		api, err = NewInClusterKubernetesApi()
+	default:
+		api, err = NewKubernetesApi(apiUrl, tokenFile, caFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return api, nil
+}
+
+func (k *KubernetesApi) GetPod(namespace, name string) (*Pod, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s", k.url, url.PathEscape(namespace), url.PathEscape(name)), nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.tokenFile != "" {
+		// service account tokens are rotated, so the token is read on every request
+		token, err := ioutil.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer " + strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %d response from kubernetes api for pod %s/%s", resp.StatusCode, namespace, name)
+	}
+	pod := &Pod{}
+	if err := json.NewDecoder(resp.Body).Decode(pod); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	LevelTrace = "trace"
+	LevelDebug = "debug"
+	LevelInfo = "info"
+	LevelWarn = "warn"
+	LevelError = "error"
+	LevelFatal = "fatal"
+)
+
+var (
+	levelOrder = map[string]int{LevelTrace: 0, LevelDebug: 1, LevelInfo: 2, LevelWarn: 3, LevelError: 4, LevelFatal: 5}
+	levelNames = map[string]string{
+		"trace": LevelTrace,
+		"debug": LevelDebug, "dbg": LevelDebug, "d": LevelDebug,
+		"info": LevelInfo, "information": LevelInfo, "informational": LevelInfo, "notice": LevelInfo, "log": LevelInfo, "i": LevelInfo,
+		"warn": LevelWarn, "warning": LevelWarn, "w": LevelWarn,
+		"error": LevelError, "err": LevelError, "e": LevelError,
+		"fatal": LevelFatal, "critical": LevelFatal, "crit": LevelFatal, "alert": LevelFatal, "emerg": LevelFatal, "panic": LevelFatal, "f": LevelFatal,
+	}
+	levelFields = []string{"level", "severity", "lvl", "loglevel"}
+	klogLevel = regexp.MustCompile(`^([IWEF])\d{4} \d{2}:\d{2}:\d{2}`)
+	logfmtLevel = regexp.MustCompile(`(?i)\b(?:level|lvl|severity)=["']?([a-z]+)`)
+	levelToken = regexp.MustCompile(`\b(TRACE|DEBUG|INFO|NOTICE|WARN|WARNING|ERROR|ERR|FATAL|CRITICAL|CRIT|PANIC)\b`)
+)
+
+// NormalizeLevel returns one of Level* constants or "" for unknown levels, e.g. "WARNING" is LevelWarn
+// and "DEBUG2" of postgres is LevelDebug.
+func NormalizeLevel(level string) string {
+	level = strings.TrimRight(strings.ToLower(strings.TrimSpace(level)), "0123456789")
+	return levelNames[level]
+}
+
+// numericLevel maps bunyan and pino levels.
+func numericLevel(n json.Number) string {
+	v, err := n.Int64()
+	if err != nil {
+		return ""
+	}
+	switch {
+	case v >= 60:
+		return LevelFatal
+	case v >= 50:
+		return LevelError
+	case v >= 40:
+		return LevelWarn
+	case v >= 30:
+		return LevelInfo
+	case v >= 20:
+		return LevelDebug
+	}
+	return LevelTrace
+}
+
+func ValidateLevel(level string) error {
+	if _, ok := levelOrder[level]; !ok {
+		return fmt.Errorf("unknown level: %s", level)
+	}
+	return nil
+}
+
+// levelBelow returns false for unknown levels, so records without a level aren't filtered.
+func levelBelow(level, min string) bool {
+	l, ok := levelOrder[level]
+	return ok && min != "" && l < levelOrder[min]
+}
+
+// LevelTransformer sets Record.Level from structured fields, klog prefixes or level tokens in the message.
+type LevelTransformer struct {}
+
+func fieldsLevel(fields map[string]interface{}) string {
+	for _, name := range levelFields {
+		switch v := fields[name].(type) {
+		case string:
+			if level := NormalizeLevel(v); level != "" {
+				return level
+			}
+		case json.Number:
+			return numericLevel(v)
+		}
+	}
+	return ""
+}
+
+func (t *LevelTransformer) Do(record *Record) error {
+	if record.Fields != nil {
+		if record.Level = fieldsLevel(record.Fields); record.Level != "" {
+			return nil
+		}
+	}
+	if m := klogLevel.FindStringSubmatch(record.Log); m != nil {
+		record.Level = NormalizeLevel(m[1])
+		return nil
+	}
+	if m := logfmtLevel.FindStringSubmatch(record.Log); m != nil {
+		if record.Level = NormalizeLevel(m[1]); record.Level != "" {
+			return nil
+		}
+	}
+	if m := levelToken.FindStringSubmatch(record.Log); m != nil {
+		record.Level = NormalizeLevel(m[1])
+	}
+	return nil
+}
+
+type MinLevelConfig struct {
+	Selector LabelSelector
+	// Level is one of Level* constants, records with lower levels are dropped
+	Level string
+}
+
+// chooseMinLevel returns the level of the first rule matching log labels.
+func chooseMinLevel(rules []MinLevelConfig, labels LogLabels) string {
+	for _, r := range rules {
+		if r.Selector.Matches(labels) {
+			return r.Level
+		}
+	}
+	return ""
+}
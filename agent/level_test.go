@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"testing"
+	"encoding/json"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLevelTransformer(t *testing.T) {
+	for _, c := range []struct{
+		record *Record
+		level string
+	}{
+		{&Record{Log: "{}", Fields: map[string]interface{}{"level": "WARNING"}}, LevelWarn},
+		{&Record{Log: "{}", Fields: map[string]interface{}{"severity": "err"}}, LevelError},
+		{&Record{Log: "{}", Fields: map[string]interface{}{"level": json.Number("50")}}, LevelError},
+		{&Record{Log: "{}", Fields: map[string]interface{}{"level": "E"}}, LevelError},
+		{&Record{Log: "{}", Fields: map[string]interface{}{"level": "DEBUG2"}}, LevelDebug},
+		{&Record{Log: "W0101 00:00:00.123456       1 main.go:1] slow\n"}, LevelWarn},
+		{&Record{Log: "time=12:00 level=info msg=\"ERROR in request\"\n"}, LevelInfo},
+		{&Record{Log: "2018-01-01 00:00:00 [main] ERROR Main - failed\n"}, LevelError},
+		{&Record{Log: "INFO retrying after ERROR\n"}, LevelInfo},
+		{&Record{Log: "java.lang.NullPointerException\n"}, ""},
+		{&Record{Log: "Errors are fine\n"}, ""},
+	} {
+		require.NoError(t, (&LevelTransformer{}).Do(c.record))
+		assert.Equal(t, c.level, c.record.Level, c.record.Log)
+	}
+}
+
+func TestMinLevel(t *testing.T) {
+	rules := []MinLevelConfig{
+		{Selector: NewLabelSelector(map[string]string{"namespace": "ingress-*"}), Level: LevelWarn},
+		{Selector: NewLabelSelector(map[string]string{}), Level: LevelDebug},
+	}
+	assert.Equal(t, LevelWarn, chooseMinLevel(rules, LogLabels{"namespace": "ingress-nginx"}))
+	assert.Equal(t, LevelDebug, chooseMinLevel(rules, LogLabels{"namespace": "default"}))
+
+	assert.True(t, levelBelow(LevelInfo, LevelWarn))
+	assert.False(t, levelBelow(LevelError, LevelWarn))
+	assert.False(t, levelBelow("", LevelWarn))
+	assert.False(t, levelBelow(LevelDebug, ""))
+	assert.Error(t, ValidateLevel("verbose"))
+}
+
+func TestJsonFormatterLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, (&JsonFormatter{}).Format(buf, &Record{Time: "t", Stream: "stderr", Level: LevelError, Log: "ERROR failed\n"}))
+	assert.Equal(t, `{"time":"t","stream":"stderr","level":"error","log":"ERROR failed"}` + "\n", buf.String())
+}
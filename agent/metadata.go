@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"regexp"
+	"strings"
+	"log"
+)
+
+const (
+	podLabelPrefix = "label."
+	podAnnotationPrefix = "annotation."
+)
+
+// requiredLabels are kept whatever the filter is, servers, archives and dedup name logs by them.
+var requiredLabels = map[string]bool{
+	"docker.name": true,
+	"container_id": true,
+	"namespace": true,
+	"pod": true,
+	"container": true,
+}
+
+type MetadataConfig struct {
+	NodeName string
+	// Pods is used to fetch pod labels and annotations, nil disables it
+	Pods PodSource
+	PodLabels bool
+	PodAnnotations bool
+	// Allow and Deny are lists of label name patterns, "*" matches any characters
+	Allow []string
+	Deny []string
+}
+
+// logLabel returns a setting of the log from pod annotations or labels (annotation.*, label.*),
+// docker container labels are added as label.*.
+func logLabel(labels LogLabels, name string) (string, bool) {
+	for _, prefix := range []string{podAnnotationPrefix, podLabelPrefix} {
+		if v, ok := labels[prefix + name]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// settingLabels returns pod and container labels configuring the agent, they are read by logLabel.
+func settingLabels(labels LogLabels) LogLabels {
+	settings := LogLabels{}
+	for name, value := range labels {
+		for _, prefix := range []string{podAnnotationPrefix, podLabelPrefix} {
+			if strings.HasPrefix(name, prefix + agentDockerLabelPrefix) {
+				settings[name] = value
+			}
+		}
+	}
+	return settings
+}
+
+// withSettings returns labels with setting labels dropped by the filter, so overrides don't depend on labels_allow.
+func withSettings(labels, settings LogLabels) LogLabels {
+	res := make(LogLabels, len(labels) + len(settings))
+	for name, value := range labels {
+		res[name] = value
+	}
+	for name, value := range settings {
+		res[name] = value
+	}
+	return res
+}
+
+type LabelsFilter struct {
+	allow []*regexp.Regexp
+	deny []*regexp.Regexp
+}
+
+func compileLabelPatterns(patterns []string) []*regexp.Regexp {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		p = strings.Replace(regexp.QuoteMeta(p), `\*`, ".*", -1)
+		res = append(res, regexp.MustCompile("^" + p + "$"))
+	}
+	return res
+}
+
+func NewLabelsFilter(allow, deny []string) *LabelsFilter {
+	return &LabelsFilter{
+		allow: compileLabelPatterns(allow),
+		deny: compileLabelPatterns(deny),
+	}
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, p := range patterns {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *LabelsFilter) Allowed(name string) bool {
+	if len(f.allow) > 0 && !matchAny(f.allow, name) {
+		return false
+	}
+	return !matchAny(f.deny, name)
+}
+
+type Enricher struct {
+	config MetadataConfig
+	filter *LabelsFilter
+}
+
+func NewEnricher(config MetadataConfig) *Enricher {
+	return &Enricher{
+		config: config,
+		filter: NewLabelsFilter(config.Allow, config.Deny),
+	}
+}
+
+// Enrich returns labels sent with the log and labels configuring the agent, which are taken before the filter.
+func (e *Enricher) Enrich(labels LogLabels) (LogLabels, LogLabels) {
+	if e.config.NodeName != "" {
+		labels["node"] = e.config.NodeName
+	}
+	namespace, pod := labels["namespace"], labels["pod"]
+	if e.config.Pods != nil && namespace != "" && pod != "" {
+		p, err := e.config.Pods.GetPod(namespace, pod)
+		if err != nil {
+			log.Println("failed to get pod", namespace, pod, err)
+		} else {
+			e.addPodMetadata(labels, p)
+		}
+	}
+	settings := settingLabels(labels)
+	for name := range labels {
+		if !requiredLabels[name] && !e.filter.Allowed(name) {
+			delete(labels, name)
+		}
+	}
+	return labels, settings
+}
+
+func (e *Enricher) addPodMetadata(labels LogLabels, pod *Pod) {
+	if e.config.PodLabels {
+		for k, v := range pod.Metadata.Labels {
+			labels[podLabelPrefix + k] = v
+		}
+	}
+	if e.config.PodAnnotations {
+		for k, v := range pod.Metadata.Annotations {
+			labels[podAnnotationPrefix + k] = v
+		}
+	}
+	if _, ok := labels["image"]; !ok {
+		for _, c := range pod.Spec.Containers {
+			if c.Name == labels["container"] {
+				labels["image"] = c.Image
+			}
+		}
+	}
+	if _, ok := labels["node"]; !ok && pod.Spec.NodeName != "" {
+		labels["node"] = pod.Spec.NodeName
+	}
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnricher(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/pods/nginx-1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{
+			"metadata": {
+				"name": "nginx-1",
+				"namespace": "default",
+				"labels": {"app": "nginx", "pod-template-hash": "6db489d4b7", "oklogging/parser": "nginx"},
+				"annotations": {"kubectl.kubernetes.io/last-applied-configuration": "{}", "team": "web"}
+			},
+			"spec": {"nodeName": "node-1", "containers": [{"name": "nginx", "image": "nginx:1.13"}]}
+		}`))
+	}))
+	defer api.Close()
+	pods, err := NewKubernetesApi(api.URL, "", "")
+	require.NoError(t, err)
+
+	enricher := NewEnricher(MetadataConfig{
+		Pods: pods,
+		PodLabels: true,
+		PodAnnotations: true,
+		Deny: []string{"label.pod-template-hash", "annotation.kubectl.kubernetes.io/*"},
+	})
+	labels, settings := enricher.Enrich(LogLabels{"namespace": "default", "pod": "nginx-1", "container": "nginx"})
+	assert.Equal(t, LogLabels{
+		"namespace": "default",
+		"pod": "nginx-1",
+		"container": "nginx",
+		"node": "node-1",
+		"image": "nginx:1.13",
+		"label.app": "nginx",
+		"label.oklogging/parser": "nginx",
+		"annotation.team": "web",
+	}, labels)
+	assert.Equal(t, LogLabels{"label.oklogging/parser": "nginx"}, settings)
+
+	enricher = NewEnricher(MetadataConfig{NodeName: "node-2", Pods: pods, Allow: []string{"node"}})
+	labels, _ = enricher.Enrich(LogLabels{"namespace": "kube-system", "pod": "unknown", "container": "dns", "image": "dns:1"})
+	assert.Equal(t, LogLabels{"namespace": "kube-system", "pod": "unknown", "container": "dns", "node": "node-2"}, labels)
+
+	// labels used by path templates and dedup are always sent, settings are kept aside
+	enricher = NewEnricher(MetadataConfig{Pods: pods, PodLabels: true, Allow: []string{"node"}, Deny: []string{"docker.*", "container*"}})
+	labels, settings = enricher.Enrich(LogLabels{"namespace": "default", "pod": "nginx-1", "container": "nginx", "docker.name": "k8s_nginx", "container_id": "abc", "label.oklogging/rate-limit-lines": "10"})
+	assert.Equal(t, LogLabels{"namespace": "default", "pod": "nginx-1", "container": "nginx", "node": "node-1", "docker.name": "k8s_nginx", "container_id": "abc"}, labels)
+	assert.Equal(t, LogLabels{"label.oklogging/parser": "nginx", "label.oklogging/rate-limit-lines": "10"}, settings)
+	withLabels := withSettings(labels, settings)
+	assert.Equal(t, "nginx", withLabels["label.oklogging/parser"])
+	assert.Len(t, labels, 6)
+}
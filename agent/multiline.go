@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMultilineMaxLines = 500
+	defaultMultilineMaxWait  = 3 * time.Second
+)
+
+type MultilineConfig struct {
+	// StartPattern matches the first line of an event, all lines not matching it are continuations.
+	StartPattern *regexp.Regexp
+	// ContinuationPattern matches lines that belong to the previous event.
+	ContinuationPattern *regexp.Regexp
+	MaxLines            int
+	MaxWait             time.Duration
+}
+
+func (cfg *MultilineConfig) Enabled() bool {
+	return cfg != nil && (cfg.StartPattern != nil || cfg.ContinuationPattern != nil)
+}
+
+// Multiline joins consecutive records of a stream into one event, which keeps the time and stream of its first record.
+// Every pushed record carries the input offset right before and right after it, the offset of a joined event is the
+// offset of its last record, but not past the first record of events pending in other streams.
+type Multiline struct {
+	config  MultilineConfig
+	pending map[string]*pendingEvent
+}
+
+type pendingEvent struct {
+	first  *Record
+	event  strings.Builder
+	lines  int
+	start  int64
+	offset int64
+}
+
+func NewMultiline(config MultilineConfig) *Multiline {
+	if config.MaxLines <= 0 {
+		config.MaxLines = defaultMultilineMaxLines
+	}
+	if config.MaxWait <= 0 {
+		config.MaxWait = defaultMultilineMaxWait
+	}
+	return &Multiline{config: config, pending: map[string]*pendingEvent{}}
+}
+
+func (m *Multiline) isContinuation(line string) bool {
+	line = strings.TrimRight(line, "\r\n")
+	if m.config.StartPattern != nil && m.config.StartPattern.MatchString(line) {
+		return false
+	}
+	if m.config.ContinuationPattern == nil {
+		return m.config.StartPattern != nil
+	}
+	return m.config.ContinuationPattern.MatchString(line)
+}
+
+// Push adds a record read from start to offset and returns the previous event of its stream if the record
+// doesn't continue it or if the event has reached MaxLines.
+func (m *Multiline) Push(record *Record, start, offset int64) (*Record, int64, bool) {
+	var flushed *pendingEvent
+	p := m.pending[record.Stream]
+	if p != nil && (p.lines >= m.config.MaxLines || !m.isContinuation(record.Log)) {
+		flushed = p
+		p = nil
+	}
+	if p == nil {
+		p = &pendingEvent{first: record, start: start}
+		m.pending[record.Stream] = p
+	}
+	p.event.WriteString(record.Log)
+	p.lines++
+	p.offset = offset
+	if flushed == nil && p.lines >= m.config.MaxLines {
+		// otherwise it's flushed before the next record of the stream is appended
+		flushed = p
+		delete(m.pending, record.Stream)
+	}
+	if flushed == nil {
+		return nil, 0, false
+	}
+	return m.event(flushed)
+}
+
+// Flush returns the oldest pending event, if any, it's called until it returns false to flush all streams.
+func (m *Multiline) Flush() (*Record, int64, bool) {
+	oldest := ""
+	for stream, p := range m.pending {
+		if o, ok := m.pending[oldest]; !ok || p.start < o.start {
+			oldest = stream
+		}
+	}
+	p, ok := m.pending[oldest]
+	if !ok {
+		return nil, 0, false
+	}
+	delete(m.pending, oldest)
+	return m.event(p)
+}
+
+// event returns the joined event, its offset isn't past the start of other pending events, so they are read again
+// after a restart.
+func (m *Multiline) event(p *pendingEvent) (*Record, int64, bool) {
+	offset := p.offset
+	for _, other := range m.pending {
+		if other.start < offset {
+			offset = other.start
+		}
+	}
+	event := p.first
+	event.Log = p.event.String()
+	return event, offset, true
+}
+
+func (m *Multiline) Pending() bool {
+	return len(m.pending) > 0
+}
+
+func (m *Multiline) MaxWait() time.Duration {
+	return m.config.MaxWait
+}
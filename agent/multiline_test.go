@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"testing"
+	"regexp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultilineStartPattern(t *testing.T) {
+	m := NewMultiline(MultilineConfig{StartPattern: regexp.MustCompile(`^\d{4}-\d{2}-\d{2}`)})
+
+	_, _, ok := m.Push(&Record{Time: "t1", Stream: "stderr", Log: "2018-01-01 ERROR failed\n"}, 0, 10)
+	assert.False(t, ok)
+	_, _, ok = m.Push(&Record{Time: "t2", Stream: "stderr", Log: "java.lang.NullPointerException\n"}, 10, 20)
+	assert.False(t, ok)
+	_, _, ok = m.Push(&Record{Time: "t3", Stream: "stderr", Log: "\tat Main.main(Main.java:1)\n"}, 20, 30)
+	assert.False(t, ok)
+
+	event, offset, ok := m.Push(&Record{Time: "t4", Stream: "stderr", Log: "2018-01-01 INFO next\n"}, 30, 40)
+	assert.True(t, ok)
+	assert.Equal(t, &Record{
+		Time: "t1",
+		Stream: "stderr",
+		Log: "2018-01-01 ERROR failed\njava.lang.NullPointerException\n\tat Main.main(Main.java:1)\n",
+	}, event)
+	assert.Equal(t, int64(30), offset)
+	assert.True(t, m.Pending())
+
+	event, offset, ok = m.Flush()
+	assert.True(t, ok)
+	assert.Equal(t, &Record{Time: "t4", Stream: "stderr", Log: "2018-01-01 INFO next\n"}, event)
+	assert.Equal(t, int64(40), offset)
+	assert.False(t, m.Pending())
+
+	_, _, ok = m.Flush()
+	assert.False(t, ok)
+}
+
+func TestMultilineContinuationPattern(t *testing.T) {
+	m := NewMultiline(MultilineConfig{ContinuationPattern: regexp.MustCompile(`^\s`)})
+
+	m.Push(&Record{Log: "Traceback (most recent call last):\n"}, 0, 1)
+	m.Push(&Record{Log: "  File \"main.py\", line 1\n"}, 1, 2)
+	event, offset, ok := m.Push(&Record{Log: "ValueError\n"}, 2, 3)
+	assert.True(t, ok)
+	assert.Equal(t, "Traceback (most recent call last):\n  File \"main.py\", line 1\n", event.Log)
+	assert.Equal(t, int64(2), offset)
+}
+
+func TestMultilineMaxLines(t *testing.T) {
+	m := NewMultiline(MultilineConfig{ContinuationPattern: regexp.MustCompile(`^\s`), MaxLines: 2})
+
+	_, _, ok := m.Push(&Record{Log: "a\n"}, 0, 1)
+	assert.False(t, ok)
+	event, offset, ok := m.Push(&Record{Log: " b\n"}, 1, 2)
+	assert.True(t, ok)
+	assert.Equal(t, "a\n b\n", event.Log)
+	assert.Equal(t, int64(2), offset)
+	assert.False(t, m.Pending())
+
+	// continuations aren't appended to full events
+	m = NewMultiline(MultilineConfig{ContinuationPattern: regexp.MustCompile(`^\s`), MaxLines: 1})
+	for i, line := range []string{"a\n", "b\n", " c\n"} {
+		event, offset, ok = m.Push(&Record{Log: line}, int64(i), int64(i + 1))
+		assert.True(t, ok)
+		assert.Equal(t, line, event.Log)
+		assert.Equal(t, int64(i + 1), offset)
+	}
+	assert.False(t, m.Pending())
+}
+
+func TestMultilineStreams(t *testing.T) {
+	m := NewMultiline(MultilineConfig{StartPattern: regexp.MustCompile(`^\S`)})
+
+	m.Push(&Record{Stream: "stderr", Log: "panic: failed\n"}, 0, 10)
+	m.Push(&Record{Stream: "stdout", Log: "request\n"}, 10, 20)
+	_, _, ok := m.Push(&Record{Stream: "stderr", Log: "\tat main.go:10\n"}, 20, 30)
+	assert.False(t, ok)
+	event, offset, ok := m.Push(&Record{Stream: "stdout", Log: "response\n"}, 30, 40)
+	assert.True(t, ok)
+	assert.Equal(t, &Record{Stream: "stdout", Log: "request\n"}, event)
+	assert.Equal(t, int64(0), offset, "not past the pending stderr event")
+
+	event, offset, ok = m.Flush()
+	assert.True(t, ok)
+	assert.Equal(t, &Record{Stream: "stderr", Log: "panic: failed\n\tat main.go:10\n"}, event)
+	assert.Equal(t, int64(30), offset)
+	event, offset, ok = m.Flush()
+	assert.True(t, ok)
+	assert.Equal(t, &Record{Stream: "stdout", Log: "response\n"}, event)
+	assert.Equal(t, int64(40), offset)
+	assert.False(t, m.Pending())
+}
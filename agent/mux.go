@@ -0,0 +1,359 @@
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// muxVersion of the mux capability switches a connection to the multiplexed protocol
+	muxVersion = "1"
+
+	muxOpen = 1
+	muxData = 2
+	muxClose = 3
+
+	// muxHeaderSize is the frame type and the stream id
+	muxHeaderSize = 5
+)
+
+var errMuxClosed = fmt.Errorf("multiplexed connection closed")
+
+type muxResponse struct {
+	status int32
+	body []byte
+}
+
+// muxConn is a connection carrying streams of many logs. Each stream waits for the response to its frame
+// before sending the next one, responses are routed to streams by ids.
+type muxConn struct {
+	conn net.Conn
+	server string
+	timeout time.Duration
+	writeLock sync.Mutex
+	lock sync.Mutex
+	nextId uint32
+	streams map[uint32]chan muxResponse
+	done chan struct{}
+	err error
+	// checksum is set if the server has accepted checksums for all streams of the connection
+	checksum bool
+	// dedup is set if the server has accepted input offsets of batches for all streams of the connection
+	dedup bool
+	// backpressure is set if the server replies retry-after hints and keeps streams after them
+	backpressure bool
+	// codec compresses batches of all streams, it's empty without compression
+	codec string
+	// lastWrite is guarded by writeLock
+	lastWrite time.Time
+}
+
+func newMuxConn(config TcpOutputConfig, server string) (*muxConn, error) {
+	conn, err := dial(config, server)
+	if err != nil {
+		return nil, err
+	}
+	accepted, err := handshake(conn, config, nil, config.capabilities(true))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, ok := accepted[capMux]; !ok {
+		conn.Close()
+		return nil, fmt.Errorf("server %s doesn't support multiplexing", server)
+	}
+	c := &muxConn{
+		conn: conn,
+		server: server,
+		timeout: config.Timeout,
+		streams: map[uint32]chan muxResponse{},
+		done: make(chan struct{}),
+		checksum: accepted[capChecksum] == checksumCrc32c,
+		dedup: accepted[capDedup] == dedupVersion,
+	}
+	_, c.backpressure = accepted[capBackpressure]
+	c.codec = accepted[capCompression]
+	if interval := parseHeartbeat(accepted); interval > 0 {
+		go c.heartbeats(interval)
+	}
+	go c.readResponses()
+	log.Println("multiplexed connection to", server, "established")
+	return c, nil
+}
+
+func (c *muxConn) readResponses() {
+	for {
+		frame, err := readFrame(c.conn, 0)
+		if err == nil && len(frame) < muxHeaderSize + 4 {
+			err = fmt.Errorf("invalid multiplexed frame size: %d", len(frame))
+		}
+		if err != nil {
+			c.close(err)
+			return
+		}
+		id := binary.LittleEndian.Uint32(frame[1:])
+		response := muxResponse{
+			status: int32(binary.LittleEndian.Uint32(frame[muxHeaderSize:])),
+			body: frame[muxHeaderSize + 4:],
+		}
+		c.lock.Lock()
+		ch, ok := c.streams[id]
+		c.lock.Unlock()
+		if !ok {
+			// the stream has timed out or closed
+			continue
+		}
+		select {
+		case ch <- response:
+		default:
+		}
+	}
+}
+
+func (c *muxConn) close(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	if err != errMuxClosed {
+		log.Println("multiplexed connection to", c.server, "failed", err)
+	}
+	c.err = err
+	c.conn.Close()
+	close(c.done)
+}
+
+func (c *muxConn) broken() bool {
+	select {
+	case <- c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *muxConn) register() uint32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.nextId++
+	c.streams[c.nextId] = make(chan muxResponse, 1)
+	return c.nextId
+}
+
+func (c *muxConn) unregister(id uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.streams, id)
+}
+
+func (c *muxConn) write(typ byte, id uint32, body []byte) error {
+	frame := make([]byte, muxHeaderSize + len(body))
+	frame[0] = typ
+	binary.LittleEndian.PutUint32(frame[1:], id)
+	copy(frame[muxHeaderSize:], body)
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if err := writeFrame(c.conn, frame, c.timeout); err != nil {
+		c.close(err)
+		return err
+	}
+	c.lastWrite = time.Now()
+	return nil
+}
+
+// request sends a frame of the stream and waits for the response.
+func (c *muxConn) request(typ byte, id uint32, body []byte) (muxResponse, error) {
+	c.lock.Lock()
+	ch, ok := c.streams[id]
+	c.lock.Unlock()
+	if !ok {
+		return muxResponse{}, fmt.Errorf("unknown stream %d", id)
+	}
+	if err := c.write(typ, id, body); err != nil {
+		return muxResponse{}, err
+	}
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case response := <- ch:
+		return response, nil
+	case <- c.done:
+		return muxResponse{}, c.err
+	case <- timer.C:
+		return muxResponse{}, fmt.Errorf("stream %d response timeout", id)
+	}
+}
+
+// Multiplexer keeps a connection per server shared by MuxOutputs.
+type Multiplexer struct {
+	config TcpOutputConfig
+	lock sync.Mutex
+	conns map[string]*muxConn
+}
+
+func NewMultiplexer(config TcpOutputConfig) *Multiplexer {
+	return &Multiplexer{config: config, conns: map[string]*muxConn{}}
+}
+
+func (m *Multiplexer) conn(server string) (*muxConn, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if c, ok := m.conns[server]; ok && !c.broken() {
+		return c, nil
+	}
+	c, err := newMuxConn(m.config, server)
+	if err != nil {
+		return nil, err
+	}
+	m.conns[server] = c
+	return c, nil
+}
+
+func (m *Multiplexer) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for server, c := range m.conns {
+		c.close(errMuxClosed)
+		delete(m.conns, server)
+	}
+}
+
+// MuxOutput writes batches of a log to a stream of a multiplexed connection.
+type MuxOutput struct {
+	mux *Multiplexer
+	labels map[string]string
+	conn *muxConn
+	id uint32
+	server string
+	compressor Compressor
+	throttle throttle
+}
+
+func NewMuxOutput(mux *Multiplexer, labels map[string]string) *MuxOutput {
+	return &MuxOutput{mux: mux, labels: labels}
+}
+
+func (o *MuxOutput) String() string {
+	server := o.server
+	if server == "" {
+		server = o.mux.config.Servers.String()
+	}
+	return fmt.Sprintf("MuxOutput(%s, %v)", server, o.labels)
+}
+
+func (o *MuxOutput) Close() {
+	if o.conn != nil {
+		o.closeStream()
+	}
+}
+
+func (o *MuxOutput) closeStream() {
+	o.conn.unregister(o.id)
+	if !o.conn.broken() {
+		if err := o.conn.write(muxClose, o.id, nil); err != nil {
+			log.Println("failed to close stream", o.String(), err)
+		}
+	}
+	o.conn = nil
+}
+
+// failed closes the stream, the server is marked as failed if the connection is broken.
+func (o *MuxOutput) failed() {
+	if o.conn.broken() {
+		o.mux.config.Servers.Failed(o.server)
+	}
+	o.closeStream()
+}
+
+func (o *MuxOutput) open() error {
+	config := o.mux.config
+	labelsJson, err := json.Marshal(o.labels)
+	if err != nil {
+		return err
+	}
+	if o.server, err = config.Servers.Pick(serverKey(o.labels)); err != nil {
+		return err
+	}
+	if o.conn, err = o.mux.conn(o.server); err != nil {
+		config.Servers.Failed(o.server)
+		return err
+	}
+	o.id = o.conn.register()
+	response, err := o.conn.request(muxOpen, o.id, labelsJson)
+	if err != nil {
+		o.failed()
+		return err
+	}
+	if response.status != 200 {
+		o.closeStream()
+		return StatusError(response.status)
+	}
+	o.compressor = nil
+	if o.conn.codec != "" {
+		if o.compressor, err = NewCompressor(o.conn.codec); err != nil {
+			o.closeStream()
+			return err
+		}
+		log.Println(o.String(), "using compression", o.conn.codec)
+	}
+	config.Servers.Ok(o.server)
+	log.Println(o.String(), "stream", o.id, "opened")
+	return nil
+}
+
+func (o *MuxOutput) Write(data []byte) error {
+	return o.WriteBatch(&Batch{Data: data})
+}
+
+func (o *MuxOutput) WriteBatch(batch *Batch) error {
+	if err := o.throttle.wait(o.server); err != nil {
+		return err
+	}
+	if o.conn != nil && o.conn.broken() {
+		o.closeStream()
+	}
+	if o.conn == nil {
+		if err := o.open(); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	body, err := encodeBatch(batch, o.compressor, o.conn.dedup, o.conn.checksum)
+	if err != nil {
+		return err
+	}
+	response, err := o.conn.request(muxData, o.id, body)
+	for retries := 0; err == nil && response.status == statusChecksumMismatch; retries++ {
+		checksumMismatches.Inc()
+		if retries == maxChecksumRetries {
+			break
+		}
+		log.Println(o.String(), "checksum mismatch, sending the batch again")
+		response, err = o.conn.request(muxData, o.id, body)
+	}
+	if err != nil {
+		o.failed()
+		return err
+	}
+	if response.status == statusTooManyRequests && o.conn.backpressure {
+		if after, err := decodeRetryAfter(response.body); err == nil {
+			o.throttle.set(after)
+			return &RetryAfterError{After: after, Err: StatusError(response.status)}
+		}
+	}
+	if response.status != 200 {
+		// the server closes the stream on other errors
+		o.closeStream()
+		return StatusError(response.status)
+	}
+	writeHistogram.Observe(time.Since(start).Seconds())
+	bytesWritten.Add(float64(len(body)))
+	bytesUncompressed.Add(float64(len(batch.Data)))
+	return nil
+}
@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// muxFrame is a frame received by muxServer with the connection it's answered over.
+type muxFrame struct {
+	conn net.Conn
+	typ byte
+	id uint32
+	body string
+}
+
+// muxServer accepts multiplexed connections and sends received frames to the channel, they are answered by tests.
+func muxServer(t *testing.T) (net.Listener, <-chan muxFrame) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	frames := make(chan muxFrame, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				<- testHandshakeServer(t, conn, welcome{Version: 1, Status: 200, Capabilities: map[string]string{capMux: muxVersion}})
+				for {
+					frame, err := readFrame(conn, 0)
+					if err != nil || len(frame) < muxHeaderSize {
+						return
+					}
+					frames <- muxFrame{conn: conn, typ: frame[0], id: binary.LittleEndian.Uint32(frame[1:]), body: string(frame[muxHeaderSize:])}
+				}
+			}()
+		}
+	}()
+	return l, frames
+}
+
+func receiveMuxFrame(t *testing.T, frames <-chan muxFrame) muxFrame {
+	select {
+	case f := <- frames:
+		return f
+	case <- time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for a frame")
+	}
+	return muxFrame{}
+}
+
+func respondMux(t *testing.T, f muxFrame, status int32) {
+	response := make([]byte, muxHeaderSize + 4)
+	response[0] = f.typ
+	binary.LittleEndian.PutUint32(response[1:], f.id)
+	binary.LittleEndian.PutUint32(response[muxHeaderSize:], uint32(status))
+	require.NoError(t, writeFrame(f.conn, response, time.Second))
+}
+
+func writeAsync(o *MuxOutput, data string) <-chan error {
+	res := make(chan error, 1)
+	go func() {
+		res <- o.Write([]byte(data))
+	}()
+	return res
+}
+
+func waitWrite(t *testing.T, res <-chan error) error {
+	select {
+	case err := <- res:
+		return err
+	case <- time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for a write")
+	}
+	return nil
+}
+
+func TestMuxOutputStreams(t *testing.T) {
+	l, frames := muxServer(t)
+	defer l.Close()
+	servers, _ := testServerPool(t, l.Addr().String())
+	mux := NewMultiplexer(TcpOutputConfig{VersionedHandshake: true, Servers: servers, Timeout: time.Second})
+	defer mux.Close()
+	a, b := NewMuxOutput(mux, map[string]string{"docker.name": "a"}), NewMuxOutput(mux, map[string]string{"docker.name": "b"})
+	defer a.Close()
+	defer b.Close()
+
+	// streams are opened over one connection with their labels
+	resA := writeAsync(a, "a\n")
+	openA := receiveMuxFrame(t, frames)
+	assert.Equal(t, byte(muxOpen), openA.typ)
+	assert.JSONEq(t, `{"docker.name": "a"}`, openA.body)
+	resB := writeAsync(b, "b\n")
+	openB := receiveMuxFrame(t, frames)
+	assert.JSONEq(t, `{"docker.name": "b"}`, openB.body)
+	assert.True(t, openA.conn == openB.conn)
+	assert.NotEqual(t, openA.id, openB.id)
+
+	// responses are routed by stream ids
+	respondMux(t, openB, 200)
+	dataB := receiveMuxFrame(t, frames)
+	assert.Equal(t, muxFrame{conn: openB.conn, typ: muxData, id: openB.id, body: "b\n"}, dataB)
+	respondMux(t, openA, 200)
+	dataA := receiveMuxFrame(t, frames)
+	assert.Equal(t, muxFrame{conn: openA.conn, typ: muxData, id: openA.id, body: "a\n"}, dataA)
+	respondMux(t, dataA, 200)
+	respondMux(t, dataB, 200)
+	require.NoError(t, waitWrite(t, resA))
+	require.NoError(t, waitWrite(t, resB))
+
+	// opened streams carry next batches
+	res := writeAsync(a, "c\n")
+	data := receiveMuxFrame(t, frames)
+	assert.Equal(t, muxFrame{conn: openA.conn, typ: muxData, id: openA.id, body: "c\n"}, data)
+	respondMux(t, data, 200)
+	require.NoError(t, waitWrite(t, res))
+}
+
+func TestMuxOutputResponseTimeout(t *testing.T) {
+	l, frames := muxServer(t)
+	defer l.Close()
+	servers, _ := testServerPool(t, l.Addr().String())
+	mux := NewMultiplexer(TcpOutputConfig{VersionedHandshake: true, Servers: servers, Timeout: 200 * time.Millisecond})
+	defer mux.Close()
+	o := NewMuxOutput(mux, map[string]string{"docker.name": "a"})
+	defer o.Close()
+
+	res := writeAsync(o, "a\n")
+	open := receiveMuxFrame(t, frames)
+	respondMux(t, open, 200)
+	late := receiveMuxFrame(t, frames)
+	assert.Error(t, waitWrite(t, res), "the data frame isn't answered")
+	// the stream is closed, the connection is kept for other streams
+	closed := receiveMuxFrame(t, frames)
+	assert.Equal(t, muxFrame{conn: open.conn, typ: muxClose, id: open.id, body: ""}, closed)
+
+	// the late response of the closed stream is ignored and the batch is sent over a new stream
+	respondMux(t, late, 200)
+	res = writeAsync(o, "a\n")
+	reopen := receiveMuxFrame(t, frames)
+	assert.Equal(t, byte(muxOpen), reopen.typ)
+	assert.True(t, reopen.conn == open.conn)
+	assert.NotEqual(t, open.id, reopen.id)
+	respondMux(t, reopen, 200)
+	data := receiveMuxFrame(t, frames)
+	assert.Equal(t, muxFrame{conn: open.conn, typ: muxData, id: reopen.id, body: "a\n"}, data)
+	respondMux(t, data, 200)
+	require.NoError(t, waitWrite(t, res))
+}
+
+func TestMuxOutputConnectionLost(t *testing.T) {
+	l, frames := muxServer(t)
+	defer l.Close()
+	addr := l.Addr().String()
+	servers, now := testServerPool(t, addr)
+	mux := NewMultiplexer(TcpOutputConfig{VersionedHandshake: true, Servers: servers, Timeout: time.Second})
+	defer mux.Close()
+	o := NewMuxOutput(mux, map[string]string{"docker.name": "a"})
+	defer o.Close()
+
+	res := writeAsync(o, "a\n")
+	open := receiveMuxFrame(t, frames)
+	respondMux(t, open, 200)
+	receiveMuxFrame(t, frames)
+	open.conn.Close()
+	assert.Error(t, waitWrite(t, res))
+	servers.lock.Lock()
+	assert.True(t, servers.states[addr].downUntil.After(*now), "the server is marked as failed")
+	servers.lock.Unlock()
+
+	// the stream is opened again over a new connection
+	res = writeAsync(o, "a\n")
+	reopen := receiveMuxFrame(t, frames)
+	assert.Equal(t, byte(muxOpen), reopen.typ)
+	assert.False(t, reopen.conn == open.conn)
+	assert.JSONEq(t, `{"docker.name": "a"}`, reopen.body)
+	respondMux(t, reopen, 200)
+	data := receiveMuxFrame(t, frames)
+	assert.Equal(t, "a\n", data.body)
+	respondMux(t, data, 200)
+	require.NoError(t, waitWrite(t, res))
+}
+
+func TestMuxOutputOpenStatus(t *testing.T) {
+	l, frames := muxServer(t)
+	defer l.Close()
+	addr := l.Addr().String()
+	servers, _ := testServerPool(t, addr)
+	mux := NewMultiplexer(TcpOutputConfig{VersionedHandshake: true, Servers: servers, Timeout: time.Second})
+	defer mux.Close()
+	o := NewMuxOutput(mux, map[string]string{"docker.name": "a"})
+	defer o.Close()
+
+	res := writeAsync(o, "a\n")
+	open := receiveMuxFrame(t, frames)
+	respondMux(t, open, 400)
+	assert.Equal(t, StatusError(400), waitWrite(t, res))
+	closed := receiveMuxFrame(t, frames)
+	assert.Equal(t, muxFrame{conn: open.conn, typ: muxClose, id: open.id, body: ""}, closed)
+	servers.lock.Lock()
+	_, failed := servers.states[addr]
+	servers.lock.Unlock()
+	assert.False(t, failed, "the server isn't failed by a rejected stream")
+
+	res = writeAsync(o, "a\n")
+	reopen := receiveMuxFrame(t, frames)
+	assert.Equal(t, byte(muxOpen), reopen.typ)
+	assert.True(t, reopen.conn == open.conn)
+	respondMux(t, reopen, 200)
+	data := receiveMuxFrame(t, frames)
+	respondMux(t, data, 200)
+	require.NoError(t, waitWrite(t, res))
+}
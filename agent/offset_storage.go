@@ -1,6 +1,8 @@
 package agent
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"os"
 	"fmt"
 	"log"
@@ -10,6 +12,10 @@ import (
 	"strconv"
 )
 
+const (
+	generationSuffix = ".generation"
+)
+
 type OffsetStorage struct {
 	basePath string
 }
@@ -29,6 +35,7 @@ func (storage *OffsetStorage) GC(freshFiles []string) {
 	freshKeys := make(map[string]struct{}, len(freshFiles))
 	for _, f := range freshFiles {
 		freshKeys[storage.key(f)] = struct{}{}
+		freshKeys[storage.key(f) + generationSuffix] = struct{}{}
 	}
 	actualFiles, err := ioutil.ReadDir(storage.basePath)
 	if err != nil {
@@ -43,10 +50,14 @@ func (storage *OffsetStorage) GC(freshFiles []string) {
 	}
 }
 
-func (storage *OffsetStorage) key(f string) string {
+func pathKey(f string) string {
 	return strings.Replace(f, "/", "_", -1)
 }
 
+func (storage *OffsetStorage) key(f string) string {
+	return pathKey(f)
+}
+
 func (storage *OffsetStorage) offsetPath(f string) string {
 	return path.Join(storage.basePath, storage.key(f))
 }
@@ -69,4 +80,47 @@ func (storage *OffsetStorage) Get(f string) (int64, error) {
 func (storage *OffsetStorage) Save(f string, offset int64) error {
 	offsetFilePath := storage.offsetPath(f)
 	return ioutil.WriteFile(offsetFilePath, []byte(fmt.Sprintf("%d", offset)), 0644)
-}
\ No newline at end of file
+}
+
+// MigratePath moves the offset saved by older agents under the file path to the key of the file, it's called
+// before GC removes offsets of unknown keys.
+func (storage *OffsetStorage) MigratePath(filePath string, fileId string) {
+	offset, err := storage.Get(filePath)
+	if err != nil {
+		return
+	}
+	if _, err := storage.Get(fileId); err != nil {
+		if err := storage.Save(fileId, offset); err != nil {
+			log.Println("failed to migrate offset of", filePath, err)
+			return
+		}
+		log.Println("migrated offset of", filePath, "to inode", fileId)
+	}
+	os.Remove(storage.offsetPath(filePath))
+}
+
+// Generation returns a random id of the file created when the file is seen first, so a file reusing
+// the inode of a removed one can be told apart once the old offset is removed.
+func (storage *OffsetStorage) Generation(f string) (string, error) {
+	data, err := ioutil.ReadFile(storage.offsetPath(f) + generationSuffix)
+	if err == nil && len(data) > 0 {
+		return string(data), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return storage.NewGeneration(f)
+}
+
+// NewGeneration replaces the generation of the file, e.g. when it's read from the start again.
+func (storage *OffsetStorage) NewGeneration(f string) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	generation := hex.EncodeToString(id)
+	if err := ioutil.WriteFile(storage.offsetPath(f) + generationSuffix, []byte(generation), 0644); err != nil {
+		return "", err
+	}
+	return generation, nil
+}
@@ -23,8 +23,26 @@ func TestOffsetStorage(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, int64(100), offset)
 
+	generation, err := storage.Generation("/var/log/123.log")
+	require.NoError(t, err)
+	assert.Len(t, generation, 16)
+	g, err := storage.Generation("/var/log/123.log")
+	require.NoError(t, err)
+	assert.Equal(t, generation, g)
+	g, err = storage.NewGeneration("/var/log/123.log")
+	require.NoError(t, err)
+	assert.NotEqual(t, generation, g)
+
+	storage.GC([]string{"/var/log/123.log"})
+	generation, err = storage.Generation("/var/log/123.log")
+	require.NoError(t, err)
+	assert.Equal(t, g, generation)
+
 	storage.GC([]string{})
 
 	_, err = storage.Get("/var/log/123.log")
 	assert.Error(t, err)
+	generation, err = storage.Generation("/var/log/123.log")
+	require.NoError(t, err)
+	assert.NotEqual(t, g, generation)
 }
\ No newline at end of file
@@ -3,10 +3,13 @@ package agent
 import (
 	"net"
 	"time"
-	"encoding/json"
 	"encoding/binary"
 	"fmt"
 	"log"
+	"io"
+	"strings"
+	"strconv"
+	"crypto/tls"
 )
 
 type Output interface {
@@ -29,7 +32,7 @@ func (o *BlackHoleOutput) Write([]byte) error {
 	return nil
 }
 
-func send(conn net.Conn, payload []byte, timeout time.Duration) error {
+func writeFrame(conn net.Conn, payload []byte, timeout time.Duration) error {
 	if timeout > 0 {
 		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
 			return err
@@ -41,6 +44,18 @@ func send(conn net.Conn, payload []byte, timeout time.Duration) error {
 	if _, err := conn.Write(payload); err != nil {
 		return err
 	}
+	return conn.SetDeadline(time.Time{})
+}
+
+func send(conn net.Conn, payload []byte, timeout time.Duration) error {
+	if err := writeFrame(conn, payload, timeout); err != nil {
+		return err
+	}
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+	}
 	var status int32
 	if err := binary.Read(conn, binary.LittleEndian, &status); err != nil {
 		return err
@@ -49,28 +64,141 @@ func send(conn net.Conn, payload []byte, timeout time.Duration) error {
 		return err
 	}
 	if status != 200 {
-		return fmt.Errorf("got %d response from server:", status)
+		return StatusError(status)
 	}
 	return nil
 }
 
+// StatusError is a failure status replied by the server.
+type StatusError int32
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("got %d response from server", int32(e))
+}
+
+func readFrame(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+	}
+	var size int32
+	if err := binary.Read(conn, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 0 || size > maxFrameSize {
+		return nil, fmt.Errorf("invalid frame size: %d", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+type TcpOutputConfig struct {
+	Servers *ServerPool
+	Timeout time.Duration
+	// Compression is a list of codecs in preference order, the server picks one of them
+	Compression []string
+	// Tls is nil for plain tcp connections
+	Tls *TlsReloader
+	// Window is the max number of unacknowledged batches, batches are acknowledged one by one if it's 1 or less
+	Window int
+	// VersionedHandshake negotiates capabilities, they are all disabled with the legacy handshake
+	VersionedHandshake bool
+	// Checksum adds CRC32C to batches if the server supports it
+	Checksum bool
+	// Dedup sends input offsets of batches, so the server skips records it has already written
+	Dedup bool
+	// HeartbeatInterval is the max idle time of connections, heartbeats are disabled if it's 0
+	HeartbeatInterval time.Duration
+}
+
+// capabilities returns capabilities of per-log connections or multiplexed ones.
+func (config TcpOutputConfig) capabilities(mux bool) map[string]string {
+	capabilities := map[string]string{}
+	if len(config.Compression) > 0 {
+		capabilities[capCompression] = strings.Join(config.Compression, ",")
+	}
+	if mux {
+		capabilities[capMux] = muxVersion
+	} else if config.Window > 1 {
+		capabilities[capWindow] = strconv.Itoa(config.Window)
+	}
+	if config.Checksum {
+		capabilities[capChecksum] = checksumCrc32c
+	}
+	if config.Dedup {
+		capabilities[capDedup] = dedupVersion
+	}
+	capabilities[capBackpressure] = backpressureVersion
+	if config.HeartbeatInterval > 0 {
+		capabilities[capHeartbeat] = formatHeartbeat(config.HeartbeatInterval)
+	}
+	return capabilities
+}
+
 type TcpOutput struct {
-	server string
+	config TcpOutputConfig
 	conn net.Conn
+	// server is the address of the current or the last connection
+	server string
 	labels map[string]string
-	timeout time.Duration
+	compressor Compressor
+	// pipelined is set if the server has accepted the window of the current connection
+	pipelined bool
+	// checksum is set if the server has accepted checksums for the current connection
+	checksum bool
+	// dedup is set if the server has accepted input offsets of batches for the current connection
+	dedup bool
+	// backpressure is set if the server replies retry-after hints, throttle is guarded by the pipeline lock
+	backpressure bool
+	throttle throttle
+	// heartbeat is the interval accepted by the server for the current connection, lastSent is the last frame time
+	heartbeat time.Duration
+	lastSent time.Time
+	pipeline
 }
 
-func NewTcpOutput(server string, labels map[string]string, timeout time.Duration) *TcpOutput {
+func NewTcpOutput(config TcpOutputConfig, labels map[string]string) *TcpOutput {
 	return &TcpOutput{
-		server: server,
-		timeout: timeout,
+		config: config,
 		labels: labels,
+		pipeline: newPipeline(),
+	}
+}
+
+// serverKey assigns a log to servers, docker.name is unique for both docker and cri logs.
+func serverKey(labels map[string]string) string {
+	if name, ok := labels["docker.name"]; ok {
+		return name
 	}
+	return fmt.Sprint(labels)
+}
+
+// dial connects to one of the pool servers, server certificates are checked against the resolved name.
+func dial(config TcpOutputConfig, server string) (net.Conn, error) {
+	if config.Tls != nil {
+		dialer := &net.Dialer{Timeout: config.Timeout}
+		tlsConfig := config.Tls.ClientConfig()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = config.Servers.Host(server)
+		}
+		return tls.DialWithDialer(dialer, "tcp", server, tlsConfig)
+	}
+	return net.DialTimeout("tcp", server, config.Timeout)
 }
 
 func (o *TcpOutput) String() string {
-	return fmt.Sprintf("TcpOutput(%s, %v)", o.server, o.labels)
+	server := o.server
+	if server == "" {
+		server = o.config.Servers.String()
+	}
+	return fmt.Sprintf("TcpOutput(%s, %v)", server, o.labels)
 }
 
 func (o *TcpOutput) Close() {
@@ -82,40 +210,124 @@ func (o *TcpOutput) Close() {
 }
 
 func (o *TcpOutput) Write(data []byte) error {
+	return o.WriteBatch(&Batch{Data: data})
+}
+
+func (o *TcpOutput) WriteBatch(batch *Batch) error {
+	if err := o.throttled(); err != nil {
+		return err
+	}
+	if o.config.Window > 1 {
+		return o.writePipelined(batch)
+	}
 	if o.conn == nil {
 		if err := o.connect(); err != nil {
 			return err
 		}
 	}
+	return o.write(batch)
+}
+
+// write sends a batch and waits for its status.
+func (o *TcpOutput) write(batch *Batch) error {
 	start := time.Now()
-	if err := send(o.conn, data, o.timeout); err != nil {
+	frame, err := encodeBatch(batch, o.compressor, o.dedup, o.checksum)
+	if err != nil {
+		return err
+	}
+	err = send(o.conn, frame, o.config.Timeout)
+	for retries := 0; err == StatusError(statusChecksumMismatch); retries++ {
+		checksumMismatches.Inc()
+		if retries == maxChecksumRetries {
+			break
+		}
+		log.Println(o.String(), "checksum mismatch, sending the batch again")
+		err = send(o.conn, frame, o.config.Timeout)
+	}
+	if err == StatusError(statusTooManyRequests) && o.backpressure {
+		// the connection is kept, the server isn't failed
+		after, hintErr := readRetryAfter(o.conn, o.config.Timeout)
+		if hintErr == nil {
+			o.lock.Lock()
+			o.throttle.set(after)
+			o.lock.Unlock()
+			return &RetryAfterError{After: after, Err: err}
+		}
+		err = hintErr
+	}
+	if err != nil {
 		o.disconnect()
+		o.config.Servers.Failed(o.server)
 		return err
 	}
+	o.lastSent = time.Now()
 	writeHistogram.Observe(time.Since(start).Seconds())
-	bytesWritten.Add(float64(len(data)))
+	bytesWritten.Add(float64(len(frame)))
+	bytesUncompressed.Add(float64(len(batch.Data)))
 	return nil
 }
 
+// throttled returns RetryAfterError while the server doesn't accept batches.
+func (o *TcpOutput) throttled() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.throttle.wait(o.server)
+}
+
 func (o *TcpOutput) disconnect() error {
 	err := o.conn.Close()
 	o.conn = nil
+	o.connDone = nil
 	return err
 }
 
 func (o *TcpOutput) connect() error {
-	labelsJson, err := json.Marshal(o.labels)
-	if err != nil {
+	var err error
+	if o.server, err = o.config.Servers.Pick(serverKey(o.labels)); err != nil {
+		return err
+	}
+	if err := o.handshake(); err != nil {
+		o.config.Servers.Failed(o.server)
 		return err
 	}
-	o.conn, err = net.DialTimeout("tcp", o.server, o.timeout)
+	o.config.Servers.Ok(o.server)
+	if o.pipelined {
+		o.startPipeline(o.conn)
+	}
+	log.Println(o.String(), "connected")
+	return nil
+}
+
+func (o *TcpOutput) handshake() error {
+	conn, err := dial(o.config, o.server)
 	if err != nil {
 		return err
 	}
-	if err := send(o.conn, labelsJson, o.timeout); err != nil {
-		o.disconnect()
+	accepted, err := handshake(conn, o.config, o.labels, o.config.capabilities(false))
+	if err != nil {
+		conn.Close()
 		return err
 	}
-	log.Println(o.String(), "connected")
+	o.conn = conn
+	o.compressor = nil
+	if codec, ok := accepted[capCompression]; ok {
+		if o.compressor, err = NewCompressor(codec); err != nil {
+			o.disconnect()
+			return err
+		}
+		log.Println(o.String(), "using compression", codec)
+	}
+	_, o.pipelined = accepted[capWindow]
+	o.checksum = accepted[capChecksum] == checksumCrc32c
+	o.dedup = accepted[capDedup] == dedupVersion
+	_, o.backpressure = accepted[capBackpressure]
+	o.heartbeat = parseHeartbeat(accepted)
+	o.lastSent = time.Now()
+	if o.config.Dedup && !o.dedup {
+		log.Println(o.String(), "server doesn't support deduplication, resent batches may be duplicated")
+	}
+	if o.config.Window > 1 && !o.pipelined {
+		log.Println(o.String(), "server doesn't support pipelining, batches are acknowledged one by one")
+	}
 	return nil
 }
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+const (
+	// parserLabel selects a builtin pattern for a log, set as a pod label or annotation or a docker container label
+	parserLabel = "oklogging/parser"
+)
+
+const (
+	httpRequestPattern = `"(?:(?P<method>[A-Z]+) (?P<path>[^ "]+)(?: (?P<protocol>[^"]+))?|[^"]*)"`
+)
+
+// BuiltinPatterns are named capture regexps for common third-party logs, messages include continuation lines
+// of multiline events.
+var BuiltinPatterns = map[string]*regexp.Regexp{
+	"nginx": regexp.MustCompile(`^(?P<remote_addr>\S+) - (?P<remote_user>\S+) \[(?P<time_local>[^\]]+)\] ` +
+		httpRequestPattern + ` (?P<status>\d{3}) (?P<body_bytes_sent>\d+) "(?P<http_referer>[^"]*)" "(?P<http_user_agent>[^"]*)"`),
+	"apache": regexp.MustCompile(`^(?P<client>\S+) (?P<ident>\S+) (?P<user>\S+) \[(?P<time_local>[^\]]+)\] ` +
+		httpRequestPattern + ` (?P<status>\d{3}) (?P<bytes>\d+|-)(?: "(?P<referer>[^"]*)" "(?P<user_agent>[^"]*)")?`),
+	"syslog": regexp.MustCompile(`^(?:<(?P<priority>\d+)>)?(?P<timestamp>[A-Z][a-z]{2} +\d{1,2} \d{2}:\d{2}:\d{2}) ` +
+		`(?P<host>\S+) (?P<program>[^\[:\s]+)(?:\[(?P<pid>\d+)\])?: (?P<message>(?s:.*))$`),
+	"postgres": regexp.MustCompile(`^(?P<timestamp>\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?(?: \S+)?) \[(?P<pid>\d+)\] ` +
+		`(?:(?P<user>[^@\s]+)@(?P<database>\S+) )?(?P<level>[A-Z]+\d?): +(?P<message>(?s:.*))$`),
+	"klog": regexp.MustCompile(`^(?P<level>[IWEF])(?P<timestamp>\d{4} \d{2}:\d{2}:\d{2}\.\d{6}) +(?P<thread>\d+) ` +
+		`(?P<file>[^:\s]+):(?P<line>\d+)\] (?P<message>(?s:.*))$`),
+}
+
+type ParserConfig struct {
+	Selector LabelSelector
+	// Pattern is a regexp with named groups, e.g. one of BuiltinPatterns
+	Pattern *regexp.Regexp
+}
+
+func ValidatePattern(pattern *regexp.Regexp) error {
+	for _, name := range pattern.SubexpNames() {
+		if name != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("pattern has no named groups: %s", pattern)
+}
+
+// ParserTransformer sets Record.Fields from named groups of the pattern, records not matching it are kept as text.
+// Multiline events are matched as a whole.
+type ParserTransformer struct {
+	pattern *regexp.Regexp
+}
+
+func NewParserTransformer(pattern *regexp.Regexp) *ParserTransformer {
+	return &ParserTransformer{pattern: pattern}
+}
+
+// choosePattern returns the pattern selected by the log label or the first matching rule.
+func choosePattern(parsers []ParserConfig, labels LogLabels) *regexp.Regexp {
+	if name, ok := logLabel(labels, parserLabel); ok {
+		if pattern, ok := BuiltinPatterns[name]; ok {
+			return pattern
+		}
+		log.Println("unknown", parserLabel, "label value", name)
+	}
+	for _, p := range parsers {
+		if p.Selector.Matches(labels) {
+			return p.Pattern
+		}
+	}
+	return nil
+}
+
+func (t *ParserTransformer) Do(record *Record) error {
+	m := t.pattern.FindStringSubmatch(strings.TrimRight(record.Log, "\r\n"))
+	if m == nil {
+		return nil
+	}
+	fields := map[string]interface{}{}
+	for i, name := range t.pattern.SubexpNames() {
+		if name != "" && m[i] != "" {
+			fields[name] = m[i]
+		}
+	}
+	record.Fields = normalizeFields(fields, nil)
+	return nil
+}
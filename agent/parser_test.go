@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"testing"
+	"regexp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinPatterns(t *testing.T) {
+	for name, c := range map[string]struct{
+		log string
+		fields map[string]interface{}
+	}{
+		"nginx": {
+			`10.0.0.1 - - [01/Jan/2018:00:00:00 +0000] "GET /api?x=1 HTTP/1.1" 200 612 "-" "curl/7.58.0"`,
+			map[string]interface{}{
+				"remote_addr": "10.0.0.1", "remote_user": "-", "time_local": "01/Jan/2018:00:00:00 +0000",
+				"method": "GET", "path": "/api?x=1", "protocol": "HTTP/1.1", "status": "200",
+				"body_bytes_sent": "612", "http_referer": "-", "http_user_agent": "curl/7.58.0",
+			},
+		},
+		"apache": {
+			`10.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`,
+			map[string]interface{}{
+				"client": "10.0.0.1", "ident": "-", "user": "frank", "time_local": "10/Oct/2000:13:55:36 -0700",
+				"method": "GET", "path": "/apache_pb.gif", "protocol": "HTTP/1.0", "status": "200", "bytes": "2326",
+			},
+		},
+		"syslog": {
+			`<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed`,
+			map[string]interface{}{
+				"priority": "34", "timestamp": "Oct 11 22:14:15", "host": "mymachine", "program": "su",
+				"pid": "123", "message": "'su root' failed",
+			},
+		},
+		"postgres": {
+			`2018-01-01 00:00:00.123 UTC [42] app@db ERROR:  relation "x" does not exist`,
+			map[string]interface{}{
+				"timestamp": "2018-01-01 00:00:00.123 UTC", "pid": "42", "user": "app", "database": "db",
+				"level": "ERROR", "message": `relation "x" does not exist`,
+			},
+		},
+		"klog": {
+			`E0101 00:00:00.123456       1 controller.go:114] error syncing "default/web": timeout`,
+			map[string]interface{}{
+				"level": "E", "timestamp": "0101 00:00:00.123456", "thread": "1", "file": "controller.go",
+				"line": "114", "message": `error syncing "default/web": timeout`,
+			},
+		},
+	} {
+		record := &Record{Log: c.log + "\n"}
+		require.NoError(t, NewParserTransformer(BuiltinPatterns[name]).Do(record))
+		assert.Equal(t, c.fields, record.Fields, name)
+	}
+}
+
+func TestParserTransformer(t *testing.T) {
+	parser := NewParserTransformer(regexp.MustCompile(`^(?P<time>\S+) (?P<msg>.*)$`))
+	record := &Record{Log: "12:00 started\n"}
+	require.NoError(t, parser.Do(record))
+	assert.Equal(t, map[string]interface{}{"_time": "12:00", "msg": "started"}, record.Fields)
+
+	record = &Record{Log: "unmatched\n"}
+	require.NoError(t, parser.Do(record))
+	assert.Nil(t, record.Fields)
+
+	assert.Error(t, ValidatePattern(regexp.MustCompile(`^(\S+)`)))
+}
+
+func TestChoosePattern(t *testing.T) {
+	parsers := []ParserConfig{
+		{Selector: NewLabelSelector(map[string]string{"container": "nginx*"}), Pattern: BuiltinPatterns["nginx"]},
+		{Selector: NewLabelSelector(map[string]string{"namespace": "db"}), Pattern: BuiltinPatterns["postgres"]},
+	}
+	assert.Equal(t, BuiltinPatterns["nginx"], choosePattern(parsers, LogLabels{"container": "nginx-ingress", "namespace": "db"}))
+	assert.Equal(t, BuiltinPatterns["postgres"], choosePattern(parsers, LogLabels{"container": "pg", "namespace": "db"}))
+	assert.Nil(t, choosePattern(parsers, LogLabels{"container": "app"}))
+	assert.Equal(t, BuiltinPatterns["klog"], choosePattern(parsers, LogLabels{"container": "nginx", "annotation.oklogging/parser": "klog"}))
+}
@@ -0,0 +1,208 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// PipelinedOutput sends batches without waiting for acknowledgements of the previous ones.
+type PipelinedOutput interface {
+	Output
+	// Send writes a batch and returns its sequence number, it blocks while the window is full.
+	// Batches sent before a failed Send aren't acknowledged anymore and should be sent again.
+	Send(batch *Batch) (uint64, error)
+	// Acked returns the sequence number of the last batch persisted by the server, previous batches are persisted too
+	Acked() uint64
+	// Acks signals new acknowledgements
+	Acks() <-chan struct{}
+	Window() int
+}
+
+// pipelineAck is sent by the server for the last batch it has read, or for a failed one with an error status.
+type pipelineAck struct {
+	Seq uint64
+	Status int32
+}
+
+// pipeline keeps acknowledgements of a TcpOutput, sequence numbers grow across connections.
+type pipeline struct {
+	seq uint64
+	// connSeq is the last sequence number sent before the current connection
+	connSeq uint64
+	lock sync.Mutex
+	acked uint64
+	// signal wakes up Send, acks wake up the copier
+	signal chan struct{}
+	acks chan struct{}
+	// connDone is closed when acknowledgements of the current connection aren't read anymore
+	connDone chan struct{}
+}
+
+func newPipeline() pipeline {
+	return pipeline{
+		signal: make(chan struct{}, 1),
+		acks: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (o *TcpOutput) Acked() uint64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.acked
+}
+
+func (o *TcpOutput) Acks() <-chan struct{} {
+	return o.acks
+}
+
+func (o *TcpOutput) Window() int {
+	return o.config.Window
+}
+
+func (o *TcpOutput) startPipeline(conn net.Conn) {
+	o.connSeq = o.seq
+	o.connDone = make(chan struct{})
+	// the reader doesn't use fields reassigned by the next connection
+	go o.readAcks(conn, o.connDone, o.String(), o.backpressure)
+}
+
+func (o *TcpOutput) readAcks(conn net.Conn, done chan struct{}, name string, backpressure bool) {
+	defer close(done)
+	defer notify(o.acks)
+	for {
+		ack := pipelineAck{}
+		if err := binary.Read(conn, binary.LittleEndian, &ack); err != nil {
+			log.Println(name, "stopped reading acknowledgements", err)
+			return
+		}
+		if ack.Status != 200 {
+			// the server closes the connection, unacknowledged batches are sent again
+			if ack.Status == statusChecksumMismatch {
+				checksumMismatches.Inc()
+			}
+			if ack.Status == statusTooManyRequests && backpressure {
+				if after, err := readRetryAfter(conn, o.config.Timeout); err == nil {
+					o.lock.Lock()
+					o.throttle.set(after)
+					o.lock.Unlock()
+				}
+			}
+			log.Printf("%s got %d response from server for batch %d", name, ack.Status, ack.Seq)
+			conn.Close()
+			return
+		}
+		o.lock.Lock()
+		if ack.Seq > o.acked {
+			o.acked = ack.Seq
+		}
+		o.lock.Unlock()
+		notify(o.signal)
+		notify(o.acks)
+	}
+}
+
+// waitAck waits until the batch is acknowledged or the connection fails.
+func (o *TcpOutput) waitAck(seq uint64) error {
+	timer := time.NewTimer(o.config.Timeout)
+	defer timer.Stop()
+	for o.Acked() < seq {
+		select {
+		case <- o.signal:
+		case <- o.connDone:
+			return o.closed()
+		case <- timer.C:
+			o.disconnect()
+			o.config.Servers.Failed(o.server)
+			return fmt.Errorf("acknowledgement timeout")
+		}
+	}
+	return nil
+}
+
+// closed handles the connection closed by the server, the server isn't failed if it's overloaded.
+func (o *TcpOutput) closed() error {
+	o.disconnect()
+	if err := o.throttled(); err != nil {
+		return err
+	}
+	o.config.Servers.Failed(o.server)
+	return fmt.Errorf("connection to %s closed", o.server)
+}
+
+func (o *TcpOutput) Send(batch *Batch) (uint64, error) {
+	if o.conn != nil {
+		select {
+		case <- o.connDone:
+			return 0, o.closed()
+		default:
+		}
+	}
+	if err := o.throttled(); err != nil {
+		return 0, err
+	}
+	if o.conn == nil {
+		if err := o.connect(); err != nil {
+			return 0, err
+		}
+	}
+	if !o.pipelined {
+		if err := o.write(batch); err != nil {
+			return 0, err
+		}
+		o.seq++
+		o.lock.Lock()
+		o.acked = o.seq
+		o.lock.Unlock()
+		notify(o.acks)
+		return o.seq, nil
+	}
+	// acknowledgements of the current connection free the window
+	acked := o.Acked()
+	if acked < o.connSeq {
+		acked = o.connSeq
+	}
+	if o.seq - acked >= uint64(o.config.Window) {
+		if err := o.waitAck(o.seq - uint64(o.config.Window) + 1); err != nil {
+			return 0, err
+		}
+	}
+	start := time.Now()
+	body, err := encodeBatch(batch, o.compressor, o.dedup, o.checksum)
+	if err != nil {
+		return 0, err
+	}
+	frame := make([]byte, 8 + len(body))
+	binary.LittleEndian.PutUint64(frame, o.seq + 1)
+	copy(frame[8:], body)
+	if err := writeFrame(o.conn, frame, o.config.Timeout); err != nil {
+		o.disconnect()
+		o.config.Servers.Failed(o.server)
+		return 0, err
+	}
+	o.seq++
+	o.lastSent = time.Now()
+	writeHistogram.Observe(time.Since(start).Seconds())
+	bytesWritten.Add(float64(len(body)))
+	bytesUncompressed.Add(float64(len(batch.Data)))
+	return o.seq, nil
+}
+
+// writePipelined sends a batch and waits for its acknowledgement.
+func (o *TcpOutput) writePipelined(batch *Batch) error {
+	seq, err := o.Send(batch)
+	if err != nil {
+		return err
+	}
+	return o.waitAck(seq)
+}
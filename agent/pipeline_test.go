@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pipelineFrame is a batch received by pipelineServer with the connection it's acknowledged over.
+type pipelineFrame struct {
+	conn net.Conn
+	seq uint64
+	data string
+}
+
+// pipelineServer accepts versioned handshakes with the capabilities and sends received batches to the channel,
+// they are acknowledged by tests. Heartbeats aren't answered.
+func pipelineServer(t *testing.T, capabilities map[string]string) (net.Listener, <-chan pipelineFrame) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	frames := make(chan pipelineFrame, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				<- testHandshakeServer(t, conn, welcome{Version: 1, Status: 200, Capabilities: capabilities})
+				for {
+					frame, err := readFrame(conn, 0)
+					if err != nil {
+						return
+					}
+					if len(frame) >= 8 {
+						frames <- pipelineFrame{conn: conn, seq: binary.LittleEndian.Uint64(frame), data: string(frame[8:])}
+					}
+				}
+			}()
+		}
+	}()
+	return l, frames
+}
+
+func receiveFrame(t *testing.T, frames <-chan pipelineFrame) pipelineFrame {
+	select {
+	case f := <- frames:
+		return f
+	case <- time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for a batch")
+	}
+	return pipelineFrame{}
+}
+
+func ackFrame(t *testing.T, f pipelineFrame, status int32) {
+	require.NoError(t, binary.Write(f.conn, binary.LittleEndian, pipelineAck{Seq: f.seq, Status: status}))
+}
+
+// offsetsInput records saved offsets.
+type offsetsInput struct {
+	*linesInput
+	lock sync.Mutex
+	saved []int64
+}
+
+func (in *offsetsInput) SaveOffset(offset int64) error {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	in.saved = append(in.saved, offset)
+	return nil
+}
+
+func (in *offsetsInput) waitSaved(t *testing.T, saved ...int64) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		in.lock.Lock()
+		done := len(in.saved) >= len(saved)
+		in.lock.Unlock()
+		if done {
+			break
+		}
+	}
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	assert.Equal(t, saved, in.saved)
+}
+
+func TestTcpOutputWindow(t *testing.T) {
+	l, frames := pipelineServer(t, map[string]string{capWindow: "2"})
+	defer l.Close()
+	servers, err := NewServerPool([]string{l.Addr().String()})
+	require.NoError(t, err)
+	out := NewTcpOutput(TcpOutputConfig{VersionedHandshake: true, Servers: servers, Timeout: time.Second, Window: 2}, map[string]string{"docker.name": "a"})
+	defer out.Close()
+
+	seq, err := out.Send(&Batch{Data: []byte("a\n")})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), seq)
+	seq, err = out.Send(&Batch{Data: []byte("b\n")})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), seq)
+	sent := make(chan uint64, 1)
+	go func() {
+		seq, err := out.Send(&Batch{Data: []byte("c\n")})
+		assert.NoError(t, err)
+		sent <- seq
+	}()
+	first, second := receiveFrame(t, frames), receiveFrame(t, frames)
+	assert.Equal(t, pipelineFrame{conn: first.conn, seq: 1, data: "a\n"}, first)
+	assert.Equal(t, pipelineFrame{conn: first.conn, seq: 2, data: "b\n"}, second)
+	select {
+	case <- sent:
+		require.FailNow(t, "the batch is sent while the window is full")
+	case <- time.After(100 * time.Millisecond):
+	}
+
+	// the acknowledgement of the last batch acknowledges the previous ones
+	ackFrame(t, second, 200)
+	select {
+	case seq := <- sent:
+		assert.Equal(t, uint64(3), seq)
+	case <- time.After(5 * time.Second):
+		require.FailNow(t, "the window isn't freed by the acknowledgement")
+	}
+	assert.Equal(t, uint64(2), out.Acked())
+	third := receiveFrame(t, frames)
+	assert.Equal(t, uint64(3), third.seq)
+	ackFrame(t, third, 200)
+	select {
+	case <- out.Acks():
+	case <- time.After(5 * time.Second):
+		require.FailNow(t, "acknowledgements aren't signaled")
+	}
+	for deadline := time.Now().Add(5 * time.Second); out.Acked() < 3 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(3), out.Acked())
+}
+
+func TestCopierPipelineResend(t *testing.T) {
+	l, frames := pipelineServer(t, map[string]string{capWindow: "4", capHeartbeat: "50"})
+	defer l.Close()
+	servers, err := NewServerPool([]string{l.Addr().String()})
+	require.NoError(t, err)
+	out := NewTcpOutput(TcpOutputConfig{
+		VersionedHandshake: true,
+		Servers: servers,
+		Timeout: time.Second,
+		Window: 4,
+		HeartbeatInterval: 50 * time.Millisecond,
+	}, map[string]string{"docker.name": "a"})
+	in := &offsetsInput{linesInput: newLinesInput("a\n", "b\n", "c\n")}
+	copier := NewCopier(in, out, &PassThroughTransformer{}, CopierOptions{
+		Formatter: &RawFormatter{},
+		BufferSize: 1,
+		BufferTimeout: 10 * time.Millisecond,
+	})
+	go copier.Run()
+	defer copier.Wait()
+	defer copier.Close()
+
+	sent := []pipelineFrame{receiveFrame(t, frames), receiveFrame(t, frames), receiveFrame(t, frames)}
+	for i, data := range []string{"a\n", "b\n", "c\n"} {
+		assert.Equal(t, uint64(i + 1), sent[i].seq)
+		assert.Equal(t, data, sent[i].data)
+	}
+	// offsets are saved only for acknowledged batches
+	ackFrame(t, sent[0], 200)
+	in.waitSaved(t, 2)
+
+	// the connection is lost, the heartbeat notices it and unacknowledged batches are sent again in order
+	sent[0].conn.Close()
+	resent := []pipelineFrame{receiveFrame(t, frames), receiveFrame(t, frames)}
+	assert.False(t, resent[0].conn == sent[0].conn)
+	assert.Equal(t, uint64(4), resent[0].seq)
+	assert.Equal(t, "b\n", resent[0].data)
+	assert.Equal(t, uint64(5), resent[1].seq)
+	assert.Equal(t, "c\n", resent[1].data)
+	ackFrame(t, resent[1], 200)
+	in.waitSaved(t, 2, 6)
+}
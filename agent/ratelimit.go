@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	RateLimitDrop = "drop"
+	RateLimitSample = "sample"
+)
+
+// Labels overriding the rate limit of a log, see logLabel.
+const (
+	rateLimitLinesLabel = "oklogging/rate-limit-lines"
+	rateLimitBytesLabel = "oklogging/rate-limit-bytes"
+	rateLimitOverflowLabel = "oklogging/rate-limit-overflow"
+	rateLimitSampleLabel = "oklogging/rate-limit-sample"
+)
+
+type RateLimitConfig struct {
+	// LinesPerSecond and BytesPerSecond are unlimited if zero, a second of the rate can be spent at once
+	LinesPerSecond float64
+	BytesPerSecond float64
+	// Overflow is RateLimitDrop (the default) or RateLimitSample
+	Overflow string
+	// Sample keeps 1 of Sample records over the limit
+	Sample int
+}
+
+func (config RateLimitConfig) Enabled() bool {
+	return config.LinesPerSecond > 0 || config.BytesPerSecond > 0
+}
+
+func (config RateLimitConfig) Validate() error {
+	if config.LinesPerSecond < 0 || config.BytesPerSecond < 0 {
+		return fmt.Errorf("negative rate limit")
+	}
+	switch config.Overflow {
+	case "", RateLimitDrop:
+	case RateLimitSample:
+		if config.Sample < 1 {
+			return fmt.Errorf("rate limit sample should be positive")
+		}
+	default:
+		return fmt.Errorf("unknown rate limit overflow: %s", config.Overflow)
+	}
+	return nil
+}
+
+// Override returns the config changed by log labels, invalid values are ignored.
+func (config RateLimitConfig) Override(labels LogLabels) RateLimitConfig {
+	res := config
+	var err error
+	if v, ok := logLabel(labels, rateLimitLinesLabel); ok {
+		if res.LinesPerSecond, err = strconv.ParseFloat(v, 64); err != nil {
+			log.Println("invalid", rateLimitLinesLabel, "label", err)
+			return config
+		}
+	}
+	if v, ok := logLabel(labels, rateLimitBytesLabel); ok {
+		if res.BytesPerSecond, err = strconv.ParseFloat(v, 64); err != nil {
+			log.Println("invalid", rateLimitBytesLabel, "label", err)
+			return config
+		}
+	}
+	if v, ok := logLabel(labels, rateLimitOverflowLabel); ok {
+		res.Overflow = v
+	}
+	if v, ok := logLabel(labels, rateLimitSampleLabel); ok {
+		if res.Sample, err = strconv.Atoi(v); err != nil {
+			log.Println("invalid", rateLimitSampleLabel, "label", err)
+			return config
+		}
+	}
+	if err := res.Validate(); err != nil {
+		log.Println("invalid rate limit labels", err)
+		return config
+	}
+	return res
+}
+
+// tokenBucket lets a record larger than the bucket through when the bucket is full, so such records
+// aren't blocked forever, the debt is paid off by following refills.
+type tokenBucket struct {
+	rate float64
+	tokens float64
+	last time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b == nil {
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) available(n float64) bool {
+	return b == nil || b.tokens >= math.Min(n, b.rate)
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+type RateLimiter struct {
+	lines *tokenBucket
+	bytes *tokenBucket
+	sample int
+	overLimit int
+	dropped int
+	now func() time.Time
+}
+
+// NewRateLimiter returns nil if the config has no limits.
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	if !config.Enabled() {
+		return nil
+	}
+	l := &RateLimiter{now: time.Now}
+	if config.Overflow == RateLimitSample {
+		l.sample = config.Sample
+	}
+	now := l.now()
+	l.lines = newTokenBucket(config.LinesPerSecond, now)
+	l.bytes = newTokenBucket(config.BytesPerSecond, now)
+	return l
+}
+
+// Allow returns false if the record should be dropped.
+func (l *RateLimiter) Allow(record *Record) bool {
+	now := l.now()
+	l.lines.refill(now)
+	l.bytes.refill(now)
+	size := float64(len(record.Log))
+	if !l.lines.available(1) || !l.bytes.available(size) {
+		l.overLimit++
+		if l.sample == 0 || l.overLimit % l.sample != 0 {
+			l.dropped++
+			rateLimited.Inc()
+			return false
+		}
+	}
+	l.lines.take(1)
+	l.bytes.take(size)
+	return true
+}
+
+// Summary returns a record telling how many records were dropped since the previous summary, in drop mode only.
+func (l *RateLimiter) Summary() (*Record, bool) {
+	if l.sample > 0 || l.dropped == 0 {
+		return nil, false
+	}
+	summary := &Record{
+		Time: l.now().UTC().Format(time.RFC3339Nano),
+		Stream: "stderr",
+		Log: fmt.Sprintf("%d lines dropped by oklogging rate limit\n", l.dropped),
+	}
+	l.dropped = 0
+	return summary, true
+}
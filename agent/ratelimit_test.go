@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRateLimiter(config RateLimitConfig, now *time.Time) *RateLimiter {
+	l := NewRateLimiter(config)
+	l.now = func() time.Time { return *now }
+	l.lines, l.bytes = newTokenBucket(config.LinesPerSecond, *now), newTokenBucket(config.BytesPerSecond, *now)
+	return l
+}
+
+func TestRateLimiterDrop(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newTestRateLimiter(RateLimitConfig{LinesPerSecond: 2}, &now)
+	record := &Record{Log: "a\n"}
+
+	assert.True(t, l.Allow(record))
+	assert.True(t, l.Allow(record))
+	assert.False(t, l.Allow(record))
+	assert.False(t, l.Allow(record))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, l.Allow(record))
+	assert.False(t, l.Allow(record))
+	summary, ok := l.Summary()
+	require.True(t, ok)
+	assert.Equal(t, &Record{Time: "2018-01-01T00:00:00.5Z", Stream: "stderr", Log: "3 lines dropped by oklogging rate limit\n"}, summary)
+	_, ok = l.Summary()
+	assert.False(t, ok)
+}
+
+func TestRateLimiterBytesSample(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newTestRateLimiter(RateLimitConfig{BytesPerSecond: 10, Overflow: RateLimitSample, Sample: 3}, &now)
+
+	// a record larger than the bucket passes, but nothing else passes until the debt is paid
+	assert.True(t, l.Allow(&Record{Log: "0123456789012345678\n"}))
+	var allowed int
+	for i := 0; i < 9; i++ {
+		if l.Allow(&Record{Log: "a\n"}) {
+			allowed++
+		}
+	}
+	assert.Equal(t, 3, allowed)
+	_, ok := l.Summary()
+	assert.False(t, ok)
+}
+
+func TestRateLimitOverride(t *testing.T) {
+	config := RateLimitConfig{LinesPerSecond: 100}
+	assert.Equal(t, config, config.Override(LogLabels{"namespace": "default"}))
+	assert.Equal(t, RateLimitConfig{LinesPerSecond: 10, Overflow: RateLimitSample, Sample: 5}, config.Override(LogLabels{
+		"annotation.oklogging/rate-limit-lines": "10",
+		"label.oklogging/rate-limit-overflow": "sample",
+		"label.oklogging/rate-limit-sample": "5",
+	}))
+	assert.Equal(t, RateLimitConfig{}, config.Override(LogLabels{"annotation.oklogging/rate-limit-lines": "0"}))
+	assert.Equal(t, config, config.Override(LogLabels{"annotation.oklogging/rate-limit-lines": "fast"}))
+	assert.Equal(t, config, config.Override(LogLabels{"annotation.oklogging/rate-limit-overflow": "sample"}))
+	assert.Nil(t, NewRateLimiter(RateLimitConfig{}))
+}
@@ -0,0 +1,176 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	RedactMask = "mask"
+	RedactHash = "hash"
+
+	redactMask = "[redacted]"
+)
+
+var (
+	redactionsCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:    "oklogging_agent_redactions",
+		Help:    "Redacted matches by rule",
+	}, []string{"rule"})
+)
+
+func init() {
+	prometheus.MustRegister(redactionsCount)
+}
+
+// RedactRule replaces the first capture group of Pattern, or the whole match if there are no groups.
+type RedactRule struct {
+	Name string
+	Pattern *regexp.Regexp
+	// validate filters out false positives, e.g. card numbers failing the Luhn check
+	validate func(string) bool
+}
+
+var builtinRedactRules = map[string]RedactRule{
+	"card": {
+		Name: "card",
+		Pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+		validate: luhnValid,
+	},
+	"jwt": {
+		Name: "jwt",
+		Pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	},
+	"authorization": {
+		Name: "authorization",
+		Pattern: regexp.MustCompile(`(?i)\bauthorization["']?\s*[:=]\s*["']?(?:[a-z]+\s+)?([^\s"',;]+)`),
+	},
+	"url_credentials": {
+		Name: "url_credentials",
+		Pattern: regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.-]*://[^\s/:@]+:([^\s/@]+)@`),
+	},
+	"email": {
+		Name: "email",
+		Pattern: regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`),
+	},
+}
+
+// BuiltinRedactRules are applied in this order, before custom rules.
+var BuiltinRedactRules = []string{"card", "jwt", "authorization", "url_credentials", "email"}
+
+func luhnValid(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if n % 2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum % 10 == 0
+}
+
+type RedactConfig struct {
+	// Rules are names of builtin rules, see BuiltinRedactRules
+	Rules []string
+	Custom []RedactRule
+	// Mode is RedactMask or RedactHash, the hash is sha256 of Salt and the match,
+	// so equal values can be correlated without being revealed
+	Mode string
+	Salt string
+}
+
+type RedactTransformer struct {
+	rules []RedactRule
+	hash bool
+	salt string
+}
+
+func NewRedactTransformer(config RedactConfig) (*RedactTransformer, error) {
+	t := &RedactTransformer{salt: config.Salt}
+	switch config.Mode {
+	case "", RedactMask:
+	case RedactHash:
+		t.hash = true
+	default:
+		return nil, fmt.Errorf("unknown redact mode: %s", config.Mode)
+	}
+	names := map[string]bool{}
+	for _, name := range BuiltinRedactRules {
+		for _, r := range config.Rules {
+			if r == name {
+				t.rules = append(t.rules, builtinRedactRules[name])
+				names[name] = true
+			}
+		}
+	}
+	for _, r := range config.Rules {
+		if _, ok := builtinRedactRules[r]; !ok {
+			return nil, fmt.Errorf("unknown redact rule: %s", r)
+		}
+	}
+	for _, r := range config.Custom {
+		if r.Name == "" || r.Pattern == nil {
+			return nil, fmt.Errorf("redact rule should have a name and a pattern")
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate redact rule: %s", r.Name)
+		}
+		names[r.Name] = true
+		t.rules = append(t.rules, r)
+	}
+	return t, nil
+}
+
+func (t *RedactTransformer) replacement(value string) string {
+	if !t.hash {
+		return redactMask
+	}
+	sum := sha256.Sum256([]byte(t.salt + value))
+	return "[sha256:" + hex.EncodeToString(sum[:8]) + "]"
+}
+
+func (t *RedactTransformer) redact(rule RedactRule, s string) string {
+	matches := rule.Pattern.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+	var res strings.Builder
+	last, replaced := 0, false
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) > 2 {
+			start, end = m[2], m[3]
+		}
+		if start < 0 || (rule.validate != nil && !rule.validate(s[start:end])) {
+			continue
+		}
+		res.WriteString(s[last:start])
+		res.WriteString(t.replacement(s[start:end]))
+		last, replaced = end, true
+		redactionsCount.WithLabelValues(rule.Name).Inc()
+	}
+	if !replaced {
+		return s
+	}
+	res.WriteString(s[last:])
+	return res.String()
+}
+
+func (t *RedactTransformer) Do(record *Record) error {
+	for _, rule := range t.rules {
+		record.Log = t.redact(rule, record.Log)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"log"
+)
+
+const (
+	dockerLogSuffix = "-json.log"
+)
+
+// logFile is a file found by the glob, rotated files share logPath with the active one.
+type logFile struct {
+	path string
+	logPath string
+	fileId string
+	size int64
+	// rotation is 0 for the active file and N for <log>.N
+	rotation int
+}
+
+// parseDockerRotation returns the active log path and the rotation number of json-file logs: <id>-json.log.N
+func parseDockerRotation(p string) (string, int, bool) {
+	i := strings.LastIndex(p, dockerLogSuffix)
+	if i < 0 {
+		return "", 0, false
+	}
+	logPath, suffix := p[:i + len(dockerLogSuffix)], p[i + len(dockerLogSuffix):]
+	if suffix == "" {
+		return logPath, 0, true
+	}
+	if !strings.HasPrefix(suffix, ".") {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(suffix[1:])
+	if err != nil || n <= 0 {
+		// compressed rotated logs aren't read
+		return "", 0, false
+	}
+	return logPath, n, true
+}
+
+func notRotated(p string) (string, int, bool) {
+	return p, 0, true
+}
+
+// listLogs returns files of every log from the oldest to the active one.
+func listLogs(patterns []string, parseRotation func(string) (string, int, bool)) (map[string][]logFile, error) {
+	logs := map[string][]logFile{}
+	for _, pattern := range patterns {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			logPath, rotation, ok := parseRotation(f)
+			if !ok {
+				continue
+			}
+			fi, err := os.Stat(f)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					log.Println(err)
+				}
+				continue
+			}
+			fileId, err := FileId(fi)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			logs[logPath] = append(logs[logPath], logFile{
+				path: f,
+				logPath: logPath,
+				fileId: fileId,
+				size: fi.Size(),
+				rotation: rotation,
+			})
+		}
+	}
+	for _, files := range logs {
+		sort.Slice(files, func(i, j int) bool { return files[i].rotation > files[j].rotation })
+	}
+	return logs, nil
+}
+
+// chooseFile returns the index of the file to read: the oldest file not read to its end, starting from
+// the oldest file with a saved offset. Files rotated before the log was ever read are skipped.
+func chooseFile(files []logFile, offsetStorage *OffsetStorage) int {
+	last := len(files) - 1
+	first := last
+	for i, f := range files {
+		if _, err := offsetStorage.Get(f.fileId); err == nil {
+			first = i
+			break
+		}
+	}
+	for i := first; i < last; i++ {
+		offset, err := offsetStorage.Get(files[i].fileId)
+		if err != nil || offset < files[i].size {
+			return i
+		}
+	}
+	return last
+}
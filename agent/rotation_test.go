@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"testing"
+	"io/ioutil"
+	"os"
+	"path"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDockerRotation(t *testing.T) {
+	logPath, n, ok := parseDockerRotation("/c/abc/abc-json.log")
+	assert.True(t, ok)
+	assert.Equal(t, "/c/abc/abc-json.log", logPath)
+	assert.Equal(t, 0, n)
+
+	logPath, n, ok = parseDockerRotation("/c/abc/abc-json.log.2")
+	assert.True(t, ok)
+	assert.Equal(t, "/c/abc/abc-json.log", logPath)
+	assert.Equal(t, 2, n)
+
+	_, _, ok = parseDockerRotation("/c/abc/abc-json.log.1.gz")
+	assert.False(t, ok)
+	_, _, ok = parseDockerRotation("/c/abc/config.v2.json")
+	assert.False(t, ok)
+}
+
+func TestChooseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotation")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.MkdirAll(path.Join(dir, "abc"), 0755))
+	logPath := path.Join(dir, "abc", "abc-json.log")
+	require.NoError(t, ioutil.WriteFile(logPath + ".2", []byte("a\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(logPath + ".1", []byte("b\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(logPath, []byte("c\n"), 0644))
+
+	offsetStorage, err := NewOffsetStorage(path.Join(dir, "offsets"))
+	require.NoError(t, err)
+
+	logs, err := listLogs([]string{path.Join(dir, "*/*-json.log"), path.Join(dir, "*/*-json.log.*")}, parseDockerRotation)
+	require.NoError(t, err)
+	files := logs[logPath]
+	require.Len(t, files, 3)
+	assert.Equal(t, logPath + ".2", files[0].path)
+	assert.Equal(t, logPath, files[2].path)
+
+	// never read: rotated files are skipped
+	assert.Equal(t, 2, chooseFile(files, offsetStorage))
+
+	// .2 was read partially
+	require.NoError(t, offsetStorage.Save(files[0].fileId, 1))
+	assert.Equal(t, 0, chooseFile(files, offsetStorage))
+
+	// .2 was read to its end, .1 wasn't read yet
+	require.NoError(t, offsetStorage.Save(files[0].fileId, 2))
+	assert.Equal(t, 1, chooseFile(files, offsetStorage))
+
+	require.NoError(t, offsetStorage.Save(files[1].fileId, 2))
+	assert.Equal(t, 2, chooseFile(files, offsetStorage))
+}
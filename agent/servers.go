@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	srvPrefix = "srv:"
+	serversResolveInterval = 30 * time.Second
+)
+
+type serverState struct {
+	backoff Backoff
+	downUntil time.Time
+}
+
+// ServerPool is a list of servers shared by outputs. Entries are "host:port", where a host resolving
+// to several addresses gives a server per address, or "srv:<name>" for DNS SRV records.
+// Every log is assigned to servers by rendezvous hashing, so it stays on one server while it's healthy
+// and only logs of a failed server are moved.
+type ServerPool struct {
+	entries []string
+	lock sync.Mutex
+	addrs []string
+	// hosts are names of addresses resolved from A records, to verify server certificates against
+	hosts map[string]string
+	resolved time.Time
+	states map[string]*serverState
+	now func() time.Time
+	resolve func(entry string) ([]string, error)
+}
+
+func splitHost(addr string) string {
+	host, _, _ := net.SplitHostPort(addr)
+	return host
+}
+
+func validateServer(entry string) error {
+	if strings.HasPrefix(entry, srvPrefix) {
+		if strings.TrimPrefix(entry, srvPrefix) == "" {
+			return fmt.Errorf("empty srv name")
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return fmt.Errorf("invalid server port: %s", entry)
+	}
+	return nil
+}
+
+func NewServerPool(entries []string) (*ServerPool, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("empty server")
+	}
+	for _, e := range entries {
+		if err := validateServer(e); err != nil {
+			return nil, err
+		}
+	}
+	return &ServerPool{
+		entries: entries,
+		states: map[string]*serverState{},
+		now: time.Now,
+		resolve: resolveServer,
+	}, nil
+}
+
+func resolveServer(entry string) ([]string, error) {
+	if strings.HasPrefix(entry, srvPrefix) {
+		_, records, err := net.LookupSRV("", "", strings.TrimPrefix(entry, srvPrefix))
+		if err != nil {
+			return nil, err
+		}
+		var addrs []string
+		for _, r := range records {
+			addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+		}
+		return addrs, nil
+	}
+	host, port, _ := net.SplitHostPort(entry)
+	if net.ParseIP(host) != nil {
+		return []string{entry}, nil
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return addrs, nil
+}
+
+func (p *ServerPool) String() string {
+	return strings.Join(p.entries, ",")
+}
+
+// refresh resolves entries, the previous addresses are kept if nothing is resolved.
+func (p *ServerPool) refresh() {
+	now := p.now()
+	if p.addrs != nil && now.Sub(p.resolved) < serversResolveInterval {
+		return
+	}
+	p.resolved = now
+	hosts := map[string]string{}
+	var addrs []string
+	for _, e := range p.entries {
+		resolved, err := p.resolve(e)
+		if err != nil {
+			log.Println("failed to resolve server", e, err)
+			continue
+		}
+		for _, a := range resolved {
+			if _, ok := hosts[a]; ok {
+				continue
+			}
+			hosts[a] = splitHost(a)
+			if !strings.HasPrefix(e, srvPrefix) {
+				hosts[a] = splitHost(e)
+			}
+			addrs = append(addrs, a)
+		}
+	}
+	if len(addrs) == 0 {
+		return
+	}
+	p.addrs, p.hosts = addrs, hosts
+}
+
+// Host returns the name the server was resolved from.
+func (p *ServerPool) Host(addr string) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if host, ok := p.hosts[addr]; ok {
+		return host
+	}
+	return splitHost(addr)
+}
+
+func rendezvousScore(key, addr string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(addr))
+	return h.Sum64()
+}
+
+// Pick returns the healthy server with the highest score for the key, or the one which recovers first
+// if all of them are down.
+func (p *ServerPool) Pick(key string) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.refresh()
+	if len(p.addrs) == 0 {
+		return "", fmt.Errorf("no servers resolved for %s", p)
+	}
+	addrs := append([]string(nil), p.addrs...)
+	sort.Slice(addrs, func(i, j int) bool { return rendezvousScore(key, addrs[i]) > rendezvousScore(key, addrs[j]) })
+	now := p.now()
+	best := addrs[0]
+	for _, a := range addrs {
+		s, ok := p.states[a]
+		if !ok || !now.Before(s.downUntil) {
+			return a, nil
+		}
+		if s.downUntil.Before(p.states[best].downUntil) {
+			best = a
+		}
+	}
+	return best, nil
+}
+
+// Failed marks the server down with exponential backoff.
+func (p *ServerPool) Failed(addr string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s, ok := p.states[addr]
+	if !ok {
+		s = &serverState{backoff: Backoff{Min: defaultBackoffMin, Max: defaultBackoffMax}}
+		p.states[addr] = s
+	}
+	s.downUntil = p.now().Add(s.backoff.Next())
+}
+
+func (p *ServerPool) Ok(addr string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.states, addr)
+}
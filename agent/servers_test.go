@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testServerPool(t *testing.T, addrs ...string) (*ServerPool, *time.Time) {
+	pool, err := NewServerPool(addrs)
+	require.NoError(t, err)
+	now := time.Unix(1000, 0)
+	pool.now = func() time.Time { return now }
+	pool.resolve = func(entry string) ([]string, error) { return []string{entry}, nil }
+	return pool, &now
+}
+
+func TestServerPoolValidate(t *testing.T) {
+	_, err := NewServerPool(nil)
+	assert.Error(t, err)
+	_, err = NewServerPool([]string{"logs"})
+	assert.Error(t, err)
+	_, err = NewServerPool([]string{"srv:"})
+	assert.Error(t, err)
+	_, err = NewServerPool([]string{"logs:1234", "10.0.0.1:6600", "srv:_oklogging._tcp.logs"})
+	assert.NoError(t, err)
+}
+
+func TestServerPoolConsistent(t *testing.T) {
+	pool, _ := testServerPool(t, "a:1", "b:1", "c:1")
+	assigned := map[string]string{}
+	used := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("container", i)
+		server, err := pool.Pick(key)
+		require.NoError(t, err)
+		assigned[key] = server
+		used[server] = true
+	}
+	assert.Len(t, used, 3)
+
+	// removing a server moves only its logs
+	other, _ := testServerPool(t, "a:1", "c:1")
+	for key, server := range assigned {
+		s, err := other.Pick(key)
+		require.NoError(t, err)
+		if server != "b:1" {
+			assert.Equal(t, server, s)
+		}
+	}
+}
+
+func TestServerPoolFailover(t *testing.T) {
+	pool, now := testServerPool(t, "a:1", "b:1")
+	first, err := pool.Pick("c1")
+	require.NoError(t, err)
+	pool.Failed(first)
+	second, err := pool.Pick("c1")
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second)
+
+	// all servers are down, the one recovering first is tried
+	pool.Failed(second)
+	pool.Failed(second)
+	s, _ := pool.Pick("c1")
+	assert.Equal(t, first, s)
+
+	*now = now.Add(defaultBackoffMax)
+	s, _ = pool.Pick("c1")
+	assert.Equal(t, first, s)
+	pool.Ok(first)
+	pool.Failed(first)
+	s, _ = pool.Pick("c1")
+	assert.Equal(t, second, s)
+}
+
+func TestServerPoolHost(t *testing.T) {
+	pool, _ := testServerPool(t, "logs:6600", "srv:_oklogging._tcp.logs")
+	pool.resolve = func(entry string) ([]string, error) {
+		if entry == "logs:6600" {
+			return []string{"10.0.0.1:6600", "10.0.0.2:6600"}, nil
+		}
+		return []string{"logs-0.logs:6600"}, nil
+	}
+	_, err := pool.Pick("c1")
+	require.NoError(t, err)
+	assert.Equal(t, "logs", pool.Host("10.0.0.2:6600"))
+	assert.Equal(t, "logs-0.logs", pool.Host("logs-0.logs:6600"))
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: 10 * time.Second}
+	for _, max := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		d := b.Next()
+		assert.True(t, d >= max * time.Second / 2 && d <= max * time.Second, d)
+	}
+	b.Reset()
+	assert.True(t, b.Next() <= time.Second)
+}
@@ -0,0 +1,221 @@
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	spoolTmpSuffix = ".tmp"
+	// spoolOffsetsSuffix marks batches with the stream identity and input offsets before the data, see encodeSpoolHeader
+	spoolOffsetsSuffix = ".batch"
+)
+
+var (
+	ErrSpoolFull = errors.New("spool is full")
+)
+
+// Spool keeps batches that couldn't be written to the output on disk, one file per batch.
+type Spool struct {
+	dir string
+	maxSize int64
+	size int64
+	seqs []uint64
+	// withOffsets are seqs of batches stored with input offsets
+	withOffsets map[uint64]bool
+	nextSeq uint64
+}
+
+func NewSpool(dir string, maxSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool dir: %s", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, maxSize: maxSize, withOffsets: map[uint64]bool{}}
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), spoolTmpSuffix) {
+			os.Remove(path.Join(dir, fi.Name()))
+			continue
+		}
+		name := strings.TrimSuffix(fi.Name(), spoolOffsetsSuffix)
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			log.Println("unexpected file in spool", path.Join(dir, fi.Name()))
+			continue
+		}
+		if name != fi.Name() {
+			s.withOffsets[seq] = true
+		}
+		s.seqs = append(s.seqs, seq)
+		s.size += fi.Size()
+	}
+	sort.Slice(s.seqs, func(i, j int) bool { return s.seqs[i] < s.seqs[j] })
+	if len(s.seqs) > 0 {
+		s.nextSeq = s.seqs[len(s.seqs) - 1] + 1
+		log.Println("found", len(s.seqs), "spooled batches in", dir)
+	}
+	spoolBatches.Add(float64(len(s.seqs)))
+	spoolBytes.Add(float64(s.size))
+	return s, nil
+}
+
+func (s *Spool) batchPath(seq uint64) string {
+	p := path.Join(s.dir, fmt.Sprintf("%020d", seq))
+	if s.withOffsets[seq] {
+		p += spoolOffsetsSuffix
+	}
+	return p
+}
+
+func (s *Spool) Empty() bool {
+	return len(s.seqs) == 0
+}
+
+// Push persists the batch, it's synced to disk before Push returns.
+func (s *Spool) Push(data []byte) error {
+	return s.PushBatch(&Batch{Data: data})
+}
+
+// PushBatch persists the batch with its input offsets if they are known.
+func (s *Spool) PushBatch(batch *Batch) error {
+	data := batch.Data
+	if batch.End > 0 {
+		data = append(encodeSpoolHeader(batch), batch.Data...)
+	}
+	if s.size + int64(len(data)) > s.maxSize {
+		return ErrSpoolFull
+	}
+	if batch.End > 0 {
+		s.withOffsets[s.nextSeq] = true
+	}
+	p := s.batchPath(s.nextSeq)
+	f, err := os.OpenFile(p + spoolTmpSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(p + spoolTmpSuffix, p)
+	}
+	if err != nil {
+		os.Remove(p + spoolTmpSuffix)
+		delete(s.withOffsets, s.nextSeq)
+		return err
+	}
+	s.seqs = append(s.seqs, s.nextSeq)
+	s.nextSeq++
+	s.size += int64(len(data))
+	spoolBatches.Inc()
+	spoolBytes.Add(float64(len(data)))
+	return nil
+}
+
+// Peek returns data of the oldest batch.
+func (s *Spool) Peek() ([]byte, error) {
+	batch, err := s.PeekBatch()
+	if err != nil {
+		return nil, err
+	}
+	return batch.Data, nil
+}
+
+// PeekBatch returns the oldest batch, its offsets are zero if it was spooled without them.
+func (s *Spool) PeekBatch() (*Batch, error) {
+	if s.Empty() {
+		return nil, fmt.Errorf("spool is empty")
+	}
+	data, err := ioutil.ReadFile(s.batchPath(s.seqs[0]))
+	if err != nil {
+		return nil, err
+	}
+	batch := &Batch{Data: data}
+	if s.withOffsets[s.seqs[0]] {
+		if batch.Data, err = decodeSpoolHeader(batch, data); err != nil {
+			return nil, fmt.Errorf("invalid spooled batch %s: %s", s.batchPath(s.seqs[0]), err)
+		}
+	}
+	return batch, nil
+}
+
+// encodeSpoolHeader returns the stream identity and input offsets of the batch, offsets are valid only
+// for the same stream.
+func encodeSpoolHeader(batch *Batch) []byte {
+	header := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(header, uint64(len(batch.Stream)))
+	return append(append(header[:n], batch.Stream...), batch.encodeOffsets()...)
+}
+
+// decodeSpoolHeader sets the stream and offsets of the batch and returns the rest of data.
+func decodeSpoolHeader(batch *Batch, data []byte) ([]byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > uint64(len(data) - n) {
+		return nil, fmt.Errorf("invalid stream identity")
+	}
+	batch.Stream = string(data[n:n + int(size)])
+	return batch.decodeOffsets(data[n + int(size):])
+}
+
+// Pop removes the oldest batch.
+func (s *Spool) Pop() error {
+	if s.Empty() {
+		return fmt.Errorf("spool is empty")
+	}
+	p := s.batchPath(s.seqs[0])
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	delete(s.withOffsets, s.seqs[0])
+	s.seqs = s.seqs[1:]
+	s.size -= fi.Size()
+	spoolBatches.Dec()
+	spoolBytes.Sub(float64(fi.Size()))
+	return nil
+}
+
+// Close releases the spool, spooled batches stay on disk until the next NewSpool on the same dir.
+func (s *Spool) Close() {
+	spoolBatches.Sub(float64(len(s.seqs)))
+	spoolBytes.Sub(float64(s.size))
+}
+
+// GCSpools removes spools of logs that don't exist anymore.
+func GCSpools(baseDir string, freshFiles []string) {
+	freshKeys := make(map[string]struct{}, len(freshFiles))
+	for _, f := range freshFiles {
+		freshKeys[pathKey(f)] = struct{}{}
+	}
+	dirs, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		return
+	}
+	for _, fi := range dirs {
+		if _, ok := freshKeys[fi.Name()]; !ok {
+			log.Println("removing spool", fi.Name())
+			os.RemoveAll(path.Join(baseDir, fi.Name()))
+		}
+	}
+}
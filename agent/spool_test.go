@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"testing"
+	"io/ioutil"
+	"os"
+	"path"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpool(t *testing.T) {
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	spoolDir := path.Join(tmpDir, "_var_log_1.log")
+	spool, err := NewSpool(spoolDir, 10)
+	require.NoError(t, err)
+	assert.True(t, spool.Empty())
+
+	require.NoError(t, spool.Push([]byte("batch1\n")))
+	require.NoError(t, spool.Push([]byte("b2\n")))
+	assert.Equal(t, ErrSpoolFull, spool.Push([]byte("b3\n")))
+	spool.Close()
+
+	spool, err = NewSpool(spoolDir, 10)
+	require.NoError(t, err)
+	data, err := spool.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, "batch1\n", string(data))
+	require.NoError(t, spool.Pop())
+
+	require.NoError(t, spool.Push([]byte("b3\n")))
+	data, err = spool.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, "b2\n", string(data))
+	require.NoError(t, spool.Pop())
+	data, err = spool.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, "b3\n", string(data))
+	require.NoError(t, spool.Pop())
+	assert.True(t, spool.Empty())
+
+	GCSpools(tmpDir, []string{"/var/log/1.log"})
+	_, err = os.Stat(spoolDir)
+	assert.NoError(t, err)
+	GCSpools(tmpDir, []string{})
+	_, err = os.Stat(spoolDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSpoolBatchOffsets(t *testing.T) {
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	spool, err := NewSpool(tmpDir, 100)
+	require.NoError(t, err)
+	require.NoError(t, spool.Push([]byte("a\n")))
+	batch := &Batch{Data: []byte("b\nc\n"), End: 10, Marks: []BatchMark{{Offset: 6, Pos: 2}, {Offset: 8, Pos: 4}}, Stream: "abc/1_2/f00d"}
+	require.NoError(t, spool.PushBatch(batch))
+	spool.Close()
+
+	spool, err = NewSpool(tmpDir, 100)
+	require.NoError(t, err)
+	spooled, err := spool.PeekBatch()
+	require.NoError(t, err)
+	assert.Equal(t, &Batch{Data: []byte("a\n")}, spooled)
+	require.NoError(t, spool.Pop())
+	spooled, err = spool.PeekBatch()
+	require.NoError(t, err)
+	assert.Equal(t, batch, spooled)
+	require.NoError(t, spool.Pop())
+	assert.True(t, spool.Empty())
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+var (
+	// reservedFields are set by the json formatter, application fields with these names get "_" prefix
+	reservedFields = []string{"time", "stream", "labels"}
+)
+
+type StructuredConfig struct {
+	// Rename maps application fields to new names, nested fields are promoted to the top level
+	// with dotted names, e.g. "log.level": "level"
+	Rename map[string]string
+	// Labels adds log labels to every record
+	Labels bool
+}
+
+// StructuredTransformer parses json application logs into Record.Fields, other lines are kept as text.
+// Fields set by a parser are renamed the same way.
+type StructuredTransformer struct {
+	rename map[string]string
+	labels LogLabels
+}
+
+func NewStructuredTransformer(config StructuredConfig, labels LogLabels) *StructuredTransformer {
+	t := &StructuredTransformer{rename: config.Rename}
+	if config.Labels {
+		t.labels = labels
+	}
+	return t
+}
+
+func parseJsonObject(s string) (map[string]interface{}, bool) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, false
+	}
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.UseNumber()
+	fields := map[string]interface{}{}
+	if err := decoder.Decode(&fields); err != nil || decoder.More() {
+		return nil, false
+	}
+	return fields, true
+}
+
+// popField removes the field by a dotted path.
+func popField(fields map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := fields[path]; ok {
+		delete(fields, path)
+		return v, true
+	}
+	parts := strings.SplitN(path, ".", 2)
+	if len(parts) < 2 {
+		return nil, false
+	}
+	nested, ok := fields[parts[0]].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return popField(nested, parts[1])
+}
+
+// normalizeFields renames fields and adds "_" prefix to reserved ones.
+func normalizeFields(fields map[string]interface{}, rename map[string]string) map[string]interface{} {
+	renamed := map[string]interface{}{}
+	for from, to := range rename {
+		if v, ok := popField(fields, from); ok {
+			renamed[to] = v
+		}
+	}
+	for k, v := range renamed {
+		fields[k] = v
+	}
+	for _, k := range reservedFields {
+		if v, ok := fields[k]; ok {
+			delete(fields, k)
+			fields["_" + k] = v
+		}
+	}
+	return fields
+}
+
+func (t *StructuredTransformer) Do(record *Record) error {
+	record.Labels = t.labels
+	if record.Fields == nil {
+		fields, ok := parseJsonObject(record.Log)
+		if !ok {
+			return nil
+		}
+		record.Fields = fields
+	}
+	record.Fields = normalizeFields(record.Fields, t.rename)
+	return nil
+}
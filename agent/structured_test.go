@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"testing"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func formatStructured(t *testing.T, tr Transformer, record *Record) string {
+	require.NoError(t, tr.Do(record))
+	buf := &bytes.Buffer{}
+	require.NoError(t, (&JsonFormatter{}).Format(buf, record))
+	return buf.String()
+}
+
+func TestStructuredTransformer(t *testing.T) {
+	tr := NewStructuredTransformer(StructuredConfig{
+		Rename: map[string]string{"msg": "message", "log.level": "level"},
+	}, LogLabels{"namespace": "default"})
+
+	assert.Equal(t,
+		`{"_time":"12:00","level":"info","log":{"logger":"main"},"message":"started","port":8080,"stream":"stdout","time":"t"}` + "\n",
+		formatStructured(t, tr, &Record{
+			Time: "t",
+			Stream: "stdout",
+			Log: `{"msg":"started","time":"12:00","log":{"level":"info","logger":"main"},"port":8080}` + "\n",
+		}))
+
+	assert.Equal(t,
+		`{"time":"t","stream":"stderr","log":"plain {text}"}` + "\n",
+		formatStructured(t, tr, &Record{Time: "t", Stream: "stderr", Log: "plain {text}\n"}))
+
+	assert.Equal(t,
+		`{"time":"t","stream":"stdout","log":"{\"broken\":"}` + "\n",
+		formatStructured(t, tr, &Record{Time: "t", Stream: "stdout", Log: "{\"broken\":\n"}))
+}
+
+func TestStructuredTransformerLabels(t *testing.T) {
+	tr := NewStructuredTransformer(StructuredConfig{Labels: true}, LogLabels{"namespace": "default"})
+
+	assert.Equal(t,
+		`{"labels":{"namespace":"default"},"level":"warn","stream":"stdout","time":"t"}` + "\n",
+		formatStructured(t, tr, &Record{Time: "t", Stream: "stdout", Log: `{"level":"warn"}` + "\n"}))
+	assert.Equal(t,
+		`{"labels":{"namespace":"default"},"log":"text","stream":"stdout","time":"t"}` + "\n",
+		formatStructured(t, tr, &Record{Time: "t", Stream: "stdout", Log: "text\n"}))
+}
@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	tailPollInterval = 250 * time.Millisecond
+	// tailMaxLineSize splits longer lines, so input without newlines doesn't take all memory
+	tailMaxLineSize = 1024 * 1024
+)
+
+var (
+	errTailClosed = errors.New("tail closed")
+	// errTailTruncated is returned once when the file gets shorter than the read position, it's read from the start then
+	errTailTruncated = errors.New("file truncated")
+)
+
+// FileId identifies a file by device and inode, so it's kept after the file is renamed by rotation.
+func FileId(fi os.FileInfo) (string, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("can't get inode of %s", fi.Name())
+	}
+	return fmt.Sprintf("%d_%d", st.Dev, st.Ino), nil
+}
+
+func GetFileId(filePath string) (string, error) {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	return FileId(fi)
+}
+
+// fileTail reads lines from the opened file and waits for new ones at its end.
+// It never reopens the file by name, so a rotated file is read up to its end.
+type fileTail struct {
+	file *os.File
+	reader *bufio.Reader
+	partial strings.Builder
+	offset int64
+	closed chan struct{}
+}
+
+func newFileTail(file *os.File, offset int64) (*fileTail, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &fileTail{
+		file: file,
+		reader: bufio.NewReader(file),
+		offset: offset,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// ReadLine returns the next line without the trailing newline, it blocks until the line is complete.
+// Lines longer than tailMaxLineSize are returned in parts.
+func (t *fileTail) ReadLine() (string, error) {
+	for {
+		chunk, err := t.reader.ReadSlice('\n')
+		t.partial.Write(chunk)
+		if err == nil {
+			line := t.partial.String()
+			t.partial.Reset()
+			t.offset += int64(len(line))
+			return line[:len(line) - 1], nil
+		}
+		if t.partial.Len() >= tailMaxLineSize {
+			line := t.partial.String()
+			t.partial.Reset()
+			t.offset += int64(len(line))
+			return line, nil
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != io.EOF {
+			return "", err
+		}
+		if truncated, err := t.truncated(); err != nil {
+			return "", err
+		} else if truncated {
+			if err := t.reset(); err != nil {
+				return "", err
+			}
+			return "", errTailTruncated
+		}
+		select {
+		case <- t.closed:
+			return "", errTailClosed
+		case <- time.After(tailPollInterval):
+		}
+	}
+}
+
+// truncated returns true if the file is shorter than the read position.
+func (t *fileTail) truncated() (bool, error) {
+	stat, err := t.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	return stat.Size() < t.offset + int64(t.partial.Len()), nil
+}
+
+// reset reads the file from the start.
+func (t *fileTail) reset() error {
+	if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	t.reader.Reset(t.file)
+	t.partial.Reset()
+	t.offset = 0
+	return nil
+}
+
+// Offset is the position right after the last returned line.
+func (t *fileTail) Offset() int64 {
+	return t.offset
+}
+
+func (t *fileTail) Close() {
+	select {
+	case <- t.closed:
+		return
+	default:
+		close(t.closed)
+	}
+	t.file.Close()
+}
@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	tlsReloadInterval = 10 * time.Second
+)
+
+type TlsConfig struct {
+	// CaFile is the server CA bundle, system roots are used if it's empty
+	CaFile string `yaml:"ca_file" json:"ca_file"`
+	// CertFile and KeyFile are the client certificate for servers verifying agents
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile string `yaml:"key_file" json:"key_file"`
+	// ServerName overrides the name the server certificate is checked against
+	ServerName string `yaml:"server_name" json:"server_name"`
+}
+
+// TlsReloader keeps certificates loaded from TlsConfig files and reloads them when the files change.
+type TlsReloader struct {
+	config TlsConfig
+	lock sync.RWMutex
+	cert *tls.Certificate
+	roots *x509.CertPool
+	modTimes map[string]time.Time
+	closed chan struct{}
+}
+
+func NewTlsReloader(config TlsConfig) (*TlsReloader, error) {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("both tls cert and key files should be set")
+	}
+	r := &TlsReloader{config: config, closed: make(chan struct{})}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *TlsReloader) files() []string {
+	var files []string
+	for _, f := range []string{r.config.CaFile, r.config.CertFile, r.config.KeyFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (r *TlsReloader) readModTimes() (map[string]time.Time, error) {
+	modTimes := map[string]time.Time{}
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[f] = fi.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (r *TlsReloader) load() error {
+	modTimes, err := r.readModTimes()
+	if err != nil {
+		return err
+	}
+	var cert *tls.Certificate
+	if r.config.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+	var roots *x509.CertPool
+	if r.config.CaFile != "" {
+		ca, err := ioutil.ReadFile(r.config.CaFile)
+		if err != nil {
+			return err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("no certificates found in %s", r.config.CaFile)
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert, r.roots, r.modTimes = cert, roots, modTimes
+	return nil
+}
+
+func (r *TlsReloader) changed() bool {
+	modTimes, err := r.readModTimes()
+	if err != nil {
+		log.Println("failed to check tls files", err)
+		return false
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for f, t := range modTimes {
+		if !t.Equal(r.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads certificates on files change, the previous ones are kept if new ones are invalid.
+func (r *TlsReloader) Watch() {
+	ticker := time.NewTicker(tlsReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- r.closed:
+			return
+		case <- ticker.C:
+		}
+		if !r.changed() {
+			continue
+		}
+		if err := r.load(); err != nil {
+			log.Println("failed to reload tls certificates", err)
+			continue
+		}
+		log.Println("tls certificates reloaded")
+	}
+}
+
+// Close stops Watch.
+func (r *TlsReloader) Close() {
+	close(r.closed)
+}
+
+// ClientConfig returns a config with the current certificates, it's built on every dial.
+func (r *TlsReloader) ClientConfig() *tls.Config {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	cert := r.cert
+	return &tls.Config{
+		RootCAs: r.roots,
+		ServerName: r.config.ServerName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+	}
+}
@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCa issues certificates for servers and clients.
+type testCa struct {
+	cert *x509.Certificate
+	key *ecdsa.PrivateKey
+	pem []byte
+}
+
+func newTestCa(t *testing.T) *testCa {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "test ca"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IsCA: true,
+		KeyUsage: x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCa{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the certificate and key for the name, they are valid for servers and clients.
+func (ca *testCa) issue(t *testing.T, name string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// writeTlsFile writes the file with a new modification time, so reloads notice it on filesystems with coarse times.
+func writeTlsFile(t *testing.T, dir, name string, data []byte) string {
+	f := path.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(f, data, 0600))
+	modTime := time.Unix(time.Now().Unix() + tlsFileWrites, 0)
+	tlsFileWrites++
+	require.NoError(t, os.Chtimes(f, modTime, modTime))
+	return f
+}
+
+var tlsFileWrites int64
+
+// tlsServer accepts connections verifying client certificates of the ca and replies "ok" until it's closed.
+func tlsServer(t *testing.T, ca *testCa, name string) net.Listener {
+	certPem, keyPem := ca.issue(t, name)
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	require.NoError(t, err)
+	clientCas := x509.NewCertPool()
+	clientCas.AddCert(ca.cert)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs: clientCas,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	})
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("ok"))
+			}()
+		}
+	}()
+	return l
+}
+
+// tlsDial returns the server reply, the client certificate is verified by the server after the handshake.
+func tlsDial(addr string, config *tls.Config) (string, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func TestTlsReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCa(t)
+	l := tlsServer(t, ca, "logs.example")
+	defer l.Close()
+	addr := l.Addr().String()
+	certPem, keyPem := ca.issue(t, "agent")
+	config := TlsConfig{
+		CaFile: writeTlsFile(t, dir, "ca.pem", ca.pem),
+		CertFile: writeTlsFile(t, dir, "agent.pem", certPem),
+		KeyFile: writeTlsFile(t, dir, "agent-key.pem", keyPem),
+		ServerName: "logs.example",
+	}
+	r, err := NewTlsReloader(config)
+	require.NoError(t, err)
+	reply, err := tlsDial(addr, r.ClientConfig())
+	require.NoError(t, err)
+	assert.Equal(t, "ok", reply)
+
+	// the server certificate isn't valid for the address without the override
+	config.ServerName = ""
+	r, err = NewTlsReloader(config)
+	require.NoError(t, err)
+	_, err = tlsDial(addr, r.ClientConfig())
+	assert.Error(t, err)
+
+	// the server rejects agents without certificates
+	r, err = NewTlsReloader(TlsConfig{CaFile: config.CaFile, ServerName: "logs.example"})
+	require.NoError(t, err)
+	_, err = tlsDial(addr, r.ClientConfig())
+	assert.Error(t, err)
+
+	_, err = NewTlsReloader(TlsConfig{CertFile: config.CertFile})
+	assert.Error(t, err)
+}
+
+func TestTlsReloaderReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca, otherCa := newTestCa(t), newTestCa(t)
+	l := tlsServer(t, ca, "logs.example")
+	defer l.Close()
+	addr := l.Addr().String()
+	certPem, keyPem := otherCa.issue(t, "agent")
+	config := TlsConfig{
+		CaFile: writeTlsFile(t, dir, "ca.pem", otherCa.pem),
+		CertFile: writeTlsFile(t, dir, "agent.pem", certPem),
+		KeyFile: writeTlsFile(t, dir, "agent-key.pem", keyPem),
+		ServerName: "logs.example",
+	}
+	r, err := NewTlsReloader(config)
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = tlsDial(addr, r.ClientConfig())
+	assert.Error(t, err)
+	assert.False(t, r.changed())
+
+	certPem, keyPem = ca.issue(t, "agent")
+	writeTlsFile(t, dir, "ca.pem", ca.pem)
+	writeTlsFile(t, dir, "agent.pem", certPem)
+	writeTlsFile(t, dir, "agent-key.pem", keyPem)
+	require.True(t, r.changed())
+	require.NoError(t, r.load())
+	reply, err := tlsDial(addr, r.ClientConfig())
+	require.NoError(t, err)
+	assert.Equal(t, "ok", reply)
+
+	// invalid files are reported and the loaded certificates are kept
+	writeTlsFile(t, dir, "ca.pem", []byte("not a certificate"))
+	require.True(t, r.changed())
+	assert.Error(t, r.load())
+	_, err = tlsDial(addr, r.ClientConfig())
+	assert.NoError(t, err)
+}
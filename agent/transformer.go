@@ -3,29 +3,112 @@ package agent
 import (
 	"encoding/json"
 	"time"
+	"errors"
+	"fmt"
+	"strings"
 )
 
+const (
+	maxCriLineSize = 1024 * 1024
+)
+
+var (
+	ErrPartial = errors.New("partial line")
+	// ErrDrop is returned by transformers to drop a record, it isn't counted as an error
+	ErrDrop = errors.New("record dropped")
+)
+
+// Record is a log event, Log keeps the trailing newline as it was written by the container.
+type Record struct {
+	Time string
+	Stream string
+	Log string
+	// Fields are set if Log is a json object parsed by StructuredTransformer
+	Fields map[string]interface{}
+	// Labels are set if they are sent with every record
+	Labels LogLabels
+	// Level is set by LevelTransformer, see Level* constants
+	Level string
+}
+
 type Transformer interface {
-	Do(string) (string, error)
+	Do(*Record) error
+}
+
+// TransformerChain runs transformers in order and stops at the first error.
+type TransformerChain []Transformer
+
+func (chain TransformerChain) Do(record *Record) error {
+	for _, t := range chain {
+		if err := t.Do(record); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type DockerJsonTransformer struct {}
 
 type DockerLogJson struct {
 	Log string
+	Stream string
+	Time string
 }
 
-func (j *DockerJsonTransformer) Do(line string) (string, error) {
+func (j *DockerJsonTransformer) Do(record *Record) error {
 	start := time.Now()
 	obj := DockerLogJson{}
-	err := json.Unmarshal([]byte(line), &obj)
+	err := json.Unmarshal([]byte(record.Log), &obj)
 	jsonHistogram.Observe(time.Since(start).Seconds())
-	return obj.Log, err
+	record.Log, record.Stream, record.Time = obj.Log, obj.Stream, obj.Time
+	return err
 }
 
-type PassThroughTransformer struct {}
+// CriTransformer parses lines written by CRI runtimes: "<time> <stream> <P|F> <log>",
+// partial (P) lines are joined with the following ones of the same stream up to the final (F) line.
+type CriTransformer struct {
+	// partial lines by stream, stdout and stderr are interleaved in one file
+	partial map[string]*strings.Builder
+}
 
-func (t *PassThroughTransformer) Do(line string) (string, error) {
-	return line, nil
+func (t *CriTransformer) Do(record *Record) error {
+	parts := strings.SplitN(record.Log, " ", 4)
+	if len(parts) < 3 {
+		return fmt.Errorf("invalid cri log line: %q", record.Log)
+	}
+	msg := ""
+	if len(parts) == 4 {
+		msg = parts[3]
+	}
+	if t.partial == nil {
+		t.partial = map[string]*strings.Builder{}
+	}
+	partial, ok := t.partial[parts[1]]
+	if !ok {
+		partial = &strings.Builder{}
+		t.partial[parts[1]] = partial
+	}
+	switch parts[2] {
+	case "P":
+		partial.WriteString(msg)
+		if partial.Len() < maxCriLineSize {
+			return ErrPartial
+		}
+		msg = ""
+	case "F":
+	default:
+		return fmt.Errorf("invalid cri log tag %q", parts[2])
+	}
+	if partial.Len() > 0 {
+		msg = partial.String() + msg
+		partial.Reset()
+	}
+	record.Time, record.Stream, record.Log = parts[0], parts[1], msg + "\n"
+	return nil
 }
 
+type PassThroughTransformer struct {}
+
+func (t *PassThroughTransformer) Do(record *Record) error {
+	return nil
+}
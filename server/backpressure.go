@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	capBackpressure = "backpressure"
+	backpressureVersion = "1"
+	// statusTooManyRequests is followed by the retry-after hint if the agent supports backpressure
+	statusTooManyRequests = 429
+	diskCheckInterval = 10 * time.Second
+	clientIdleTimeout = 10 * time.Minute
+)
+
+type BackpressureConfig struct {
+	// MaxWriteLatency rejects batches for RetryAfter after a slower write, 0 disables it
+	MaxWriteLatency time.Duration
+	// MaxClientRate is bytes per second received from one agent host, 0 disables it
+	MaxClientRate int64
+	// MinFreeDisk is free bytes of the log dir below which batches are rejected, 0 disables it
+	MinFreeDisk uint64
+	// RetryAfter is the hint for agents when writes are slow or the disk is full
+	RetryAfter time.Duration
+}
+
+// Backpressure decides if the server is overloaded, a nil Backpressure accepts everything.
+type Backpressure struct {
+	config BackpressureConfig
+	lock sync.Mutex
+	slowUntil time.Time
+	diskLow bool
+	clients map[string]*clientRate
+}
+
+// clientRate is a token bucket of received bytes, it goes negative for big batches, so they aren't rejected forever.
+type clientRate struct {
+	tokens float64
+	last time.Time
+}
+
+func NewBackpressure(config BackpressureConfig) *Backpressure {
+	return &Backpressure{config: config, clients: map[string]*clientRate{}}
+}
+
+// check returns how long the agent should wait before sending the batch again and the reason, 0 if it's accepted.
+func (b *Backpressure) check(client string, size int) (time.Duration, string) {
+	if b == nil {
+		return 0, ""
+	}
+	now := time.Now()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.diskLow {
+		return b.config.RetryAfter, "disk"
+	}
+	if now.Before(b.slowUntil) {
+		return b.slowUntil.Sub(now), "latency"
+	}
+	if b.config.MaxClientRate <= 0 {
+		return 0, ""
+	}
+	rate := float64(b.config.MaxClientRate)
+	c, ok := b.clients[client]
+	if !ok {
+		c = &clientRate{tokens: rate, last: now}
+		b.clients[client] = c
+	}
+	c.tokens += now.Sub(c.last).Seconds() * rate
+	if c.tokens > rate {
+		c.tokens = rate
+	}
+	c.last = now
+	if c.tokens <= 0 {
+		return time.Duration(-c.tokens / rate * float64(time.Second)) + time.Millisecond, "throughput"
+	}
+	c.tokens -= float64(size)
+	return 0, ""
+}
+
+// observeWrite rejects batches for a while after a slow write, so the disk can catch up.
+func (b *Backpressure) observeWrite(latency time.Duration) {
+	if b == nil || b.config.MaxWriteLatency <= 0 || latency <= b.config.MaxWriteLatency {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !time.Now().Before(b.slowUntil) {
+		log.Println("write latency", latency, "exceeds", b.config.MaxWriteLatency, "rejecting batches for", b.config.RetryAfter)
+	}
+	b.slowUntil = time.Now().Add(b.config.RetryAfter)
+}
+
+// Watch checks free space of the dir and forgets idle clients until the process exits.
+func (b *Backpressure) Watch(dir string) {
+	for {
+		b.checkDisk(dir)
+		b.lock.Lock()
+		for client, c := range b.clients {
+			if time.Since(c.last) > clientIdleTimeout {
+				delete(b.clients, client)
+			}
+		}
+		b.lock.Unlock()
+		time.Sleep(diskCheckInterval)
+	}
+}
+
+func (b *Backpressure) checkDisk(dir string) {
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &st); err != nil {
+		log.Println("failed to get free disk space of", dir, err)
+		return
+	}
+	free := st.Bavail * uint64(st.Bsize)
+	diskFreeBytes.Set(float64(free))
+	low := b.config.MinFreeDisk > 0 && free < b.config.MinFreeDisk
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if low != b.diskLow {
+		log.Println("free disk space of", dir, "is", free, "bytes, rejecting batches:", low)
+	}
+	b.diskLow = low
+}
+
+// clientHost is the agent host, connections of one agent share its throughput limit.
+func clientHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// retryAfterHint is the hint in milliseconds sent after statusTooManyRequests.
+func retryAfterHint(d time.Duration) []byte {
+	hint := make([]byte, 4)
+	binary.LittleEndian.PutUint32(hint, uint32(d / time.Millisecond))
+	return hint
+}
+
+func sendRetryAfter(conn net.Conn, d time.Duration) error {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(retryAfterHint(d)); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
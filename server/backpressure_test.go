@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackpressureNil(t *testing.T) {
+	var b *Backpressure
+	after, reason := b.check("host", 1 << 30)
+	assert.Equal(t, time.Duration(0), after)
+	assert.Equal(t, "", reason)
+	b.observeWrite(time.Hour)
+}
+
+func TestBackpressureLatency(t *testing.T) {
+	b := NewBackpressure(BackpressureConfig{MaxWriteLatency: 100 * time.Millisecond, RetryAfter: time.Minute})
+	b.observeWrite(50 * time.Millisecond)
+	after, _ := b.check("host", 10)
+	assert.Equal(t, time.Duration(0), after)
+
+	b.observeWrite(200 * time.Millisecond)
+	after, reason := b.check("host", 10)
+	assert.Equal(t, "latency", reason)
+	assert.True(t, after > 59 * time.Second && after <= time.Minute, "retry after %v", after)
+
+	b.slowUntil = time.Now().Add(-time.Millisecond)
+	after, _ = b.check("host", 10)
+	assert.Equal(t, time.Duration(0), after, "accepted after the retry-after")
+}
+
+func TestBackpressureThroughput(t *testing.T) {
+	b := NewBackpressure(BackpressureConfig{MaxClientRate: 100})
+	after, _ := b.check("a", 150)
+	assert.Equal(t, time.Duration(0), after, "a big batch is accepted with enough tokens")
+	after, reason := b.check("a", 10)
+	assert.Equal(t, "throughput", reason)
+	// 50 bytes over the limit at 100 bytes per second
+	assert.True(t, after > 490 * time.Millisecond && after <= 501 * time.Millisecond, "retry after %v", after)
+	after, _ = b.check("b", 10)
+	assert.Equal(t, time.Duration(0), after, "hosts have their own limits")
+
+	b.clients["a"].last = time.Now().Add(-time.Second)
+	after, _ = b.check("a", 10)
+	assert.Equal(t, time.Duration(0), after, "tokens are refilled")
+}
+
+func TestBackpressureDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	b := NewBackpressure(BackpressureConfig{MinFreeDisk: math.MaxUint64, RetryAfter: time.Minute})
+	b.checkDisk(dir)
+	after, reason := b.check("host", 10)
+	assert.Equal(t, "disk", reason)
+	assert.Equal(t, time.Minute, after)
+
+	b.config.MinFreeDisk = 1
+	b.checkDisk(dir)
+	after, _ = b.check("host", 10)
+	assert.Equal(t, time.Duration(0), after)
+}
+
+func TestSendRetryAfter(t *testing.T) {
+	assert.Equal(t, uint32(1500), binary.LittleEndian.Uint32(retryAfterHint(1500 * time.Millisecond)))
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go sendRetryAfter(server, 2 * time.Second)
+	hint := make([]byte, 4)
+	_, err := client.Read(hint)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2000), binary.LittleEndian.Uint32(hint))
+}
+
+func TestLogStreamBackpressure(t *testing.T) {
+	config, cleanup := testConfig(t)
+	defer cleanup()
+	config.Backpressure = NewBackpressure(BackpressureConfig{MaxClientRate: 1})
+	stream := openTestStream(t, config, map[string]string{"docker.name": "a"}, map[string]string{capBackpressure: backpressureVersion})
+	defer stream.Close()
+	assert.True(t, stream.backpressure)
+
+	assert.Equal(t, int32(200), stream.Write([]byte("a\n")))
+	assert.Equal(t, int32(statusTooManyRequests), stream.Write([]byte("b\n")))
+	assert.True(t, stream.retryAfter > 0)
+	assert.Equal(t, "a\n", readLog(t, config, "a"))
+	// the stream is kept, so the batch is sent again after the hint
+	config.Backpressure.clients[stream.client].last = time.Now().Add(-2 * time.Second)
+	assert.Equal(t, int32(200), stream.Write([]byte("b\n")))
+	assert.Equal(t, "a\nb\n", readLog(t, config, "a"))
+}
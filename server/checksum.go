@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+const (
+	capChecksum = "checksum"
+	checksumCrc32c = "crc32c"
+	checksumSize = 4
+	// statusChecksumMismatch makes agents resend the batch
+	statusChecksumMismatch = 422
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// verifyChecksum returns the payload of a batch prefixed with its CRC32C.
+func verifyChecksum(msg []byte) ([]byte, bool) {
+	if len(msg) < checksumSize {
+		return nil, false
+	}
+	payload := msg[checksumSize:]
+	return payload, crc32.Checksum(payload, crc32cTable) == binary.LittleEndian.Uint32(msg)
+}
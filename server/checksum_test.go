@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"github.com/stretchr/testify/assert"
+)
+
+// withChecksum prefixes the payload with its CRC32C as agents do.
+func withChecksum(payload []byte) []byte {
+	msg := make([]byte, checksumSize, checksumSize + len(payload))
+	binary.LittleEndian.PutUint32(msg, crc32.Checksum(payload, crc32.MakeTable(crc32.Castagnoli)))
+	return append(msg, payload...)
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	payload, ok := verifyChecksum(withChecksum([]byte("a\nb\n")))
+	assert.True(t, ok)
+	assert.Equal(t, "a\nb\n", string(payload))
+
+	payload, ok = verifyChecksum(withChecksum(nil))
+	assert.True(t, ok)
+	assert.Empty(t, payload)
+
+	msg := withChecksum([]byte("a\nb\n"))
+	msg[len(msg) - 1] = 'x'
+	_, ok = verifyChecksum(msg)
+	assert.False(t, ok)
+	msg = withChecksum([]byte("a\nb\n"))
+	msg[0]++
+	_, ok = verifyChecksum(msg)
+	assert.False(t, ok)
+	_, ok = verifyChecksum([]byte{1, 2, 3})
+	assert.False(t, ok)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+	compressionSnappy = "snappy"
+)
+
+var (
+	supportedCompression = []string{compressionZstd, compressionGzip, compressionSnappy}
+)
+
+type Decompressor interface {
+	Decompress([]byte) ([]byte, error)
+}
+
+func NewDecompressor(codec string) (Decompressor, error) {
+	switch codec {
+	case compressionNone:
+		return nil, nil
+	case compressionGzip:
+		return &gzipDecompressor{}, nil
+	case compressionZstd:
+		r, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxMsgSize))
+		if err != nil {
+			return nil, err
+		}
+		return &zstdDecompressor{reader: r}, nil
+	case compressionSnappy:
+		return &snappyDecompressor{}, nil
+	}
+	return nil, fmt.Errorf("unknown compression: %s", codec)
+}
+
+// chooseCompression returns the first codec offered by the agent that is allowed on the server.
+func chooseCompression(offered string, allowed []string) string {
+	for _, codec := range strings.Split(offered, ",") {
+		for _, a := range allowed {
+			if strings.TrimSpace(codec) == a {
+				return a
+			}
+		}
+	}
+	return compressionNone
+}
+
+type gzipDecompressor struct {
+	buf bytes.Buffer
+	reader *gzip.Reader
+}
+
+func (d *gzipDecompressor) Decompress(data []byte) ([]byte, error) {
+	var err error
+	if d.reader == nil {
+		d.reader, err = gzip.NewReader(bytes.NewReader(data))
+	} else {
+		err = d.reader.Reset(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.buf.Reset()
+	n, err := d.buf.ReadFrom(io.LimitReader(d.reader, maxMsgSize + 1))
+	if err != nil {
+		return nil, err
+	}
+	if n > maxMsgSize {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", maxMsgSize)
+	}
+	return d.buf.Bytes(), nil
+}
+
+type zstdDecompressor struct {
+	buf []byte
+	reader *zstd.Decoder
+}
+
+func (d *zstdDecompressor) Decompress(data []byte) ([]byte, error) {
+	var err error
+	d.buf, err = d.reader.DecodeAll(data, d.buf[:0])
+	return d.buf, err
+}
+
+type snappyDecompressor struct {
+	buf []byte
+}
+
+func (d *snappyDecompressor) Decompress(data []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxMsgSize {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", maxMsgSize)
+	}
+	d.buf, err = snappy.Decode(d.buf[:cap(d.buf)], data)
+	return d.buf, err
+}
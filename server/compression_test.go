@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func zstdData(t *testing.T, data []byte) []byte {
+	w, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	defer w.Close()
+	return w.EncodeAll(data, nil)
+}
+
+func TestDecompressors(t *testing.T) {
+	compress := map[string]func([]byte) []byte{
+		compressionGzip: func(data []byte) []byte { return gzipData(t, data) },
+		compressionZstd: func(data []byte) []byte { return zstdData(t, data) },
+		compressionSnappy: func(data []byte) []byte { return snappy.Encode(nil, data) },
+	}
+	for codec, c := range compress {
+		d, err := NewDecompressor(codec)
+		require.NoError(t, err, codec)
+		// decompressors reuse buffers between batches
+		for _, batch := range []string{"first batch\nof lines\n", "second\n", ""} {
+			data, err := d.Decompress(c([]byte(batch)))
+			require.NoError(t, err, codec)
+			assert.Equal(t, batch, string(data), codec)
+		}
+		_, err = d.Decompress([]byte("not compressed"))
+		assert.Error(t, err, codec)
+	}
+
+	d, err := NewDecompressor(compressionNone)
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+	_, err = NewDecompressor("lz4")
+	assert.Error(t, err)
+}
+
+func TestDecompressorsLimitSize(t *testing.T) {
+	big := make([]byte, maxMsgSize + 1)
+	gz, err := NewDecompressor(compressionGzip)
+	require.NoError(t, err)
+	_, err = gz.Decompress(gzipData(t, big))
+	assert.Error(t, err)
+	sn, err := NewDecompressor(compressionSnappy)
+	require.NoError(t, err)
+	_, err = sn.Decompress(snappy.Encode(nil, big))
+	assert.Error(t, err)
+}
+
+func TestChooseCompression(t *testing.T) {
+	assert.Equal(t, compressionZstd, chooseCompression("zstd,gzip", supportedCompression))
+	assert.Equal(t, compressionGzip, chooseCompression("lz4, gzip", supportedCompression))
+	assert.Equal(t, compressionSnappy, chooseCompression("zstd,snappy", []string{compressionSnappy}))
+	assert.Equal(t, compressionNone, chooseCompression("lz4", supportedCompression))
+	assert.Equal(t, compressionNone, chooseCompression("", supportedCompression))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	capDedup = "dedup"
+	dedupVersion = "1"
+	// streamLabel identifies the agent input of a log, it's required for deduplication
+	streamLabel = "oklogging.stream"
+	dedupTmpSuffix = ".tmp"
+)
+
+var (
+	dedupStates = map[string]*dedupState{}
+	dedupLock sync.Mutex
+)
+
+// dedupState is the agent input offset up to which records of a stream are written. It's shared by
+// connections of the same stream, e.g. a broken one which isn't closed yet and the new one.
+type dedupState struct {
+	lock sync.Mutex
+	identity string
+	path string
+	offset int64
+	refs int
+}
+
+type batchMark struct {
+	offset int64
+	pos int
+}
+
+// acquireDedupState loads the state of the stream, it's released when the stream is closed.
+func acquireDedupState(dir string, identity string) (*dedupState, error) {
+	dedupLock.Lock()
+	defer dedupLock.Unlock()
+	if d, ok := dedupStates[identity]; ok {
+		d.refs++
+		return d, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	d := &dedupState{identity: identity, path: path.Join(dir, sanitizePathComponent(identity)), refs: 1}
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if d.offset, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid dedup state %s: %s", d.path, err)
+		}
+	}
+	dedupStates[identity] = d
+	return d, nil
+}
+
+func (d *dedupState) release() {
+	dedupLock.Lock()
+	defer dedupLock.Unlock()
+	if d.refs--; d.refs == 0 {
+		delete(dedupStates, d.identity)
+	}
+}
+
+// save persists the offset after records up to it are written, the file and the rename are synced,
+// so the offset survives a crash.
+func (d *dedupState) save(offset int64) error {
+	f, err := os.OpenFile(d.path + dedupTmpSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strconv.FormatInt(offset, 10))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(d.path + dedupTmpSuffix, d.path)
+	}
+	if err != nil {
+		os.Remove(d.path + dedupTmpSuffix)
+		return err
+	}
+	if err := syncDir(path.Dir(d.path)); err != nil {
+		return err
+	}
+	d.offset = offset
+	return nil
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// decodeOffsets returns the input offset after the batch, offsets of its records and the rest of the msg.
+func decodeOffsets(msg []byte) (int64, []batchMark, []byte, error) {
+	r := bytes.NewReader(msg)
+	end, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if count > uint64(len(msg)) {
+		return 0, nil, nil, fmt.Errorf("invalid batch marks count: %d", count)
+	}
+	marks := make([]batchMark, 0, count)
+	offset, pos := int64(0), 0
+	for i := uint64(0); i < count; i++ {
+		offsetDelta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		posDelta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		offset, pos = offset + int64(offsetDelta), pos + int(posDelta)
+		marks = append(marks, batchMark{offset: offset, pos: pos})
+	}
+	return int64(end), marks, msg[len(msg) - r.Len():], nil
+}
+
+// trimBatch skips records up to the written offset, it returns nil if all of them are written.
+func trimBatch(data []byte, end int64, marks []batchMark, written int64) ([]byte, error) {
+	if end <= written {
+		return nil, nil
+	}
+	skip := 0
+	for _, m := range marks {
+		if m.offset > written {
+			break
+		}
+		skip = m.pos
+	}
+	if skip > len(data) {
+		return nil, fmt.Errorf("invalid batch mark position: %d", skip)
+	}
+	return data[skip:], nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withOffsets prefixes the data with offsets as agents do, marks are pairs of the input offset and the end position
+// of records.
+func withOffsets(data string, end int64, marks ...int64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64 * (2 + len(marks)))
+	n := binary.PutUvarint(buf, uint64(end))
+	n += binary.PutUvarint(buf[n:], uint64(len(marks) / 2))
+	offset, pos := int64(0), int64(0)
+	for i := 0; i + 1 < len(marks); i += 2 {
+		n += binary.PutUvarint(buf[n:], uint64(marks[i] - offset))
+		n += binary.PutUvarint(buf[n:], uint64(marks[i + 1] - pos))
+		offset, pos = marks[i], marks[i + 1]
+	}
+	return append(buf[:n], data...)
+}
+
+func TestDecodeOffsets(t *testing.T) {
+	end, marks, data, err := decodeOffsets(withOffsets("a\nb\n", 10, 6, 2, 8, 4))
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), end)
+	assert.Equal(t, []batchMark{{offset: 6, pos: 2}, {offset: 8, pos: 4}}, marks)
+	assert.Equal(t, "a\nb\n", string(data))
+
+	end, marks, data, err = decodeOffsets(withOffsets("", 0))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), end)
+	assert.Empty(t, marks)
+	assert.Empty(t, data)
+
+	_, _, _, err = decodeOffsets(nil)
+	assert.Error(t, err)
+	// more marks than bytes
+	_, _, _, err = decodeOffsets([]byte{10, 100, 1})
+	assert.Error(t, err)
+	// truncated marks
+	_, _, _, err = decodeOffsets([]byte{10, 2, 6, 2})
+	assert.Error(t, err)
+}
+
+func TestTrimBatch(t *testing.T) {
+	data := []byte("a\nb\nc\n")
+	marks := []batchMark{{offset: 2, pos: 2}, {offset: 4, pos: 4}, {offset: 6, pos: 6}}
+	for _, c := range []struct {
+		written int64
+		expected string
+	}{
+		{0, "a\nb\nc\n"},
+		{1, "a\nb\nc\n"},
+		{2, "b\nc\n"},
+		{4, "c\n"},
+		{5, "c\n"},
+	} {
+		trimmed, err := trimBatch(data, 7, marks, c.written)
+		require.NoError(t, err)
+		assert.Equal(t, c.expected, string(trimmed), "written %d", c.written)
+	}
+	// written up to the end, including records dropped by the agent after the last one
+	for _, written := range []int64{6, 7, 100} {
+		trimmed, err := trimBatch(data, 7, marks, written)
+		require.NoError(t, err)
+		assert.Empty(t, trimmed, "written %d", written)
+	}
+	_, err := trimBatch(data, 20, []batchMark{{offset: 10, pos: 100}}, 10)
+	assert.Error(t, err)
+}
+
+func TestDedupState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	state, err := acquireDedupState(dir, "cid/1_2/f00d")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), state.offset)
+	assert.Equal(t, path.Join(dir, "cid_1_2_f00d"), state.path)
+	// connections of the same stream share the state
+	shared, err := acquireDedupState(dir, "cid/1_2/f00d")
+	require.NoError(t, err)
+	assert.True(t, state == shared)
+	require.NoError(t, state.save(42))
+	assert.Equal(t, int64(42), shared.offset)
+	shared.release()
+	state.release()
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1, "no temporary files")
+	data, err := ioutil.ReadFile(path.Join(dir, "cid_1_2_f00d"))
+	require.NoError(t, err)
+	assert.Equal(t, "42", string(data))
+
+	state, err = acquireDedupState(dir, "cid/1_2/f00d")
+	require.NoError(t, err)
+	assert.False(t, state == shared, "released states are loaded again")
+	assert.Equal(t, int64(42), state.offset)
+	state.release()
+
+	// another generation of the file has its own state
+	state, err = acquireDedupState(dir, "cid/1_2/beef")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), state.offset)
+	state.release()
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "invalid"), []byte("x"), 0644))
+	_, err = acquireDedupState(dir, "invalid")
+	assert.Error(t, err)
+}
+
+func TestLogStreamDedup(t *testing.T) {
+	config, cleanup := testConfig(t)
+	defer cleanup()
+	config.DedupDir = path.Join(config.LogDir, "dedup")
+	openStream := func() *logStream {
+		return openTestStream(t, config, map[string]string{"docker.name": "a", streamLabel: "cid/1_2/f00d"}, map[string]string{capDedup: dedupVersion})
+	}
+	stream := openStream()
+	assert.Equal(t, int32(200), stream.Write(withOffsets("a\nb\n", 4, 2, 2, 4, 4)))
+	// resent with an overlap, the connection of the first one may still be open
+	resent := openStream()
+	assert.Equal(t, int32(200), resent.Write(withOffsets("b\nc\n", 7, 4, 2, 6, 4)))
+	assert.Equal(t, int32(200), stream.Write(withOffsets("c\n", 6, 6, 2)))
+	// batches without offsets are written
+	assert.Equal(t, int32(200), stream.Write(withOffsets("x\n", 0)))
+	assert.Equal(t, int32(400), stream.Write([]byte{0x80}))
+	stream.Close()
+	resent.Close()
+	assert.Equal(t, "a\nb\nc\nx\n", readLog(t, config, "a"))
+
+	stream = openStream()
+	assert.Equal(t, int32(200), stream.Write(withOffsets("c\nd\n", 8, 6, 2, 8, 4)))
+	stream.Close()
+	assert.Equal(t, "a\nb\nc\nx\nd\n", readLog(t, config, "a"))
+
+	// offsets aren't accepted without the dedup dir, so agents don't send them
+	config.DedupDir = ""
+	assert.NotContains(t, acceptCapabilities(config, map[string]string{capDedup: dedupVersion}), capDedup)
+	stream = openStream()
+	assert.Equal(t, int32(200), stream.Write([]byte("d\n")))
+	stream.Close()
+	assert.Equal(t, "a\nb\nc\nx\nd\nd\n", readLog(t, config, "a"))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// handshakeMagic starts versioned handshakes, as a legacy frame size it's bigger than maxMsgSize
+	handshakeMagic = "OKLG"
+	protocolVersion = 1
+	minProtocolVersion = 1
+
+	capCompression = "compression"
+	capWindow = "window"
+	capMux = "mux"
+)
+
+// version is reported to agents, it's set with -ldflags "-X main.version=..."
+var version = "dev"
+
+// hello is the first frame of a versioned handshake after the magic bytes.
+type hello struct {
+	MinVersion int `json:"min_version"`
+	Version int `json:"version"`
+	Agent string `json:"agent"`
+	Capabilities map[string]string `json:"capabilities,omitempty"`
+	// Labels are empty for multiplexed connections, streams have their own labels
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// welcome is the server reply, Capabilities are the accepted ones with chosen values.
+type welcome struct {
+	Version int `json:"version"`
+	Server string `json:"server"`
+	Status int32 `json:"status"`
+	Error string `json:"error,omitempty"`
+	Capabilities map[string]string `json:"capabilities,omitempty"`
+}
+
+// bufferedConn reads through a buffer, so the handshake can be peeked at and pipelined frames
+// already received can be checked.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: conn, reader: bufio.NewReaderSize(conn, pipelineBufferSize)}
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// isVersionedHandshake consumes the magic bytes if the connection starts with them.
+func isVersionedHandshake(conn *bufferedConn) (bool, error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return false, err
+	}
+	magic, err := conn.reader.Peek(len(handshakeMagic))
+	if err != nil {
+		return false, err
+	}
+	if string(magic) != handshakeMagic {
+		return false, nil
+	}
+	_, err = conn.reader.Discard(len(handshakeMagic))
+	return true, err
+}
+
+// negotiateVersion returns the highest version supported by both sides or 0.
+func negotiateVersion(h hello) int {
+	v := h.Version
+	if v > protocolVersion {
+		v = protocolVersion
+	}
+	if v < minProtocolVersion || v < h.MinVersion {
+		return 0
+	}
+	return v
+}
+
+// acceptCapabilities returns capabilities requested by the agent that are accepted with the chosen values.
+func acceptCapabilities(config *Config, requested map[string]string) map[string]string {
+	accepted := map[string]string{}
+	if offered, ok := requested[capCompression]; ok {
+		accepted[capCompression] = chooseCompression(offered, config.Compression)
+	}
+	if window, ok := requested[capWindow]; ok {
+		accepted[capWindow] = window
+	}
+	if requested[capChecksum] == checksumCrc32c {
+		accepted[capChecksum] = checksumCrc32c
+	}
+	// offsets are useless without DedupDir, so they aren't sent
+	if requested[capDedup] == dedupVersion && config.DedupDir != "" {
+		accepted[capDedup] = dedupVersion
+	}
+	if requested[capBackpressure] == backpressureVersion {
+		accepted[capBackpressure] = backpressureVersion
+	}
+	if interval, ok := heartbeatInterval(requested[capHeartbeat], config.IdleTimeout); ok {
+		accepted[capHeartbeat] = interval
+	}
+	return accepted
+}
+
+func sendWelcome(conn net.Conn, w welcome) error {
+	w.Server = version
+	payload, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return sendFrame(conn, payload, timeout)
+}
+
+func handleVersioned(conn *bufferedConn, config *Config) {
+	msg := &Msg{}
+	if err := readMsg(conn, msg, timeout); err != nil {
+		log.Println("failed to read msg from", conn.RemoteAddr(), err)
+		return
+	}
+	h := hello{}
+	if err := json.Unmarshal(msg.Bytes(), &h); err != nil {
+		log.Println("failed to unmarshal handshake", string(msg.Bytes()), err)
+		sendWelcome(conn, welcome{Status: 400, Error: "invalid handshake"})
+		return
+	}
+	v := negotiateVersion(h)
+	if v == 0 {
+		log.Println("unsupported protocol versions", h.MinVersion, "-", h.Version, "of agent", h.Agent, "from", conn.RemoteAddr())
+		sendWelcome(conn, welcome{Status: 400, Error: "unsupported protocol version"})
+		return
+	}
+	if _, ok := h.Capabilities[capMux]; ok {
+		capabilities := muxCapabilities(config, h.Capabilities)
+		if err := sendWelcome(conn, welcome{Version: v, Status: 200, Capabilities: capabilities}); err != nil {
+			log.Println("failed to write response", err)
+			return
+		}
+		log.Println("new multiplexed connection from", conn.RemoteAddr(), "agent", h.Agent, "protocol", v)
+		handleMux(conn, config, capabilities)
+		return
+	}
+	labels := h.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	log.Println("new connection from", conn.RemoteAddr(), "agent", h.Agent, "protocol", v, labels)
+	stream, status := openLogStream(config, labels)
+	w := welcome{Version: v, Status: status}
+	if stream != nil {
+		w.Capabilities = acceptCapabilities(config, h.Capabilities)
+		if err := stream.enable(w.Capabilities); err != nil {
+			log.Println("failed to enable capabilities", w.Capabilities, err)
+			stream.Close()
+			stream = nil
+			w = welcome{Version: v, Status: 400}
+		}
+	}
+	if err := sendWelcome(conn, w); err != nil {
+		log.Println("failed to write response", err)
+		if stream != nil {
+			stream.Close()
+		}
+		return
+	}
+	if w.Status != 200 {
+		return
+	}
+	defer stream.Close()
+	serveStream(conn, stream)
+}
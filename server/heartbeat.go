@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	capHeartbeat = "heartbeat"
+	// heartbeats are empty frames, muxHeartbeat frames of multiplexed connections
+	muxHeartbeat = 4
+)
+
+// heartbeatInterval returns the interval of agent heartbeats, it's shortened so idle connections aren't closed.
+func heartbeatInterval(requested string, idleTimeout time.Duration) (string, bool) {
+	ms, err := strconv.ParseInt(requested, 10, 64)
+	if err != nil || ms <= 0 {
+		return "", false
+	}
+	interval := time.Duration(ms) * time.Millisecond
+	if idleTimeout > 0 && interval > idleTimeout / 3 {
+		interval = idleTimeout / 3
+	}
+	return strconv.FormatInt(int64(interval / time.Millisecond), 10), true
+}
+
+// readDataMsg waits for the next frame up to the idle timeout, idle connections are counted. The timeout applies
+// to the frame size only, so big batches over slow links aren't cut.
+func readDataMsg(conn net.Conn, msg *Msg, idleTimeout time.Duration) error {
+	if idleTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return err
+		}
+	}
+	var size int32
+	err := binary.Read(conn, binary.LittleEndian, &size)
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		idleConnections.Inc()
+		return fmt.Errorf("no frames for %s, closing idle connection", idleTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	if idleTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			return err
+		}
+	}
+	return readPayload(conn, msg, size)
+}
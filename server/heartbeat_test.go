@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeatInterval(t *testing.T) {
+	interval, ok := heartbeatInterval("30000", 5 * time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, "30000", interval)
+	interval, ok = heartbeatInterval("300000", time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, "20000", interval, "shortened to a third of the idle timeout")
+	interval, ok = heartbeatInterval("300000", 0)
+	assert.True(t, ok)
+	assert.Equal(t, "300000", interval)
+	for _, requested := range []string{"", "0", "-1", "x"} {
+		_, ok = heartbeatInterval(requested, time.Minute)
+		assert.False(t, ok, requested)
+	}
+}
+
+func TestReadDataMsgIdle(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	err := readDataMsg(server, &Msg{}, 50 * time.Millisecond)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "idle connection")
+}
+
+func TestReadDataMsgSlowPayload(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		size := make([]byte, 4)
+		binary.LittleEndian.PutUint32(size, 4)
+		client.Write(size)
+		// the payload takes longer than the idle timeout
+		client.Write([]byte("a\n"))
+		time.Sleep(100 * time.Millisecond)
+		client.Write([]byte("b\n"))
+	}()
+	msg := &Msg{}
+	require.NoError(t, readDataMsg(server, msg, 50 * time.Millisecond))
+	assert.Equal(t, "a\nb\n", string(msg.Bytes()))
+}
+
+func TestIdleLegacyConnection(t *testing.T) {
+	config, cleanup := testConfig(t)
+	defer cleanup()
+	config.IdleTimeout = 50 * time.Millisecond
+	server, client := net.Pipe()
+	defer client.Close()
+	go handleConnection(server, config)
+	// legacy agents don't send heartbeats, their idle connections are closed too
+	require.NoError(t, sendFrame(client, []byte(`{"docker.name":"a"}`), time.Second))
+	var status int32
+	require.NoError(t, binary.Read(client, binary.LittleEndian, &status))
+	require.Equal(t, int32(200), status)
+	client.SetDeadline(time.Now().Add(time.Second))
+	_, err := client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
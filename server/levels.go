@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"time"
+	"log"
+)
+
+const (
+	// formatLabel is sent by agents, only json records have levels
+	formatLabel = "oklogging.format"
+	formatJson = "json"
+)
+
+type levelRecord struct {
+	Level string `json:"level"`
+}
+
+// errorLines returns json records with error or fatal levels set by agents.
+func errorLines(data []byte) ([]byte, int) {
+	var res []byte
+	count := 0
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i + 1], data[i + 1:]
+		} else {
+			data = nil
+		}
+		if !bytes.Contains(line, []byte(`"level"`)) {
+			continue
+		}
+		record := levelRecord{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			continue
+		}
+		if record.Level == "error" || record.Level == "fatal" {
+			res = append(res, line...)
+			count++
+		}
+	}
+	return res, count
+}
+
+// openErrorsLog opens the errors file of a log, it's rotated on open if it's too big.
+func openErrorsLog(p string) (*os.File, error) {
+	if fi, err := os.Stat(p); err == nil && fi.Size() >= maxLogSize {
+		if err := os.Rename(p, backupLogPath(p, time.Now().Format(backupLogDateFormat))); err != nil {
+			log.Println("failed to move errors log", err)
+		}
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	lock.Lock()
+	openFiles[f.Name()] = struct{}{}
+	lock.Unlock()
+	return f, nil
+}
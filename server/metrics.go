@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	connectionsCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:    "oklogging_server_connections",
+		Help:    "Open agent connections",
+	})
+	streamsCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:    "oklogging_server_streams",
+		Help:    "Open streams of multiplexed agent connections",
+	})
+	bytesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:    "oklogging_server_bytes_received",
+		Help:    "Bytes received from agents",
+	})
+	bytesWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:    "oklogging_server_bytes_written",
+		Help:    "Bytes written to logs after decompression",
+	})
+	writeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:    "oklogging_server_write_errors",
+		Help:    "Log write errors count",
+	})
+	checksumErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:    "oklogging_server_checksum_errors",
+		Help:    "Batches rejected because of checksum mismatch",
+	})
+	duplicateBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:    "oklogging_server_duplicate_bytes",
+		Help:    "Bytes of resent batches skipped because they were already written",
+	})
+	backpressureResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:    "oklogging_server_backpressure_responses",
+		Help:    "Batches rejected with 429 by reason: disk, latency or throughput",
+	}, []string{"reason"})
+	diskFreeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:    "oklogging_server_disk_free_bytes",
+		Help:    "Free space of the log dir available to the server",
+	})
+	idleConnections = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:    "oklogging_server_idle_connections_closed",
+		Help:    "Agent connections closed by -idle-timeout",
+	})
+	errorRecords = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:    "oklogging_server_error_records",
+		Help:    "Error and fatal records written to errors logs",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(connectionsCount)
+	prometheus.MustRegister(streamsCount)
+	prometheus.MustRegister(bytesReceived)
+	prometheus.MustRegister(bytesWritten)
+	prometheus.MustRegister(writeErrors)
+	prometheus.MustRegister(checksumErrors)
+	prometheus.MustRegister(duplicateBytes)
+	prometheus.MustRegister(backpressureResponses)
+	prometheus.MustRegister(diskFreeBytes)
+	prometheus.MustRegister(idleConnections)
+	prometheus.MustRegister(errorRecords)
+}
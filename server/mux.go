@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net"
+)
+
+const (
+	// muxVersion of the mux capability switches a connection to the multiplexed protocol
+	muxVersion = "1"
+
+	muxOpen = 1
+	muxData = 2
+	muxClose = 3
+
+	// muxHeaderSize is the frame type and the stream id
+	muxHeaderSize = 5
+)
+
+// muxResponse is a frame with the type and the stream id of the request, the status and the body.
+func muxResponse(typ byte, id uint32, status int32, body []byte) []byte {
+	frame := make([]byte, muxHeaderSize + 4 + len(body))
+	frame[0] = typ
+	binary.LittleEndian.PutUint32(frame[1:], id)
+	binary.LittleEndian.PutUint32(frame[muxHeaderSize:], uint32(status))
+	copy(frame[muxHeaderSize + 4:], body)
+	return frame
+}
+
+// muxCapabilities returns capabilities accepted for all streams of a multiplexed connection,
+// batches of streams aren't pipelined.
+func muxCapabilities(config *Config, requested map[string]string) map[string]string {
+	capabilities := acceptCapabilities(config, requested)
+	delete(capabilities, capWindow)
+	capabilities[capMux] = muxVersion
+	return capabilities
+}
+
+// handleMux serves a connection carrying many logs. Every frame starts with its type and a stream id:
+// open frames register a stream with its labels, data frames are batches of a stream and close frames
+// remove it. Open and data frames are answered with the status in the order they are received, so each
+// stream keeps its batches order and acknowledgements.
+// The handshake is answered by the caller with the accepted capabilities.
+func handleMux(conn net.Conn, config *Config, capabilities map[string]string) {
+	_, backpressure := capabilities[capBackpressure]
+	streams := map[uint32]*logStream{}
+	defer func() {
+		for _, stream := range streams {
+			stream.Close()
+		}
+		streamsCount.Sub(float64(len(streams)))
+	}()
+	closeStream := func(id uint32) {
+		if stream, ok := streams[id]; ok {
+			stream.Close()
+			delete(streams, id)
+			streamsCount.Dec()
+		}
+	}
+	msg := &Msg{}
+	for {
+		if err := readDataMsg(conn, msg, config.IdleTimeout); err != nil {
+			log.Println("failed to read msg from", conn.RemoteAddr(), err)
+			return
+		}
+		frame := msg.Bytes()
+		if len(frame) < muxHeaderSize {
+			log.Println("invalid multiplexed frame from", conn.RemoteAddr())
+			return
+		}
+		typ, id, body := frame[0], binary.LittleEndian.Uint32(frame[1:]), frame[muxHeaderSize:]
+		var response []byte
+		switch typ {
+		case muxOpen:
+			closeStream(id)
+			labels := map[string]string{}
+			if err := json.Unmarshal(body, &labels); err != nil {
+				log.Println("failed to unmarshal labels", string(body), err)
+				response = muxResponse(typ, id, 400, nil)
+				break
+			}
+			stream, status := openLogStream(config, labels)
+			if status != 200 {
+				response = muxResponse(typ, id, status, nil)
+				break
+			}
+			if err := stream.enable(capabilities); err != nil {
+				log.Println("failed to enable capabilities", capabilities, err)
+				stream.Close()
+				response = muxResponse(typ, id, 400, nil)
+				break
+			}
+			stream.client = clientHost(conn)
+			streams[id] = stream
+			streamsCount.Inc()
+			log.Println("new stream", id, "from", conn.RemoteAddr(), labels)
+			response = muxResponse(typ, id, status, nil)
+		case muxData:
+			stream, ok := streams[id]
+			if !ok {
+				log.Println("unknown stream", id, "from", conn.RemoteAddr())
+				response = muxResponse(typ, id, 404, nil)
+				break
+			}
+			status := stream.Write(body)
+			if status == statusTooManyRequests && backpressure {
+				response = muxResponse(typ, id, status, retryAfterHint(stream.retryAfter))
+				break
+			}
+			if status != 200 && status != statusChecksumMismatch {
+				closeStream(id)
+			}
+			response = muxResponse(typ, id, status, nil)
+		case muxClose:
+			closeStream(id)
+			continue
+		case muxHeartbeat:
+			response = muxResponse(typ, id, 200, nil)
+		default:
+			log.Println("unknown multiplexed frame type", typ, "from", conn.RemoteAddr())
+			return
+		}
+		if err := sendFrame(conn, response, timeout); err != nil {
+			log.Println("failed to write response", err)
+			return
+		}
+	}
+}
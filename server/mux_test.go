@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"path"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// muxClient opens a multiplexed connection to a server listening with the config.
+func muxClient(t *testing.T, config *Config, capabilities map[string]string) (net.Conn, map[string]string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(c, config)
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	capabilities[capMux] = muxVersion
+	payload, err := json.Marshal(hello{MinVersion: 1, Version: 1, Agent: "test", Capabilities: capabilities})
+	require.NoError(t, err)
+	_, err = conn.Write([]byte(handshakeMagic))
+	require.NoError(t, err)
+	require.NoError(t, sendFrame(conn, payload, time.Second))
+	msg := &Msg{}
+	require.NoError(t, readMsg(conn, msg, time.Second))
+	w := welcome{}
+	require.NoError(t, json.Unmarshal(msg.Bytes(), &w))
+	require.Equal(t, int32(200), w.Status)
+	return conn, w.Capabilities, func() {
+		conn.Close()
+		l.Close()
+	}
+}
+
+func sendMux(t *testing.T, conn net.Conn, typ byte, id uint32, body string) {
+	frame := make([]byte, muxHeaderSize + len(body))
+	frame[0] = typ
+	binary.LittleEndian.PutUint32(frame[1:], id)
+	copy(frame[muxHeaderSize:], body)
+	require.NoError(t, sendFrame(conn, frame, time.Second))
+}
+
+// readMux returns the stream id and the status of the next response.
+func readMux(t *testing.T, conn net.Conn) (uint32, int32) {
+	msg := &Msg{}
+	require.NoError(t, readMsg(conn, msg, time.Second))
+	frame := msg.Bytes()
+	require.True(t, len(frame) >= muxHeaderSize + 4)
+	return binary.LittleEndian.Uint32(frame[1:]), int32(binary.LittleEndian.Uint32(frame[muxHeaderSize:]))
+}
+
+func TestMuxStreams(t *testing.T) {
+	config, cleanup := testConfig(t)
+	defer cleanup()
+	conn, capabilities, closeConn := muxClient(t, config, map[string]string{capChecksum: checksumCrc32c, capWindow: "8"})
+	defer closeConn()
+	assert.Equal(t, map[string]string{capMux: muxVersion, capChecksum: checksumCrc32c}, capabilities, "streams aren't pipelined")
+
+	sendMux(t, conn, muxOpen, 1, `{"docker.name": "a"}`)
+	sendMux(t, conn, muxOpen, 2, `{"docker.name": "b"}`)
+	sendMux(t, conn, muxData, 1, string(withChecksum([]byte("a1\n"))))
+	sendMux(t, conn, muxData, 2, string(withChecksum([]byte("b1\n"))))
+	sendMux(t, conn, muxData, 1, string(withChecksum([]byte("a2\n"))))
+	for _, expected := range []uint32{1, 2, 1, 2, 1} {
+		id, status := readMux(t, conn)
+		assert.Equal(t, expected, id)
+		assert.Equal(t, int32(200), status)
+	}
+	assert.Equal(t, "a1\na2\n", readLog(t, config, "a"))
+	assert.Equal(t, "b1\n", readLog(t, config, "b"))
+
+	// streams are rejected without a log path, closed streams are unknown
+	sendMux(t, conn, muxOpen, 3, `{}`)
+	id, status := readMux(t, conn)
+	assert.Equal(t, uint32(3), id)
+	assert.Equal(t, int32(400), status)
+	sendMux(t, conn, muxData, 3, string(withChecksum([]byte("x\n"))))
+	_, status = readMux(t, conn)
+	assert.Equal(t, int32(404), status)
+	sendMux(t, conn, muxClose, 2, "")
+	sendMux(t, conn, muxData, 2, string(withChecksum([]byte("b2\n"))))
+	id, status = readMux(t, conn)
+	assert.Equal(t, uint32(2), id)
+	assert.Equal(t, int32(404), status)
+	assert.Equal(t, "b1\n", readLog(t, config, "b"))
+
+	// a corrupted batch keeps the stream
+	corrupted := withChecksum([]byte("a3\n"))
+	corrupted[checksumSize] = 'b'
+	sendMux(t, conn, muxData, 1, string(corrupted))
+	_, status = readMux(t, conn)
+	assert.Equal(t, int32(statusChecksumMismatch), status)
+	sendMux(t, conn, muxData, 1, string(withChecksum([]byte("a3\n"))))
+	_, status = readMux(t, conn)
+	assert.Equal(t, int32(200), status)
+	assert.Equal(t, "a1\na2\na3\n", readLog(t, config, "a"))
+}
+
+func TestMuxConnectionClosed(t *testing.T) {
+	config, cleanup := testConfig(t)
+	defer cleanup()
+	conn, _, closeConn := muxClient(t, config, map[string]string{})
+	defer closeConn()
+	sendMux(t, conn, muxOpen, 1, `{"docker.name": "a"}`)
+	_, status := readMux(t, conn)
+	require.Equal(t, int32(200), status)
+	logPath := path.Join(config.LogDir, "a.log")
+	assert.True(t, isFileOpen(logPath))
+
+	// logs of streams are closed with the connection
+	conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); isFileOpen(logPath) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, isFileOpen(logPath))
+}
@@ -5,19 +5,24 @@ import (
 	"flag"
 	"encoding/json"
 	"os"
-	"path"
 	"net"
 	"encoding/binary"
 	"io"
 	"time"
-	"io/ioutil"
 	"sync"
+	"path/filepath"
+	"fmt"
+	"strings"
+	"net/http"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"crypto/tls"
 )
 
 const (
 	timeout = 10 * time.Second
 	maxLogSize = 1 * 1024 * 1024 * 1024
 	backupLogDateFormat = "2006-01-02T15-04-05.000"
+	maxMsgSize = 64 * 1024 * 1024
 )
 
 var (
@@ -25,6 +30,24 @@ var (
 	lock sync.RWMutex
 )
 
+type Config struct {
+	LogDir string
+	// PathTemplates are tried in order until one of them is resolved
+	PathTemplates []*PathTemplate
+	// Compression lists codecs allowed for agents
+	Compression []string
+	// Tls is nil for plain tcp connections
+	Tls *TlsReloader
+	// ErrorsSuffix enables writing error records of json logs to a separate file, see errorsLogPath
+	ErrorsSuffix string
+	// DedupDir keeps offsets of agent inputs written to logs, deduplication is disabled if it's empty
+	DedupDir string
+	// Backpressure is nil if batches are never rejected because of overload
+	Backpressure *Backpressure
+	// IdleTimeout closes connections without frames, agents without heartbeats reconnect with the next batch, 0 disables it
+	IdleTimeout time.Duration
+}
+
 type Msg struct {
 	size int
 	payload []byte
@@ -48,12 +71,35 @@ func readMsg(conn net.Conn, msg *Msg, timeout time.Duration) error {
 	if err := binary.Read(conn, binary.LittleEndian, &size); err != nil {
 		return err
 	}
+	if err := readPayload(conn, msg, size); err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readPayload reads the frame of the size into msg.
+func readPayload(conn net.Conn, msg *Msg, size int32) error {
+	if size < 0 || size > maxMsgSize {
+		return fmt.Errorf("invalid msg size: %d", size)
+	}
 	msg.size = int(size)
 	if len(msg.payload) < msg.size {
 		msg.payload = make([]byte, msg.size)
 	}
-	_, err := io.ReadAtLeast(conn, msg.payload, msg.size)
-	if err != nil {
+	_, err := io.ReadFull(conn, msg.payload[:msg.size])
+	return err
+}
+
+func sendResponse(conn net.Conn, status int32, timeout time.Duration) error {
+	if timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(conn, binary.LittleEndian, &status); err != nil {
 		return err
 	}
 	if err := conn.SetDeadline(time.Time{}); err != nil {
@@ -62,13 +108,16 @@ func readMsg(conn net.Conn, msg *Msg, timeout time.Duration) error {
 	return nil
 }
 
-func sendResponse(conn net.Conn, status int32, timeout time.Duration) error {
+func sendFrame(conn net.Conn, payload []byte, timeout time.Duration) error {
 	if timeout > 0 {
 		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
 			return err
 		}
 	}
-	if err := binary.Write(conn, binary.LittleEndian, &status); err != nil {
+	if err := binary.Write(conn, binary.LittleEndian, int32(len(payload))); err != nil {
+		return err
+	}
+	if _, err := conn.Write(payload); err != nil {
 		return err
 	}
 	if err := conn.SetDeadline(time.Time{}); err != nil {
@@ -77,11 +126,14 @@ func sendResponse(conn net.Conn, status int32, timeout time.Duration) error {
 	return nil
 }
 
-func listenAndServe(listen string, logDir string) (error) {
+func listenAndServe(listen string, config *Config) (error) {
 	l, err := net.Listen("tcp", listen)
 	if err != nil {
 		return err
 	}
+	if config.Tls != nil {
+		l = tls.NewListener(l, config.Tls.ServerConfig())
+	}
 	defer l.Close()
 
 	for {
@@ -89,13 +141,25 @@ func listenAndServe(listen string, logDir string) (error) {
 		if err != nil {
 			return err
 		}
-		go handleConnection(c, logDir)
+		go handleConnection(c, config)
 	}
 }
 
 
-func handleConnection(conn net.Conn, logDir string) {
-	defer conn.Close()
+func handleConnection(c net.Conn, config *Config) {
+	defer c.Close()
+	connectionsCount.Inc()
+	defer connectionsCount.Dec()
+	conn := newBufferedConn(c)
+	versioned, err := isVersionedHandshake(conn)
+	if err != nil {
+		log.Println("failed to read msg from", conn.RemoteAddr(), err)
+		return
+	}
+	if versioned {
+		handleVersioned(conn, config)
+		return
+	}
 	msg := &Msg{}
 	if err := readMsg(conn, msg, timeout); err != nil {
 		log.Println("failed to read msg from", conn.RemoteAddr(), err)
@@ -107,68 +171,55 @@ func handleConnection(conn net.Conn, logDir string) {
 		return
 	}
 	log.Println("new connection from", conn.RemoteAddr(), labels)
-	status := int32(200)
-	dockerName, ok := labels["docker.name"]
-	if !ok {
-		status = 400
-	}
+	stream, status := openLogStream(config, labels)
 	if err := sendResponse(conn, status, timeout); err != nil {
 		log.Println("failed to write response", err)
+		if stream != nil {
+			stream.Close()
+		}
 		return
 	}
 	if status != 200 {
 		return
 	}
+	defer stream.Close()
+	serveStream(conn, stream)
+}
 
-	logPath := path.Join(logDir, dockerName + ".log")
-	currentSize := int64(0)
-
-	if fi, err := os.Stat(logPath); err == nil {
-		currentSize = fi.Size()
-		if currentSize >= maxLogSize {
-			err := os.Rename(logPath,
-				path.Join(logDir, dockerName + "-" + time.Now().Format(backupLogDateFormat)+ ".log"))
-			if err != nil {
-				log.Println("failed to move log", err)
-			}
-			return
-		}
-	}
-
-	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-	if err != nil {
-		log.Println(err)
+// serveStream writes batches of a connection after the handshake.
+func serveStream(conn *bufferedConn, stream *logStream) {
+	stream.client = clientHost(conn)
+	if stream.pipelined {
+		handlePipelined(conn, stream)
 		return
 	}
-
-	lock.Lock()
-	openFiles[f.Name()] = struct{}{}
-	lock.Unlock()
-
-	defer func() {
-		f.Close()
-		lock.Lock()
-		delete(openFiles, f.Name())
-		lock.Unlock()
-	}()
-
+	msg := &Msg{}
 	for {
-		if err := readMsg(conn, msg, 0); err != nil {
+		if err := readDataMsg(conn, msg, stream.config.IdleTimeout); err != nil {
 			log.Println("failed to read msg from", conn.RemoteAddr(), err)
 			return
 		}
-		log.Printf("got %d bytes from %s", msg.Len(), conn.RemoteAddr()) //todo
-		if _, err := f.Write(msg.Bytes()); err != nil {
-			sendResponse(conn, 500, timeout)
-			return
+		if msg.Len() == 0 && stream.heartbeat {
+			if err := sendResponse(conn, 200, timeout); err != nil {
+				log.Println("failed to write response", err)
+				return
+			}
+			continue
 		}
-		if err := sendResponse(conn, 200, timeout); err != nil {
+		log.Printf("got %d bytes from %s", msg.Len(), conn.RemoteAddr()) //todo
+		status := stream.Write(msg.Bytes())
+		if err := sendResponse(conn, status, timeout); err != nil {
 			log.Println("failed to write response", err)
 			return
 		}
-		currentSize += int64(msg.Len())
-		if currentSize >= maxLogSize {
-			log.Printf("closing connection with %s for log rotation", conn.RemoteAddr())
+		if status == statusTooManyRequests && stream.backpressure {
+			if err := sendRetryAfter(conn, stream.retryAfter); err != nil {
+				log.Println("failed to write response", err)
+				return
+			}
+			continue
+		}
+		if status != 200 && status != statusChecksumMismatch {
 			return
 		}
 	}
@@ -184,33 +235,64 @@ func isFileOpen(name string) bool {
 func gc(logPath string, maxAge time.Duration) {
 	log.Println("GC started")
 	now := time.Now()
-	files, err := ioutil.ReadDir(logPath)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	for _, f := range files {
-		if isFileOpen(f.Name()) {
-			continue
+	var dirs []string
+	err := filepath.Walk(logPath, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		if f.IsDir() {
+			if p != logPath && f.ModTime().Before(now.Add(-maxAge)) {
+				dirs = append(dirs, p)
+			}
+			return nil
+		}
+		if isFileOpen(p) {
+			return nil
 		}
 		if f.ModTime().Before(now.Add(-maxAge)) {
-			log.Println("removing log", f.Name(), f.ModTime())
-			if err := os.Remove(path.Join(logPath, f.Name())); err != nil {
+			log.Println("removing log", p, f.ModTime())
+			if err := os.Remove(p); err != nil {
 				log.Println(err)
-				continue
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	// nested dirs go after their parents, so they are removed first, non-empty dirs aren't removed
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Remove(dirs[i]); err == nil {
+			log.Println("removed empty dir", dirs[i])
+		}
 	}
 	log.Println("GC finished in", time.Since(now).Seconds(), "seconds")
 }
 
 func main() {
 	openFiles = map[string]struct{}{}
-	var logPath, listen string
-	var maxAge time.Duration
+	var logPath, listen, pathTemplate, fallbackPathTemplate, compression, metricsListen, errorsSuffix, dedupDir string
+	var maxAge, idleTimeout time.Duration
+	tlsConfig := TlsConfig{}
+	backpressureConfig := BackpressureConfig{}
 	flag.StringVar(&logPath, "log-path", "", "absolute logs path")
 	flag.StringVar(&listen, "listen", "", "listen address ip:port or :port")
 	flag.DurationVar(&maxAge, "max-age", 3 * 24 * time.Hour, "time to retain old logs based on last file modification time")
+	flag.StringVar(&pathTemplate, "path-template", "{{docker.name}}.log", "log path relative to -log-path with {{label}} placeholders, e.g. {{namespace}}/{{pod}}/{{container}}.log")
+	flag.StringVar(&fallbackPathTemplate, "fallback-path-template", "", "log path template used when -path-template labels are missing")
+	flag.StringVar(&compression, "compression", strings.Join(supportedCompression, ","), "comma separated compression codecs allowed for agents")
+	flag.StringVar(&metricsListen, "metricsListen", "", "ip:port of :port for /metrics")
+	flag.StringVar(&tlsConfig.CertFile, "tls-cert", "", "server certificate file, enables tls")
+	flag.StringVar(&tlsConfig.KeyFile, "tls-key", "", "server certificate key file")
+	flag.StringVar(&errorsSuffix, "errors-suffix", "", "write error and fatal records of json logs also to a file with this suffix before the extension, e.g. \".errors\" for app.errors.log")
+	flag.StringVar(&dedupDir, "dedup-dir", "", "dir to keep offsets of agent logs written to files, agents resending batches don't duplicate records if it's set")
+	flag.DurationVar(&backpressureConfig.MaxWriteLatency, "max-write-latency", 0, "reply 429 to agents for -retry-after after a log write slower than this, disabled if 0")
+	flag.Int64Var(&backpressureConfig.MaxClientRate, "max-client-rate", 0, "bytes per second received from one agent host before replying 429, disabled if 0")
+	flag.Uint64Var(&backpressureConfig.MinFreeDisk, "min-free-disk", 0, "free bytes of -log-path below which agents get 429, disabled if 0")
+	flag.DurationVar(&backpressureConfig.RetryAfter, "retry-after", 10 * time.Second, "retry-after hint for agents when writes are slow or the disk is full")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 5 * time.Minute, "close connections without batches or heartbeats for this time, disabled if 0")
+	flag.StringVar(&tlsConfig.ClientCaFile, "tls-client-ca", "", "CA bundle file to verify agents certificates, agents aren't verified if not set")
 	flag.Parse()
 
 	if logPath == "" {
@@ -219,15 +301,62 @@ func main() {
 	if listen == "" {
 		log.Fatalln("-listen argument isn't set")
 	}
+	config := &Config{LogDir: logPath, ErrorsSuffix: errorsSuffix, DedupDir: dedupDir, IdleTimeout: idleTimeout}
+	for _, t := range []string{pathTemplate, fallbackPathTemplate} {
+		if t == "" {
+			continue
+		}
+		template, err := NewPathTemplate(t)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		config.PathTemplates = append(config.PathTemplates, template)
+	}
+	if len(config.PathTemplates) == 0 {
+		log.Fatalln("-path-template argument isn't set")
+	}
+	for _, codec := range strings.Split(compression, ",") {
+		if codec = strings.TrimSpace(codec); codec == "" {
+			continue
+		}
+		if _, err := NewDecompressor(codec); err != nil {
+			log.Fatalln(err)
+		}
+		config.Compression = append(config.Compression, codec)
+	}
+	if tlsConfig != (TlsConfig{}) {
+		var err error
+		if config.Tls, err = NewTlsReloader(tlsConfig); err != nil {
+			log.Fatalln("failed to load tls certificates:", err)
+		}
+		go config.Tls.Watch()
+	}
+	if backpressureConfig != (BackpressureConfig{RetryAfter: backpressureConfig.RetryAfter}) {
+		config.Backpressure = NewBackpressure(backpressureConfig)
+		go config.Backpressure.Watch(logPath)
+	}
 	log.Println("log path is", logPath)
 	log.Println("listening on", listen)
 
 	go func(){
 		gc(logPath, maxAge)
+		if dedupDir != "" {
+			gc(dedupDir, maxAge)
+		}
 		ticker := time.NewTicker(time.Minute * 10).C
 		for range ticker {
 			gc(logPath, maxAge)
+			if dedupDir != "" {
+				gc(dedupDir, maxAge)
+			}
 		}
 	}()
-	log.Panic(listenAndServe(listen, logPath))
+	http.Handle("/metrics", promhttp.Handler())
+	if metricsListen != "" {
+		go func() {
+			log.Println("listening for /metrics on", metricsListen)
+			log.Fatal(http.ListenAndServe(metricsListen, nil))
+		}()
+	}
+	log.Panic(listenAndServe(listen, config))
 }
\ No newline at end of file
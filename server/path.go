@@ -0,0 +1,82 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"fmt"
+	"path"
+)
+
+var (
+	placeholderRe = regexp.MustCompile(`\{\{\s*([^{}]+?)\s*\}\}`)
+	unsafeCharsReplacer = strings.NewReplacer("/", "_", "\\", "_", "\x00", "_")
+)
+
+// PathTemplate is a log path relative to the log dir with {{label}} placeholders,
+// e.g. {{namespace}}/{{pod}}/{{container}}.log
+type PathTemplate struct {
+	template string
+}
+
+func NewPathTemplate(template string) (*PathTemplate, error) {
+	if strings.TrimSpace(template) == "" {
+		return nil, fmt.Errorf("empty path template")
+	}
+	if !placeholderRe.MatchString(template) {
+		return nil, fmt.Errorf("path template %q has no {{label}} placeholders", template)
+	}
+	return &PathTemplate{template: template}, nil
+}
+
+func (t *PathTemplate) String() string {
+	return t.template
+}
+
+func sanitizePathComponent(value string) string {
+	value = unsafeCharsReplacer.Replace(value)
+	if value == "." || value == ".." {
+		return "_"
+	}
+	return value
+}
+
+// Resolve returns the log path relative to the log dir, false if some label is missing.
+func (t *PathTemplate) Resolve(labels map[string]string) (string, bool) {
+	resolved := true
+	p := placeholderRe.ReplaceAllStringFunc(t.template, func(placeholder string) string {
+		name := placeholderRe.FindStringSubmatch(placeholder)[1]
+		value := labels[name]
+		if value == "" {
+			resolved = false
+		}
+		return sanitizePathComponent(value)
+	})
+	if !resolved {
+		return "", false
+	}
+	p = path.Clean("/" + p)[1:]
+	if p == "" {
+		return "", false
+	}
+	return p, true
+}
+
+func resolveLogPath(templates []*PathTemplate, labels map[string]string) (string, bool) {
+	for _, t := range templates {
+		if p, ok := t.Resolve(labels); ok {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+func backupLogPath(logPath string, suffix string) string {
+	ext := path.Ext(logPath)
+	return strings.TrimSuffix(logPath, ext) + "-" + suffix + ext
+}
+
+// errorsLogPath returns the errors file alongside the log, e.g. app.log -> app.errors.log for ".errors" suffix.
+func errorsLogPath(logPath string, suffix string) string {
+	ext := path.Ext(logPath)
+	return strings.TrimSuffix(logPath, ext) + suffix + ext
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"path"
+	"strings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPathTemplate(t *testing.T) {
+	_, err := NewPathTemplate("")
+	assert.Error(t, err)
+	_, err = NewPathTemplate("static.log")
+	assert.Error(t, err)
+	tmpl, err := NewPathTemplate("{{namespace}}/{{ pod }}.log")
+	require.NoError(t, err)
+	assert.Equal(t, "{{namespace}}/{{ pod }}.log", tmpl.String())
+}
+
+func TestSanitizePathComponent(t *testing.T) {
+	assert.Equal(t, "nginx", sanitizePathComponent("nginx"))
+	assert.Equal(t, "_", sanitizePathComponent("."))
+	assert.Equal(t, "_", sanitizePathComponent(".."))
+	assert.Equal(t, "..._etc_passwd", sanitizePathComponent(".../etc/passwd"))
+	assert.Equal(t, "a_b_c_", sanitizePathComponent("a/b\\c\x00"))
+	assert.Equal(t, "", sanitizePathComponent(""))
+}
+
+func TestPathTemplateResolve(t *testing.T) {
+	tmpl, err := NewPathTemplate("{{namespace}}/{{pod}}/{{container}}.log")
+	require.NoError(t, err)
+
+	p, ok := tmpl.Resolve(map[string]string{"namespace": "default", "pod": "nginx-1", "container": "nginx"})
+	assert.True(t, ok)
+	assert.Equal(t, "default/nginx-1/nginx.log", p)
+
+	_, ok = tmpl.Resolve(map[string]string{"namespace": "default", "pod": "nginx-1"})
+	assert.False(t, ok, "missing label")
+	_, ok = tmpl.Resolve(map[string]string{"namespace": "default", "pod": "", "container": "nginx"})
+	assert.False(t, ok, "empty label")
+
+	p, ok = tmpl.Resolve(map[string]string{"namespace": "..", "pod": "../../etc", "container": "/passwd"})
+	assert.True(t, ok)
+	assert.Equal(t, "_/.._.._etc/_passwd.log", p)
+}
+
+func TestPathTemplateStaysInLogDir(t *testing.T) {
+	root := "/var/log/oklogging"
+	templates := []string{"{{name}}", "{{name}}.log", "{{name}}/{{name}}", "../{{name}}.log", "/{{name}}/../../{{name}}"}
+	values := []string{".", "..", "/", "../..", "/etc/passwd", "..\\..", "a/../../b", "\x00"}
+	for _, template := range templates {
+		tmpl, err := NewPathTemplate(template)
+		require.NoError(t, err)
+		for _, value := range values {
+			p, ok := tmpl.Resolve(map[string]string{"name": value})
+			if !ok {
+				continue
+			}
+			full := path.Join(root, p)
+			assert.True(t, strings.HasPrefix(full, root + "/"), "%q with %q resolved to %q", template, value, full)
+		}
+	}
+}
+
+func TestResolveLogPath(t *testing.T) {
+	primary, err := NewPathTemplate("{{namespace}}/{{container}}.log")
+	require.NoError(t, err)
+	fallback, err := NewPathTemplate("{{docker.name}}.log")
+	require.NoError(t, err)
+	templates := []*PathTemplate{primary, fallback}
+
+	p, ok := resolveLogPath(templates, map[string]string{"namespace": "default", "container": "nginx", "docker.name": "k8s_nginx"})
+	assert.True(t, ok)
+	assert.Equal(t, "default/nginx.log", p)
+	p, ok = resolveLogPath(templates, map[string]string{"docker.name": "k8s_nginx"})
+	assert.True(t, ok)
+	assert.Equal(t, "k8s_nginx.log", p)
+	_, ok = resolveLogPath(templates, map[string]string{"container": "nginx"})
+	assert.False(t, ok)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	pipelineBufferSize = 64 * 1024
+)
+
+// pipelineAck acknowledges the batch and all previous ones, or reports an error status for the batch.
+type pipelineAck struct {
+	Seq uint64
+	Status int32
+}
+
+func sendAck(conn net.Conn, seq uint64, status int32) error {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if err := binary.Write(conn, binary.LittleEndian, pipelineAck{Seq: seq, Status: status}); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// handlePipelined writes batches prefixed with sequence numbers while the agent keeps sending them.
+// The last batch read is acknowledged when there are no more received frames, so one ack can cover many batches.
+// The connection is closed after a failed batch, including a checksum mismatch and statusTooManyRequests, so later
+// batches aren't written out of order and the agent sends all unacknowledged batches again.
+func handlePipelined(conn *bufferedConn, stream *logStream) {
+	msg := &Msg{}
+	// lastSeq is acknowledged again for heartbeats
+	lastSeq := uint64(0)
+	for {
+		if err := readDataMsg(conn, msg, stream.config.IdleTimeout); err != nil {
+			log.Println("failed to read msg from", conn.RemoteAddr(), err)
+			return
+		}
+		frame := msg.Bytes()
+		if len(frame) == 0 && stream.heartbeat {
+			if err := sendAck(conn, lastSeq, 200); err != nil {
+				log.Println("failed to write response", err)
+				return
+			}
+			continue
+		}
+		if len(frame) < 8 {
+			log.Println("invalid pipelined frame from", conn.RemoteAddr())
+			return
+		}
+		seq := binary.LittleEndian.Uint64(frame)
+		status := stream.Write(frame[8:])
+		if status == 200 {
+			lastSeq = seq
+		}
+		if status != 200 || conn.reader.Buffered() == 0 {
+			if err := sendAck(conn, seq, status); err != nil {
+				log.Println("failed to write response", err)
+				return
+			}
+		}
+		if status == statusTooManyRequests && stream.backpressure {
+			if err := sendRetryAfter(conn, stream.retryAfter); err != nil {
+				log.Println("failed to write response", err)
+			}
+			return
+		}
+		if status != 200 {
+			return
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// logStream writes batches of one agent log to its file, it's a connection or a stream of a multiplexed connection.
+type logStream struct {
+	config *Config
+	labels map[string]string
+	logPath string
+	f *os.File
+	errorsFile *os.File
+	errorsSize int64
+	splitErrors bool
+	// pipelined batches have sequence numbers and are acknowledged by handlePipelined
+	pipelined bool
+	// checksum is set if batches are prefixed with CRC32C
+	checksum bool
+	// dedup is set if batches start with agent input offsets
+	dedup bool
+	// dedupState is nil if written offsets aren't tracked for the stream
+	dedupState *dedupState
+	// client is the agent host sharing the throughput limit
+	client string
+	// backpressure is set if the agent reads retry-after hints and keeps the connection after statusTooManyRequests
+	backpressure bool
+	// retryAfter is the hint of the last statusTooManyRequests
+	retryAfter time.Duration
+	// heartbeat is set if empty frames keep the idle connection alive
+	heartbeat bool
+	decompressor Decompressor
+	currentSize int64
+}
+
+// openLogStream returns the status for the agent and the stream if it's 200, capabilities are enabled by the caller.
+func openLogStream(config *Config, labels map[string]string) (*logStream, int32) {
+	identity := labels[streamLabel]
+	delete(labels, streamLabel)
+	relativePath, ok := resolveLogPath(config.PathTemplates, labels)
+	if !ok {
+		log.Println("can't resolve log path for", labels)
+		return nil, 400
+	}
+	if config.ErrorsSuffix != "" && labels[formatLabel] != formatJson {
+		// only json records have levels, so other logs are written without the errors file
+		log.Println("errors aren't split for", labels[formatLabel], "format log", relativePath)
+	}
+	s := &logStream{
+		config: config,
+		labels: labels,
+		logPath: path.Join(config.LogDir, relativePath),
+		splitErrors: config.ErrorsSuffix != "" && labels[formatLabel] == formatJson,
+	}
+	if identity != "" && config.DedupDir != "" {
+		var err error
+		if s.dedupState, err = acquireDedupState(config.DedupDir, identity); err != nil {
+			log.Println("failed to load dedup state of", identity, err)
+			return nil, 500
+		}
+	}
+	if err := s.open(); err != nil {
+		log.Println("failed to open log", s.logPath, err)
+		s.Close()
+		return nil, 500
+	}
+	return s, 200
+}
+
+// enable turns on capabilities accepted for the stream, see acceptCapabilities.
+func (s *logStream) enable(accepted map[string]string) error {
+	if codec, ok := accepted[capCompression]; ok {
+		var err error
+		if s.decompressor, err = NewDecompressor(codec); err != nil {
+			return err
+		}
+	}
+	_, s.pipelined = accepted[capWindow]
+	s.checksum = accepted[capChecksum] == checksumCrc32c
+	s.dedup = accepted[capDedup] == dedupVersion
+	_, s.backpressure = accepted[capBackpressure]
+	_, s.heartbeat = accepted[capHeartbeat]
+	return nil
+}
+
+// open opens the log file, it's rotated first if it's too big.
+func (s *logStream) open() error {
+	s.currentSize = 0
+	if fi, err := os.Stat(s.logPath); err == nil {
+		s.currentSize = fi.Size()
+		if s.currentSize >= maxLogSize {
+			if err := os.Rename(s.logPath, backupLogPath(s.logPath, time.Now().Format(backupLogDateFormat))); err != nil {
+				log.Println("failed to move log", err)
+			} else {
+				s.currentSize = 0
+			}
+		}
+	}
+	if err := os.MkdirAll(path.Dir(s.logPath), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	lock.Lock()
+	openFiles[f.Name()] = struct{}{}
+	lock.Unlock()
+	return nil
+}
+
+func closeLog(f *os.File) {
+	f.Close()
+	lock.Lock()
+	delete(openFiles, f.Name())
+	lock.Unlock()
+}
+
+func (s *logStream) Close() {
+	if s.f != nil {
+		closeLog(s.f)
+		s.f = nil
+	}
+	if s.errorsFile != nil {
+		closeLog(s.errorsFile)
+		s.errorsFile = nil
+	}
+	if s.dedupState != nil {
+		s.dedupState.release()
+		s.dedupState = nil
+	}
+}
+
+// Write writes a batch and returns the status for the agent, the stream can be used after statusChecksumMismatch
+// and statusTooManyRequests with retryAfter.
+func (s *logStream) Write(msg []byte) int32 {
+	bytesReceived.Add(float64(len(msg)))
+	if after, reason := s.config.Backpressure.check(s.client, len(msg)); after > 0 {
+		backpressureResponses.WithLabelValues(reason).Inc()
+		s.retryAfter = after
+		return statusTooManyRequests
+	}
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			log.Println("failed to open log", s.logPath, err)
+			return 500
+		}
+	}
+	data := msg
+	if s.checksum {
+		var ok bool
+		if data, ok = verifyChecksum(msg); !ok {
+			log.Println("checksum mismatch of batch for", s.logPath)
+			checksumErrors.Inc()
+			return statusChecksumMismatch
+		}
+	}
+	end, marks := int64(0), []batchMark(nil)
+	if s.dedup {
+		var err error
+		if end, marks, data, err = decodeOffsets(data); err != nil {
+			log.Println("failed to decode batch offsets for", s.logPath, err)
+			return 400
+		}
+	}
+	if s.decompressor != nil {
+		var err error
+		if data, err = s.decompressor.Decompress(data); err != nil {
+			log.Println("failed to decompress msg for", s.logPath, err)
+			return 400
+		}
+	}
+	if s.dedupState == nil || end == 0 {
+		return s.write(data)
+	}
+	// records of the stream are written by one connection at a time
+	s.dedupState.lock.Lock()
+	defer s.dedupState.lock.Unlock()
+	trimmed, err := trimBatch(data, end, marks, s.dedupState.offset)
+	if err != nil {
+		log.Println("failed to deduplicate batch for", s.logPath, err)
+		return 400
+	}
+	duplicateBytes.Add(float64(len(data) - len(trimmed)))
+	if len(trimmed) > 0 {
+		if status := s.write(trimmed); status != 200 {
+			return status
+		}
+	}
+	if end > s.dedupState.offset {
+		if err := s.dedupState.save(end); err != nil {
+			log.Println("failed to save dedup state of", s.logPath, err)
+			return 500
+		}
+	}
+	return 200
+}
+
+// write appends data to the log and rotates it if it's too big.
+func (s *logStream) write(data []byte) int32 {
+	start := time.Now()
+	if _, err := s.f.Write(data); err != nil {
+		log.Println("failed to write log", s.logPath, err)
+		writeErrors.Inc()
+		return 500
+	}
+	if s.dedupState != nil {
+		// the saved offset isn't ahead of the log after a crash, so records are never lost
+		if err := s.f.Sync(); err != nil {
+			log.Println("failed to sync log", s.logPath, err)
+			writeErrors.Inc()
+			return 500
+		}
+	}
+	s.config.Backpressure.observeWrite(time.Since(start))
+	bytesWritten.Add(float64(len(data)))
+	if s.splitErrors {
+		s.writeErrors(data)
+	}
+	s.currentSize += int64(len(data))
+	if s.currentSize >= maxLogSize {
+		log.Println("rotating log", s.logPath)
+		closeLog(s.f)
+		s.f = nil
+		// the batch is written, the log is opened again on the next one if it fails now
+		if err := s.open(); err != nil {
+			log.Println("failed to open log", s.logPath, err)
+		}
+	}
+	return 200
+}
+
+func (s *logStream) writeErrors(data []byte) {
+	lines, count := errorLines(data)
+	if count == 0 {
+		return
+	}
+	errorRecords.Add(float64(count))
+	if s.errorsFile == nil {
+		var err error
+		if s.errorsFile, err = openErrorsLog(errorsLogPath(s.logPath, s.config.ErrorsSuffix)); err != nil {
+			log.Println("failed to open errors log", err)
+			return
+		}
+		s.errorsSize = 0
+		if fi, err := s.errorsFile.Stat(); err == nil {
+			s.errorsSize = fi.Size()
+		}
+	}
+	// the record is in the log anyway, so the batch isn't failed
+	if _, err := s.errorsFile.Write(lines); err != nil {
+		log.Println("failed to write errors log", err)
+		writeErrors.Inc()
+	}
+	s.errorsSize += int64(len(lines))
+	if s.errorsSize >= maxLogSize {
+		// it's rotated when it's opened for the next error records
+		log.Println("rotating errors log", s.errorsFile.Name())
+		closeLog(s.errorsFile)
+		s.errorsFile = nil
+	}
+}
+
+func (s *logStream) String() string {
+	return fmt.Sprintf("%s %v", s.logPath, s.labels)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testConfig writes logs to a temporary dir named by docker.name, it's removed by the returned func.
+func testConfig(t *testing.T) (*Config, func()) {
+	dir, err := ioutil.TempDir("", "logs")
+	require.NoError(t, err)
+	template, err := NewPathTemplate("{{docker.name}}.log")
+	require.NoError(t, err)
+	if openFiles == nil {
+		openFiles = map[string]struct{}{}
+	}
+	config := &Config{LogDir: dir, PathTemplates: []*PathTemplate{template}, Compression: supportedCompression}
+	return config, func() { os.RemoveAll(dir) }
+}
+
+func readLog(t *testing.T, config *Config, name string) string {
+	data, err := ioutil.ReadFile(path.Join(config.LogDir, name + ".log"))
+	require.NoError(t, err)
+	return string(data)
+}
+
+// openTestStream opens a stream with capabilities accepted for the requested ones.
+func openTestStream(t *testing.T, config *Config, labels map[string]string, requested map[string]string) *logStream {
+	stream, status := openLogStream(config, labels)
+	require.Equal(t, int32(200), status)
+	require.NoError(t, stream.enable(acceptCapabilities(config, requested)))
+	return stream
+}
+
+func TestLogStreamChecksum(t *testing.T) {
+	config, cleanup := testConfig(t)
+	defer cleanup()
+	stream := openTestStream(t, config, map[string]string{"docker.name": "a"}, map[string]string{capChecksum: checksumCrc32c})
+	defer stream.Close()
+
+	corrupted := withChecksum([]byte("a\n"))
+	corrupted[checksumSize] = 'b'
+	assert.Equal(t, int32(statusChecksumMismatch), stream.Write(corrupted))
+	assert.Equal(t, "", readLog(t, config, "a"))
+	// the stream is kept, so the batch is sent again
+	assert.Equal(t, int32(200), stream.Write(withChecksum([]byte("a\n"))))
+	assert.Equal(t, "a\n", readLog(t, config, "a"))
+
+	// checksums are verified before decompression
+	stream = openTestStream(t, config, map[string]string{"docker.name": "b"}, map[string]string{capChecksum: checksumCrc32c, capCompression: compressionSnappy})
+	defer stream.Close()
+	assert.Equal(t, int32(statusChecksumMismatch), stream.Write([]byte("not a checksum")))
+	assert.Equal(t, int32(400), stream.Write(withChecksum([]byte("not snappy"))))
+	assert.Equal(t, "", readLog(t, config, "b"))
+}
+
+func TestLogStreamErrors(t *testing.T) {
+	config, cleanup := testConfig(t)
+	defer cleanup()
+	config.ErrorsSuffix = ".errors"
+	stream, status := openLogStream(config, map[string]string{"docker.name": "a", formatLabel: formatJson})
+	require.Equal(t, int32(200), status)
+	defer stream.Close()
+	records := "{\"level\":\"info\",\"msg\":\"a\"}\n{\"level\":\"error\",\"msg\":\"b\"}\n"
+	require.Equal(t, int32(200), stream.Write([]byte(records)))
+	assert.Equal(t, records, readLog(t, config, "a"))
+	assert.Equal(t, "{\"level\":\"error\",\"msg\":\"b\"}\n", readLog(t, config, "a.errors"))
+
+	// records of other formats don't have levels
+	stream, status = openLogStream(config, map[string]string{"docker.name": "b", formatLabel: "raw"})
+	require.Equal(t, int32(200), status)
+	defer stream.Close()
+	require.Equal(t, int32(200), stream.Write([]byte(records)))
+	_, err := os.Stat(path.Join(config.LogDir, "b.errors.log"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	tlsReloadInterval = 10 * time.Second
+)
+
+type TlsConfig struct {
+	CertFile string
+	KeyFile string
+	// ClientCaFile enables agents certificates verification
+	ClientCaFile string
+}
+
+// TlsReloader keeps certificates loaded from TlsConfig files and reloads them when the files change.
+type TlsReloader struct {
+	config TlsConfig
+	lock sync.RWMutex
+	cert *tls.Certificate
+	clientCas *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+func NewTlsReloader(config TlsConfig) (*TlsReloader, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, fmt.Errorf("both tls cert and key files should be set")
+	}
+	r := &TlsReloader{config: config}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *TlsReloader) files() []string {
+	var files []string
+	for _, f := range []string{r.config.CertFile, r.config.KeyFile, r.config.ClientCaFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (r *TlsReloader) readModTimes() (map[string]time.Time, error) {
+	modTimes := map[string]time.Time{}
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[f] = fi.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (r *TlsReloader) load() error {
+	modTimes, err := r.readModTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return err
+	}
+	var clientCas *x509.CertPool
+	if r.config.ClientCaFile != "" {
+		ca, err := ioutil.ReadFile(r.config.ClientCaFile)
+		if err != nil {
+			return err
+		}
+		clientCas = x509.NewCertPool()
+		if !clientCas.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("no certificates found in %s", r.config.ClientCaFile)
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert, r.clientCas, r.modTimes = &cert, clientCas, modTimes
+	return nil
+}
+
+func (r *TlsReloader) changed() bool {
+	modTimes, err := r.readModTimes()
+	if err != nil {
+		log.Println("failed to check tls files", err)
+		return false
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for f, t := range modTimes {
+		if !t.Equal(r.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads certificates on files change, the previous ones are kept if new ones are invalid.
+func (r *TlsReloader) Watch() {
+	ticker := time.NewTicker(tlsReloadInterval).C
+	for range ticker {
+		if !r.changed() {
+			continue
+		}
+		if err := r.load(); err != nil {
+			log.Println("failed to reload tls certificates", err)
+			continue
+		}
+		log.Println("tls certificates reloaded")
+	}
+}
+
+// ServerConfig returns a config picking the current certificates for every handshake.
+func (r *TlsReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			config := &tls.Config{Certificates: []tls.Certificate{*r.cert}}
+			if r.clientCas != nil {
+				config.ClientCAs = r.clientCas
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCa issues certificates for servers and agents.
+type testCa struct {
+	cert *x509.Certificate
+	key *ecdsa.PrivateKey
+	pem []byte
+}
+
+func newTestCa(t *testing.T) *testCa {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "test ca"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IsCA: true,
+		KeyUsage: x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCa{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the certificate and key for the name, they are valid for servers and agents.
+func (ca *testCa) issue(t *testing.T, name string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// writeTlsFile writes the file with a new modification time, so reloads notice it on filesystems with coarse times.
+func writeTlsFile(t *testing.T, dir, name string, data []byte) string {
+	f := path.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(f, data, 0600))
+	modTime := time.Unix(time.Now().Unix() + tlsFileWrites, 0)
+	tlsFileWrites++
+	require.NoError(t, os.Chtimes(f, modTime, modTime))
+	return f
+}
+
+var tlsFileWrites int64
+
+// tlsListen accepts connections with the reloader config and replies "ok" until it's closed.
+func tlsListen(t *testing.T, r *TlsReloader) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l = tls.NewListener(l, r.ServerConfig())
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("ok"))
+			}()
+		}
+	}()
+	return l
+}
+
+// agentConfig trusts the ca and presents the agent certificate if it's set.
+func agentConfig(t *testing.T, ca *testCa, serverName string, certPem, keyPem []byte) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots, ServerName: serverName}
+	if certPem != nil {
+		cert, err := tls.X509KeyPair(certPem, keyPem)
+		require.NoError(t, err)
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config
+}
+
+// tlsDial returns the server reply, agent certificates are verified by the server after the handshake.
+func tlsDial(addr string, config *tls.Config) (string, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func TestTlsReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCa(t)
+	certPem, keyPem := ca.issue(t, "logs.example")
+	r, err := NewTlsReloader(TlsConfig{
+		CertFile: writeTlsFile(t, dir, "server.pem", certPem),
+		KeyFile: writeTlsFile(t, dir, "server-key.pem", keyPem),
+		ClientCaFile: writeTlsFile(t, dir, "ca.pem", ca.pem),
+	})
+	require.NoError(t, err)
+	l := tlsListen(t, r)
+	defer l.Close()
+	addr := l.Addr().String()
+
+	agentCert, agentKey := ca.issue(t, "agent")
+	reply, err := tlsDial(addr, agentConfig(t, ca, "logs.example", agentCert, agentKey))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", reply)
+	// agents without certificates or with certificates of another ca are rejected
+	_, err = tlsDial(addr, agentConfig(t, ca, "logs.example", nil, nil))
+	assert.Error(t, err)
+	otherCert, otherKey := newTestCa(t).issue(t, "agent")
+	_, err = tlsDial(addr, agentConfig(t, ca, "logs.example", otherCert, otherKey))
+	assert.Error(t, err)
+
+	// agents aren't verified without the client ca
+	r, err = NewTlsReloader(TlsConfig{CertFile: path.Join(dir, "server.pem"), KeyFile: path.Join(dir, "server-key.pem")})
+	require.NoError(t, err)
+	plain := tlsListen(t, r)
+	defer plain.Close()
+	reply, err = tlsDial(plain.Addr().String(), agentConfig(t, ca, "logs.example", nil, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", reply)
+
+	_, err = NewTlsReloader(TlsConfig{CertFile: path.Join(dir, "server.pem")})
+	assert.Error(t, err)
+}
+
+func TestTlsReloaderReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCa(t)
+	certPem, keyPem := ca.issue(t, "logs.example")
+	r, err := NewTlsReloader(TlsConfig{
+		CertFile: writeTlsFile(t, dir, "server.pem", certPem),
+		KeyFile: writeTlsFile(t, dir, "server-key.pem", keyPem),
+	})
+	require.NoError(t, err)
+	l := tlsListen(t, r)
+	defer l.Close()
+	addr := l.Addr().String()
+	_, err = tlsDial(addr, agentConfig(t, ca, "logs.example", nil, nil))
+	require.NoError(t, err)
+	assert.False(t, r.changed())
+
+	// new certificates are used by the next handshakes
+	certPem, keyPem = ca.issue(t, "logs2.example")
+	writeTlsFile(t, dir, "server.pem", certPem)
+	writeTlsFile(t, dir, "server-key.pem", keyPem)
+	require.True(t, r.changed())
+	require.NoError(t, r.load())
+	_, err = tlsDial(addr, agentConfig(t, ca, "logs2.example", nil, nil))
+	require.NoError(t, err)
+	_, err = tlsDial(addr, agentConfig(t, ca, "logs.example", nil, nil))
+	assert.Error(t, err)
+
+	// invalid files are reported and the loaded certificates are kept
+	writeTlsFile(t, dir, "server-key.pem", []byte("not a key"))
+	require.True(t, r.changed())
+	assert.Error(t, r.load())
+	_, err = tlsDial(addr, agentConfig(t, ca, "logs2.example", nil, nil))
+	assert.NoError(t, err)
+}